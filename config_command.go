@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/mostlygeek/llama-swap/proxy/config"
+	"gopkg.in/yaml.v3"
+)
+
+// runConfigCommand handles `llama-swap config <subcommand>` and returns the exit code
+func runConfigCommand(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] != "check" {
+		fmt.Fprintln(stderr, "Usage: llama-swap config check [-config config.yaml] [-overlay name] [-format yaml|json]")
+		return 2
+	}
+
+	flags := flag.NewFlagSet("config check", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configPath := flags.String("config", "config.yaml", "config file name")
+	format := flags.String("format", "yaml", "output format: yaml or json")
+	overlay := flags.String("overlay", "", "config overlays to apply, comma separated (default: the overlay named after the hostname)")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	if *format != "yaml" && *format != "json" {
+		fmt.Fprintf(stderr, "Error: unknown format %q, must be yaml or json\n", *format)
+		return 2
+	}
+
+	_, conf, err := loadConfig(*configPath, *overlay)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %s is not valid:\n", *configPath)
+		printConfigErrors(stderr, err)
+		return 1
+	}
+
+	resolved := conf.Resolve()
+	switch *format {
+	case "json":
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(resolved)
+	default:
+		encoder := yaml.NewEncoder(stdout)
+		encoder.SetIndent(2)
+		err = encoder.Encode(resolved)
+		if err == nil {
+			err = encoder.Close()
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+// printConfigErrors prints each configuration error on its own line
+func printConfigErrors(w io.Writer, err error) {
+	var validationErrs config.ValidationErrors
+	if !errors.As(err, &validationErrs) {
+		fmt.Fprintf(w, "  - %v\n", err)
+		return
+	}
+	for _, e := range validationErrs {
+		fmt.Fprintf(w, "  - %v\n", e)
+	}
+}
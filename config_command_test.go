@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func writeTestConfig(t *testing.T, content string) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "hf_token"), []byte("hf_secret123\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	content = strings.ReplaceAll(content, "${tokenfile}", filepath.ToSlash(filepath.Join(dir, "hf_token")))
+	configPath := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return configPath
+}
+
+func runConfigCheck(args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := runConfigCommand(append([]string{"check"}, args...), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+const validTestConfig = `
+models:
+  model1:
+    cmd: llama-server --port ${PORT} --hf-token ${file:${tokenfile}}
+peers:
+  peer1:
+    proxy: http://192.168.1.23
+    apiKey: ${file:${tokenfile}}
+    models: [model-a]
+`
+
+func TestConfigCommand_Valid(t *testing.T) {
+	configPath := writeTestConfig(t, validTestConfig)
+
+	code, stdout, stderr := runConfigCheck("-config", configPath)
+	assert.Equal(t, 0, code)
+	assert.Empty(t, stderr)
+
+	var resolved map[string]any
+	if assert.NoError(t, yaml.Unmarshal([]byte(stdout), &resolved)) {
+		assert.Contains(t, resolved["models"], "model1")
+	}
+
+	// secrets are never printed
+	assert.NotContains(t, stdout, "hf_secret123")
+	assert.Contains(t, stdout, "--hf-token ********")
+}
+
+func TestConfigCommand_Format(t *testing.T) {
+	configPath := writeTestConfig(t, validTestConfig)
+
+	code, stdout, _ := runConfigCheck("-config", configPath, "-format", "json")
+	assert.Equal(t, 0, code)
+	var resolved struct {
+		Models map[string]struct {
+			Cmd string `json:"cmd"`
+		} `json:"models"`
+		Peers map[string]struct {
+			ApiKey string `json:"apiKey"`
+		} `json:"peers"`
+	}
+	if assert.NoError(t, json.Unmarshal([]byte(stdout), &resolved)) {
+		assert.Equal(t, "llama-server --port 5800 --hf-token ********", resolved.Models["model1"].Cmd)
+		assert.Equal(t, "********", resolved.Peers["peer1"].ApiKey)
+	}
+	assert.NotContains(t, stdout, "hf_secret123")
+
+	code, _, stderr := runConfigCheck("-config", configPath, "-format", "toml")
+	assert.Equal(t, 2, code)
+	assert.Contains(t, stderr, `unknown format "toml"`)
+}
+
+func TestConfigCommand_Invalid(t *testing.T) {
+	configPath := writeTestConfig(t, `
+models:
+  model1:
+    cmd: llama-server --port ${PORT} ${unknown}
+  model2:
+    cmd: llama-server --port ${PORT}
+groups:
+  group1:
+    members: [model2, typo-model]
+profiles:
+  coding: [model2, nope]
+`)
+
+	code, stdout, stderr := runConfigCheck("-config", configPath)
+	assert.Equal(t, 1, code)
+	assert.Empty(t, stdout)
+
+	// every error is listed so they can all be fixed at once
+	assert.Contains(t, stderr, configPath+" is not valid:")
+	assert.Contains(t, stderr, "unknown macro '${unknown}' found in model1.cmd")
+	assert.Contains(t, stderr, "group group1: unknown model typo-model")
+	assert.Contains(t, stderr, "profile coding: unknown model nope")
+	assert.Equal(t, 3, strings.Count(stderr, "\n  - "))
+}
+
+func TestConfigCommand_Usage(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	assert.Equal(t, 2, runConfigCommand(nil, &stdout, &stderr))
+	assert.Contains(t, stderr.String(), "Usage: llama-swap config check")
+
+	code, _, stderr2 := runConfigCheck("-config", filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr2, "is not valid")
+}
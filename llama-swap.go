@@ -9,6 +9,7 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
@@ -26,6 +27,14 @@ var (
 )
 
 func main() {
+	// subcommands are handled before the server flags are parsed
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(runConfigCommand(os.Args[2:], os.Stdout, os.Stderr))
+	}
+	if len(os.Args) > 1 && os.Args[1] == proxy.LimitsShimArg {
+		os.Exit(proxy.RunLimitsShim(os.Args[2:], os.Stderr))
+	}
+
 	// Define a command-line flag for the port
 	configPath := flag.String("config", "config.yaml", "config file name")
 	listenStr := flag.String("listen", "", "listen ip/port")
@@ -33,6 +42,7 @@ func main() {
 	keyFile := flag.String("tls-key-file", "", "TLS key file")
 	showVersion := flag.Bool("version", false, "show version of build")
 	watchConfig := flag.Bool("watch-config", false, "Automatically reload config file on change")
+	overlay := flag.String("overlay", "", "config overlays to apply, comma separated (default: the overlay named after the hostname)")
 
 	flag.Parse() // Parse the command-line flags
 
@@ -41,14 +51,15 @@ func main() {
 		os.Exit(0)
 	}
 
-	conf, err := config.LoadConfig(*configPath)
+	_, conf, err := loadConfig(*configPath, *overlay)
 	if err != nil {
-		fmt.Printf("Error loading config: %v\n", err)
+		fmt.Println("Error loading config:")
+		printConfigErrors(os.Stdout, err)
 		os.Exit(1)
 	}
 
-	if len(conf.Profiles) > 0 {
-		fmt.Println("WARNING: Profile functionality has been removed in favor of Groups. See the README for more information.")
+	if overlays := conf.Overlays(); len(overlays) > 0 {
+		fmt.Printf("Using config overlays: %s\n", strings.Join(overlays, ", "))
 	}
 
 	if mode := os.Getenv("GIN_MODE"); mode != "" {
@@ -84,20 +95,36 @@ func main() {
 		Addr: *listenStr,
 	}
 
+	// the watcher is told about include paths after every reload as they may change
+	includesChanged := make(chan []string, 1)
+	notifyIncludes := func(paths []string) {
+		select {
+		case <-includesChanged:
+		default:
+		}
+		includesChanged <- paths
+	}
+
 	// Support for watching config and reloading when it changes
 	reloadProxyManager := func() {
+		// the source is kept so models can be changed through the API
+		source, newConf, err := loadConfig(*configPath, *overlay)
+		if err == nil {
+			conf = newConf
+		}
+
 		if currentPM, ok := srv.Handler.(*proxy.ProxyManager); ok {
-			conf, err = config.LoadConfig(*configPath)
 			if err != nil {
-				fmt.Printf("Warning, unable to reload configuration: %v\n", err)
+				fmt.Println("Warning, unable to reload configuration:")
+				printConfigErrors(os.Stdout, err)
 				return
 			}
 
 			fmt.Println("Configuration Changed")
-			currentPM.Shutdown()
-			newPM := proxy.New(conf)
-			newPM.SetVersion(date, commit, version)
-			srv.Handler = newPM
+			notifyIncludes(conf.IncludePaths())
+			// only models with a changed configuration are restarted, the new
+			// ProxyManager is handed to OnReload
+			currentPM.ReloadConfigFile(source, conf)
 			fmt.Println("Configuration Reloaded")
 
 			// wait a few seconds and tell any UI to reload
@@ -107,13 +134,17 @@ func main() {
 				})
 			})
 		} else {
-			conf, err = config.LoadConfig(*configPath)
 			if err != nil {
-				fmt.Printf("Error, unable to load configuration: %v\n", err)
+				fmt.Println("Error, unable to load configuration:")
+				printConfigErrors(os.Stdout, err)
 				os.Exit(1)
 			}
 			newPM := proxy.New(conf)
 			newPM.SetVersion(date, commit, version)
+			newPM.SetConfigSource(source)
+			newPM.OnReload(func(newPM *proxy.ProxyManager) {
+				srv.Handler = newPM
+			})
 			srv.Handler = newPM
 		}
 	}
@@ -129,6 +160,7 @@ func main() {
 		})()
 
 		fmt.Println("Watching Configuration for changes")
+		initialIncludePaths := conf.IncludePaths()
 		go func() {
 			absConfigPath, err := filepath.Abs(*configPath)
 			if err != nil {
@@ -148,11 +180,41 @@ func main() {
 				return
 			}
 
+			// also watch the directories of included files, these can change on reload
+			watchedDirs := map[string]bool{configDir: true}
+			var includePaths []string
+			watchIncludes := func(paths []string) {
+				includePaths = paths
+				for _, includePath := range paths {
+					includeDir := filepath.Dir(includePath)
+					if watchedDirs[includeDir] {
+						continue
+					}
+					if err := watcher.Add(includeDir); err != nil {
+						fmt.Printf("Error adding include directory (%s) to watcher: %v\n", includeDir, err)
+						continue
+					}
+					watchedDirs[includeDir] = true
+				}
+			}
+			watchIncludes(initialIncludePaths)
+
+			isIncluded := func(name string) bool {
+				for _, pattern := range includePaths {
+					if matched, _ := filepath.Match(pattern, name); matched {
+						return true
+					}
+				}
+				return false
+			}
+
 			defer watcher.Close()
 			for {
 				select {
+				case paths := <-includesChanged:
+					watchIncludes(paths)
 				case changeEvent := <-watcher.Events:
-					if changeEvent.Name == absConfigPath && (changeEvent.Has(fsnotify.Write) || changeEvent.Has(fsnotify.Create) || changeEvent.Has(fsnotify.Remove)) {
+					if (changeEvent.Name == absConfigPath || isIncluded(changeEvent.Name)) && (changeEvent.Has(fsnotify.Write) || changeEvent.Has(fsnotify.Create) || changeEvent.Has(fsnotify.Remove)) {
 						event.Emit(proxy.ConfigFileChangedEvent{
 							ReloadingState: proxy.ReloadingStateStart,
 						})
@@ -217,3 +279,14 @@ func debounce(interval time.Duration, f func()) func() {
 		timer = time.AfterFunc(interval, f)
 	}
 }
+
+// loadConfig reads the config file and applies the selected overlays
+func loadConfig(path, overlay string) (*config.Source, config.Config, error) {
+	source, err := config.ReadSource(path)
+	if err != nil {
+		return nil, config.Config{}, err
+	}
+	source.Overlay = overlay
+	conf, err := source.Load()
+	return source, conf, err
+}
@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mostlygeek/llama-swap/event"
+)
+
+// autoscaler starts and stops the replicas of models with maxReplicas. A replica is
+// started when the requests per ready replica stay over scaleUpThreshold for
+// scaleWindow seconds. Replicas over minReplicas are stopped by their ttl, or after
+// scaleWindow seconds without requests when the model has no ttl. The ttl only stops
+// the last minReplicas once all of them reached it, which unloads the model.
+type autoscaler struct {
+	pm     *ProxyManager
+	models []*scaledModel
+}
+
+type scaledModel struct {
+	id       string
+	replicas []*Process
+
+	// when the requests per replica went over the threshold, zero while they are not
+	overSince time.Time
+
+	// replicas that reach their ttl together are stopped one at a time
+	ttlMutex sync.Mutex
+}
+
+// newAutoscaler sets an autoscaler on every replica of models with maxReplicas and
+// starts scaling them
+func newAutoscaler(pm *ProxyManager) *autoscaler {
+	a := &autoscaler{pm: pm}
+
+	for _, group := range pm.processGroups {
+		for modelID, replicas := range group.replicas {
+			scaled := replicas[0].config.MaxReplicas > 0
+			for _, process := range replicas {
+				if scaled {
+					process.autoscaler.Store(a)
+				} else {
+					// kept processes may have been scaled by the previous configuration
+					process.autoscaler.Store(nil)
+				}
+			}
+			if scaled {
+				a.models = append(a.models, &scaledModel{id: modelID, replicas: replicas})
+			}
+		}
+	}
+
+	if len(a.models) > 0 {
+		go a.run()
+	}
+	return a
+}
+
+// run checks the models every second until the ProxyManager shuts down
+func (a *autoscaler) run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.pm.shutdownCtx.Done():
+			return
+		case <-ticker.C:
+			for _, model := range a.models {
+				a.scale(model, time.Now())
+			}
+		}
+	}
+}
+
+// scale starts or stops at most one replica of the model
+func (a *autoscaler) scale(model *scaledModel, now time.Time) {
+	modelConfig := model.replicas[0].config
+	window := time.Duration(modelConfig.ScaleWindow) * time.Second
+
+	running, ready, load := 0, 0, 0
+	for _, process := range model.replicas {
+		switch process.CurrentState() {
+		case StateReady:
+			ready++
+			running++
+			load += process.load()
+		case StateStarting, StateStopping:
+			running++
+		}
+	}
+
+	// the model is not loaded or a replica is still starting or stopping
+	if ready == 0 || running > ready {
+		model.overSince = time.Time{}
+		return
+	}
+
+	if load > modelConfig.ScaleUpThreshold*ready {
+		if model.overSince.IsZero() {
+			model.overSince = now
+		} else if now.Sub(model.overSince) >= window && running < len(model.replicas) {
+			model.overSince = time.Time{}
+			for _, process := range model.replicas {
+				if process.CurrentState() == StateStopped {
+					a.pm.proxyLogger.Infof("<%s> Scaling up to %d replicas, %d requests on %d replicas", model.id, running+1, load, ready)
+					startReplica(process)
+					a.emit(process, ModelScaleUp, running+1, "requests over scaleUpThreshold")
+					return
+				}
+			}
+		}
+		return
+	}
+	model.overSince = time.Time{}
+
+	// with a ttl the replicas are stopped by it
+	if modelConfig.UnloadAfter > 0 || running <= modelConfig.MinReplicas {
+		return
+	}
+	for i := len(model.replicas) - 1; i >= 0; i-- {
+		process := model.replicas[i]
+		if process.CurrentState() == StateReady && process.load() == 0 && now.Sub(process.getLastRequestHandled()) > window {
+			a.pm.proxyLogger.Infof("<%s> Scaling down to %d replicas, replica %d is idle", model.id, running-1, process.replica)
+			go process.Stop()
+			a.emit(process, ModelScaleDown, running-1, "idle")
+			return
+		}
+	}
+}
+
+// stopAfterTTL stops a replica that reached its ttl, it returns false when the replica
+// is kept running for minReplicas because other replicas still handle requests
+func (a *autoscaler) stopAfterTTL(p *Process) bool {
+	var model *scaledModel
+	for _, scaled := range a.models {
+		if scaled.id == p.ID {
+			model = scaled
+		}
+	}
+	if model == nil {
+		p.Stop()
+		return true
+	}
+
+	model.ttlMutex.Lock()
+	defer model.ttlMutex.Unlock()
+
+	ttl := time.Duration(p.config.UnloadAfter) * time.Second
+	running, expired := 0, 0
+	for _, process := range model.replicas {
+		if !isRunning([]*Process{process}) {
+			continue
+		}
+		running++
+		if process.CurrentState() == StateReady && process.load() == 0 && time.Since(process.getLastRequestHandled()) > ttl {
+			expired++
+		}
+	}
+	if running <= p.config.MinReplicas && expired < running {
+		return false
+	}
+
+	p.proxyLogger.Infof("<%s> Unloading replica %d, TTL of %ds reached", p.ID, p.replica, p.config.UnloadAfter)
+	p.Stop()
+	a.emit(p, ModelScaleDown, running-1, "TTL reached")
+	return true
+}
+
+func (a *autoscaler) emit(p *Process, action ModelScaleAction, replicas int, reason string) {
+	event.Emit(ModelScaledEvent{
+		ModelID:  p.ID,
+		Replica:  p.replica,
+		Action:   action,
+		Replicas: replicas,
+		Reason:   reason,
+	})
+}
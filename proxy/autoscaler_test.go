@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mostlygeek/llama-swap/event"
+	"github.com/mostlygeek/llama-swap/proxy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyManager_Autoscaling(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping long autoscaling test")
+	}
+
+	port := getTestPort()
+	getTestPort() // the second replica listens on port+1
+
+	cfg := config.AddDefaultGroupToConfig(config.Config{
+		HealthCheckTimeout: 15,
+		Models: map[string]config.ModelConfig{
+			"model1": {
+				Cmd:              fmt.Sprintf("%s --port ${PORT} --silent --respond model1", filepath.ToSlash(simpleResponderPath)),
+				Proxy:            "http://127.0.0.1:${PORT}",
+				Port:             port,
+				Replicas:         2,
+				MinReplicas:      1,
+				MaxReplicas:      2,
+				ScaleUpThreshold: 1,
+				ScaleWindow:      1,
+			},
+		},
+		LogLevel: "error",
+	})
+
+	var mu sync.Mutex
+	var scaled []ModelScaledEvent
+	defer event.On(func(e ModelScaledEvent) {
+		mu.Lock()
+		scaled = append(scaled, e)
+		mu.Unlock()
+	})()
+	waitForScaled := func(n int) bool {
+		t.Helper()
+		return assert.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(scaled) >= n
+		}, 10*time.Second, 10*time.Millisecond)
+	}
+
+	proxy := New(cfg)
+	defer proxy.StopProcesses(StopWaitForInflightRequest)
+	replicas := proxy.findGroupByModelName("model1").replicas["model1"]
+
+	// only minReplicas are started with the model
+	w := CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "/upstream/model1/test", nil))
+	assert.Equal(t, StateReady, replicas[0].CurrentState())
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, StateStopped, replicas[1].CurrentState())
+
+	// two requests on one replica for the scaleWindow start the second one
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := CreateTestResponseRecorder()
+			proxy.ServeHTTP(w, httptest.NewRequest("GET", "/upstream/model1/slow-respond?echo=1234&delay=1s", nil))
+		}()
+	}
+	if !waitForScaled(1) {
+		return
+	}
+	mu.Lock()
+	assert.Equal(t, ModelScaledEvent{ModelID: "model1", Replica: 1, Action: ModelScaleUp, Replicas: 2, Reason: "requests over scaleUpThreshold"}, scaled[0])
+	mu.Unlock()
+	assert.Eventually(t, func() bool {
+		return replicas[1].CurrentState() == StateReady
+	}, 5*time.Second, 10*time.Millisecond)
+	wg.Wait()
+
+	// without a ttl the idle replica is stopped after the scaleWindow
+	if !waitForScaled(2) {
+		return
+	}
+	mu.Lock()
+	assert.Equal(t, ModelScaledEvent{ModelID: "model1", Replica: 1, Action: ModelScaleDown, Replicas: 1, Reason: "idle"}, scaled[1])
+	mu.Unlock()
+	assert.Eventually(t, func() bool {
+		return replicas[1].CurrentState() == StateStopped
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, StateReady, replicas[0].CurrentState())
+}
+
+func TestProxyManager_AutoscalingTTLKeepsMinReplicas(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping long autoscaling test")
+	}
+
+	port := getTestPort()
+	getTestPort() // the second replica listens on port+1
+
+	cfg := config.AddDefaultGroupToConfig(config.Config{
+		HealthCheckTimeout: 15,
+		Models: map[string]config.ModelConfig{
+			"model1": {
+				Cmd:              fmt.Sprintf("%s --port ${PORT} --silent --respond model1", filepath.ToSlash(simpleResponderPath)),
+				Proxy:            "http://127.0.0.1:${PORT}",
+				Port:             port,
+				Replicas:         2,
+				MinReplicas:      2,
+				MaxReplicas:      2,
+				ScaleUpThreshold: 1,
+				ScaleWindow:      1,
+				UnloadAfter:      1,
+			},
+		},
+		LogLevel: "error",
+	})
+
+	proxy := New(cfg)
+	defer proxy.StopProcesses(StopWaitForInflightRequest)
+	replicas := proxy.findGroupByModelName("model1").replicas["model1"]
+
+	w := CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "/upstream/model1/test", nil))
+	assert.Eventually(t, func() bool {
+		return replicas[0].CurrentState() == StateReady && replicas[1].CurrentState() == StateReady
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the idle replica is kept past its ttl while the other one handles a request
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w := CreateTestResponseRecorder()
+		proxy.ServeHTTP(w, httptest.NewRequest("GET", "/upstream/model1/slow-respond?echo=1234&delay=1s", nil))
+	}()
+	time.Sleep(3 * time.Second)
+	assert.Equal(t, StateReady, replicas[0].CurrentState())
+	assert.Equal(t, StateReady, replicas[1].CurrentState())
+	<-done
+
+	// once every replica reached the ttl the model is unloaded
+	assert.Eventually(t, func() bool {
+		return replicas[0].CurrentState() == StateStopped && replicas[1].CurrentState() == StateStopped
+	}, 10*time.Second, 10*time.Millisecond)
+}
@@ -5,9 +5,12 @@ import (
 	"io"
 	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
 	"runtime"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/billziss-gh/golib/shlex"
@@ -15,6 +18,10 @@ import (
 )
 
 const DEFAULT_GROUP_ID = "(default)"
+
+// PROFILE_SPLIT_CHAR separates the profile and the model in a `profile:model` name
+const PROFILE_SPLIT_CHAR = ":"
+
 const (
 	LogToStdoutProxy    = "proxy"
 	LogToStdoutUpstream = "upstream"
@@ -110,12 +117,24 @@ func (c *GroupConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 
 type HooksConfig struct {
 	OnStartup HookOnStartup `yaml:"on_startup"`
+
+	// hooks of every model, see LifecycleHooks
+	LifecycleHooks `yaml:",inline"`
 }
 
 type HookOnStartup struct {
 	Preload []string `yaml:"preload"`
 }
 
+// PriorityClass orders the requests waiting in a model's queue, see maxQueueSize
+type PriorityClass struct {
+	// higher is served first, requests without a class have priority 0
+	Priority int `yaml:"priority"`
+
+	// requests using one of these keys are in the class
+	APIKeys []string `yaml:"apiKeys"`
+}
+
 type Config struct {
 	HealthCheckTimeout int                    `yaml:"healthCheckTimeout"`
 	LogRequests        bool                   `yaml:"logRequests"`
@@ -143,14 +162,92 @@ type Config struct {
 	// send loading state in reasoning
 	SendLoadingState bool `yaml:"sendLoadingState"`
 
+	// seconds in-flight requests can take when a model is stopped, 0 waits for them
+	DrainTimeout int `yaml:"drainTimeout"`
+
+	// queue or reject requests for a model while it is stopped, default queue
+	DrainPolicy string `yaml:"drainPolicy"`
+
 	// present aliases to /v1/models OpenAI API listing
 	IncludeAliasesInList bool `yaml:"includeAliasesInList"`
 
 	// support API keys, see issue #433, #50, #251
 	RequiredAPIKeys []string `yaml:"apiKeys"`
 
+	// priority of queued requests by API key or the X-LlamaSwap-Priority header
+	PriorityClasses map[string]PriorityClass `yaml:"priorityClasses"`
+
 	// support remote peers, see issue #433, #296
 	Peers PeerDictionaryConfig `yaml:"peers"`
+
+	// additional files (or globs) that define models, groups, macros and peers
+	Include []string `yaml:"include"`
+
+	// absolute paths of the include patterns, relative to the main config file
+	includePaths []string
+
+	// enable ${cmd:...} macros, they run commands while loading the config
+	AllowCommandMacros bool `yaml:"allowCommandMacros"`
+
+	// pick a free ${PORT} when a model starts instead of when the config is loaded
+	DynamicPorts bool `yaml:"dynamicPorts"`
+
+	// MB of memory per device the running models can use together. When set, models
+	// are loaded while they fit and the least recently used ones are unloaded to make
+	// room. It replaces the swap and exclusive settings of groups.
+	MemoryBudget map[string]int `yaml:"memoryBudget"`
+
+	// the most models, or groups with a loaded model, that are loaded at once. The least
+	// recently used ones are unloaded to make room. Persistent groups are not counted.
+	MaxLoadedModels int `yaml:"maxLoadedModels"`
+	MaxLoadedGroups int `yaml:"maxLoadedGroups"`
+
+	// where processes keep the pid, port and command hash of their upstream so the
+	// upstreams still running when llama-swap starts are adopted instead of started again
+	StateDir string `yaml:"stateDir"`
+
+	// leave ready upstreams running on shutdown for the next llama-swap to adopt
+	DetachOnShutdown bool `yaml:"detachOnShutdown"`
+
+	// values from ${file:...} and ${cmd:...} macros, see Redact()
+	secrets []string
+
+	// names of the overlays that were applied, see applyOverlays()
+	overlays []string
+}
+
+// ProfileModel splits a `profile:model` name. The model can be an alias, the
+// model ID is returned.
+func (c *Config) ProfileModel(search string) (profile string, modelID string, found bool) {
+	profile, modelName, ok := strings.Cut(search, PROFILE_SPLIT_CHAR)
+	if !ok {
+		return "", "", false
+	}
+	members, ok := c.Profiles[profile]
+	if !ok {
+		return "", "", false
+	}
+	modelID, ok = c.RealModelName(modelName)
+	if !ok || !slices.Contains(members, modelID) {
+		return "", "", false
+	}
+	return profile, modelID, true
+}
+
+// RequestPriority returns the priority of a request. A class matched by apiKey wins
+// over the class named in the request's header, anything else is priority 0.
+func (c *Config) RequestPriority(className string, apiKey string) int {
+	if apiKey != "" {
+		for _, class := range c.PriorityClasses {
+			if slices.Contains(class.APIKeys, apiKey) {
+				return class.Priority
+			}
+		}
+	}
+	if class, ok := c.PriorityClasses[className]; ok {
+		return class.Priority
+	}
+	return 0
 }
 
 func (c *Config) RealModelName(search string) (string, bool) {
@@ -177,10 +274,18 @@ func LoadConfig(path string) (Config, error) {
 		return Config{}, err
 	}
 	defer file.Close()
-	return LoadConfigFromReader(file)
+	return loadConfigFromReader(file, path, filepath.Dir(path), "")
 }
 
+// LoadConfigFromReader loads the configuration from r. Relative include paths
+// are resolved from the current working directory.
 func LoadConfigFromReader(r io.Reader) (Config, error) {
+	return loadConfigFromReader(r, "main config", ".", "")
+}
+
+// loadConfigFromReader loads the configuration named name from r. overlay is a comma
+// separated list of overlays to apply, when empty the one for this host is used.
+func loadConfigFromReader(r io.Reader, name string, baseDir string, overlay string) (Config, error) {
 	data, err := io.ReadAll(r)
 	if err != nil {
 		return Config{}, err
@@ -191,7 +296,19 @@ func LoadConfigFromReader(r io.Reader) (Config, error) {
 	// This is safe because env values are simple strings without YAML formatting
 	yamlStr, err = substituteEnvMacros(yamlStr)
 	if err != nil {
-		return Config{}, err
+		return Config{}, inFile(err, name)
+	}
+
+	// Substitute ${file:...} and ${cmd:...} secrets. allowCommandMacros is read
+	// first as ${cmd:...} is only substituted when it is enabled.
+	var options struct {
+		AllowCommandMacros bool `yaml:"allowCommandMacros"`
+	}
+	_ = yaml.Unmarshal([]byte(yamlStr), &options)
+	secrets := &secretSources{baseDir: baseDir, allowCommands: options.AllowCommandMacros}
+	yamlStr, err = secrets.substitute(yamlStr)
+	if err != nil {
+		return Config{}, inFile(err, name)
 	}
 
 	// Unmarshal into full Config with defaults
@@ -204,30 +321,84 @@ func LoadConfigFromReader(r io.Reader) (Config, error) {
 		MetricsMaxInMemory: 1000,
 		CaptureBuffer:      5,
 	}
-	if err = yaml.Unmarshal([]byte(yamlStr), &config); err != nil {
-		return Config{}, err
+	var doc yaml.Node
+	if err = yaml.Unmarshal([]byte(yamlStr), &doc); err != nil {
+		return Config{}, inFile(err, name)
+	}
+
+	// included files are parsed up front so model templates can be shared across files
+	var includeList struct {
+		Include []string `yaml:"include"`
+	}
+	if err = decodeDocument(&doc, &includeList); err != nil {
+		return Config{}, decodeErrors(name, err)
+	}
+	config.Include = includeList.Include
+	includes, err := loadIncludes(&config, baseDir, secrets)
+	if err != nil {
+		return Config{}, inFile(err, name)
+	}
+
+	// overlays change the base configuration for a machine before anything else uses it
+	config.overlays, err = applyOverlays(name, &doc, includes, overlay)
+	if err != nil {
+		return Config{}, inFile(err, name)
+	}
+
+	// remember where every key is defined before templates rewrite the models
+	positions := make(positionIndex)
+	positions.add(name, &doc)
+	for _, include := range includes {
+		positions.add(include.file, include.doc)
+	}
+
+	// Phase 2: apply modelTemplates to models that use extends
+	if err = applyModelTemplates(name, &doc, includes); err != nil {
+		return Config{}, inFile(err, name)
+	}
+
+	// validation errors are collected so they can all be reported at once
+	errs := removeInvalidEntries(name, &doc)
+	for _, include := range includes {
+		errs = append(errs, removeInvalidEntries(include.file, include.doc)...)
+	}
+
+	if err = decodeDocument(&doc, &config); err != nil {
+		return Config{}, append(errs, decodeErrors(name, err)...)
 	}
 
+	// merge models, groups, macros and peers from included files
+	errs = append(errs, mergeIncludes(&config, name, includes)...)
+	config.secrets = secrets.values
+
 	if config.HealthCheckTimeout < 15 {
 		config.HealthCheckTimeout = 15
 	}
 
 	if config.StartPort < 1 {
-		return Config{}, fmt.Errorf("startPort must be greater than 1")
+		errs = append(errs, atPath(fmt.Errorf("startPort must be greater than 1"), "startPort"))
 	}
 
 	switch config.LogToStdout {
 	case LogToStdoutProxy, LogToStdoutUpstream, LogToStdoutBoth, LogToStdoutNone:
 	default:
-		return Config{}, fmt.Errorf("logToStdout must be one of: proxy, upstream, both, none")
+		errs = append(errs, atPath(fmt.Errorf("logToStdout must be one of: proxy, upstream, both, none"), "logToStdout"))
 	}
 
+	// Get and sort all model IDs for consistent port assignment
+	modelIds := make([]string, 0, len(config.Models))
+	for modelId := range config.Models {
+		modelIds = append(modelIds, modelId)
+	}
+	sort.Strings(modelIds)
+
 	// Populate the aliases map
 	config.aliases = make(map[string]string)
-	for modelName, modelConfig := range config.Models {
-		for _, alias := range modelConfig.Aliases {
+	for _, modelName := range modelIds {
+		for i, alias := range config.Models[modelName].Aliases {
 			if _, found := config.aliases[alias]; found {
-				return Config{}, fmt.Errorf("duplicate alias %s found in model: %s", alias, modelName)
+				errs = append(errs, atPath(fmt.Errorf("duplicate alias %s found in model: %s", alias, modelName), "models", modelName, "aliases", strconv.Itoa(i)))
+				continue
 			}
 			config.aliases[alias] = modelName
 		}
@@ -236,223 +407,551 @@ func LoadConfigFromReader(r io.Reader) (Config, error) {
 	// Validate global macros
 	for _, macro := range config.Macros {
 		if err = validateMacro(macro.Name, macro.Value); err != nil {
-			return Config{}, err
+			errs = append(errs, atPath(err, "macros", macro.Name))
 		}
 	}
 
-	// Get and sort all model IDs for consistent port assignment
-	modelIds := make([]string, 0, len(config.Models))
-	for modelId := range config.Models {
-		modelIds = append(modelIds, modelId)
-	}
-	sort.Strings(modelIds)
-
 	nextPort := config.StartPort
 	for _, modelId := range modelIds {
-		modelConfig := config.Models[modelId]
+		modelConfig, modelErrs := config.resolveModelConfig(modelId, config.Models[modelId], &nextPort)
+		if len(modelErrs) > 0 {
+			errs = append(errs, modelErrs...)
+			continue
+		}
+		config.Models[modelId] = modelConfig
+	}
 
-		// Strip comments from command fields
-		modelConfig.Cmd = StripComments(modelConfig.Cmd)
-		modelConfig.CmdStop = StripComments(modelConfig.CmdStop)
+	config = AddDefaultGroupToConfig(config)
 
-		// Validate model macros
-		for _, macro := range modelConfig.Macros {
-			if err = validateMacro(macro.Name, macro.Value); err != nil {
-				return Config{}, fmt.Errorf("model %s: %s", modelId, err.Error())
+	// Validate group members
+	groupIDs := make([]string, 0, len(config.Groups))
+	for groupID := range config.Groups {
+		groupIDs = append(groupIDs, groupID)
+	}
+	sort.Strings(groupIDs)
+
+	memberUsage := make(map[string]string)
+	for _, groupID := range groupIDs {
+		groupConfig := config.Groups[groupID]
+		prevSet := make(map[string]bool)
+		for i, member := range groupConfig.Members {
+			memberPath := []string{"groups", groupID, "members", strconv.Itoa(i)}
+			if _, found := prevSet[member]; found {
+				errs = append(errs, atPath(fmt.Errorf("duplicate model member %s found in group: %s", member, groupID), memberPath...))
+				continue
 			}
-		}
+			prevSet[member] = true
 
-		// Build merged macro list: MODEL_ID + global macros + model macros (model overrides global)
-		mergedMacros := make(MacroList, 0, len(config.Macros)+len(modelConfig.Macros)+1)
-		mergedMacros = append(mergedMacros, MacroEntry{Name: "MODEL_ID", Value: modelId})
-		mergedMacros = append(mergedMacros, config.Macros...)
+			if _, found := config.Models[member]; !found {
+				errs = append(errs, atPath(fmt.Errorf("group %s: unknown model %s", groupID, member), memberPath...))
+				continue
+			}
 
-		// Add model macros (override globals with same name)
-		for _, entry := range modelConfig.Macros {
-			found := false
-			for i, existing := range mergedMacros {
-				if existing.Name == entry.Name {
-					mergedMacros[i] = entry
-					found = true
-					break
-				}
+			if existingGroup, exists := memberUsage[member]; exists {
+				errs = append(errs, atPath(fmt.Errorf("model member %s is used in multiple groups: %s and %s", member, existingGroup, groupID), memberPath...))
+				continue
 			}
+			memberUsage[member] = groupID
+		}
+	}
+
+	// Validate profiles, members can be aliases but are stored as model IDs
+	profileNames := make([]string, 0, len(config.Profiles))
+	for profileName := range config.Profiles {
+		profileNames = append(profileNames, profileName)
+	}
+	sort.Strings(profileNames)
+
+	for _, profileName := range profileNames {
+		if strings.TrimSpace(profileName) == "" || strings.Contains(profileName, PROFILE_SPLIT_CHAR) {
+			errs = append(errs, atPath(fmt.Errorf("invalid profile name `%s`, it can not be empty or contain `%s`", profileName, PROFILE_SPLIT_CHAR), "profiles", profileName))
+			continue
+		}
+
+		members := make([]string, 0, len(config.Profiles[profileName]))
+		for i, member := range config.Profiles[profileName] {
+			memberPath := []string{"profiles", profileName, strconv.Itoa(i)}
+			modelID, found := config.RealModelName(member)
 			if !found {
-				mergedMacros = append(mergedMacros, entry)
+				errs = append(errs, atPath(fmt.Errorf("profile %s: unknown model %s", profileName, member), memberPath...))
+				continue
 			}
+			if slices.Contains(members, modelID) {
+				errs = append(errs, atPath(fmt.Errorf("profile %s: duplicate model %s", profileName, member), memberPath...))
+				continue
+			}
+			members = append(members, modelID)
 		}
+		config.Profiles[profileName] = members
+	}
 
-		// Substitute remaining macros in model fields (LIFO order)
-		for i := len(mergedMacros) - 1; i >= 0; i-- {
-			entry := mergedMacros[i]
-			macroSlug := fmt.Sprintf("${%s}", entry.Name)
-			macroStr := fmt.Sprintf("%v", entry.Value)
+	errs = append(errs, config.Hooks.LifecycleHooks.validate("", "hooks")...)
 
-			modelConfig.Cmd = strings.ReplaceAll(modelConfig.Cmd, macroSlug, macroStr)
-			modelConfig.CmdStop = strings.ReplaceAll(modelConfig.CmdStop, macroSlug, macroStr)
-			modelConfig.Proxy = strings.ReplaceAll(modelConfig.Proxy, macroSlug, macroStr)
-			modelConfig.CheckEndpoint = strings.ReplaceAll(modelConfig.CheckEndpoint, macroSlug, macroStr)
-			modelConfig.Filters.StripParams = strings.ReplaceAll(modelConfig.Filters.StripParams, macroSlug, macroStr)
-
-			// Substitute in metadata (type-preserving)
-			if len(modelConfig.Metadata) > 0 {
-				result, err := substituteMacroInValue(modelConfig.Metadata, entry.Name, entry.Value)
-				if err != nil {
-					return Config{}, fmt.Errorf("model %s metadata: %s", modelId, err.Error())
-				}
-				modelConfig.Metadata = result.(map[string]any)
+	// Clean up hooks preload
+	if len(config.Hooks.OnStartup.Preload) > 0 {
+		var toPreload []string
+		for _, modelID := range config.Hooks.OnStartup.Preload {
+			modelID = strings.TrimSpace(modelID)
+			if modelID == "" {
+				continue
+			}
+			if real, found := config.RealModelName(modelID); found {
+				toPreload = append(toPreload, real)
 			}
 		}
+		config.Hooks.OnStartup.Preload = toPreload
+	}
 
-		// Handle PORT macro - only allocate if cmd uses it
-		cmdHasPort := strings.Contains(modelConfig.Cmd, "${PORT}")
-		proxyHasPort := strings.Contains(modelConfig.Proxy, "${PORT}")
-		if cmdHasPort || proxyHasPort {
-			if !cmdHasPort && proxyHasPort {
-				return Config{}, fmt.Errorf("model %s: proxy uses ${PORT} but cmd does not - ${PORT} is only available when used in cmd", modelId)
-			}
+	// Validate API keys (env macros already substituted at string level)
+	for i, apikey := range config.RequiredAPIKeys {
+		if apikey == "" {
+			errs = append(errs, atPath(fmt.Errorf("empty api key found in apiKeys"), "apiKeys", strconv.Itoa(i)))
+			continue
+		}
+		if strings.Contains(apikey, " ") {
+			errs = append(errs, atPath(fmt.Errorf("api key cannot contain spaces: `%s`", apikey), "apiKeys", strconv.Itoa(i)))
+			continue
+		}
+		config.RequiredAPIKeys[i] = apikey
+	}
 
-			macroSlug := "${PORT}"
-			macroStr := fmt.Sprintf("%v", nextPort)
+	for _, device := range sortedDevices(config.MemoryBudget) {
+		if config.MemoryBudget[device] <= 0 {
+			errs = append(errs, atPath(fmt.Errorf("memoryBudget.%s must be greater than 0", device), "memoryBudget", device))
+		}
+	}
 
-			modelConfig.Cmd = strings.ReplaceAll(modelConfig.Cmd, macroSlug, macroStr)
-			modelConfig.CmdStop = strings.ReplaceAll(modelConfig.CmdStop, macroSlug, macroStr)
-			modelConfig.Proxy = strings.ReplaceAll(modelConfig.Proxy, macroSlug, macroStr)
+	if config.DrainTimeout < 0 {
+		errs = append(errs, atPath(fmt.Errorf("drainTimeout must not be negative"), "drainTimeout"))
+	}
+	switch config.DrainPolicy {
+	case "", DrainPolicyQueue, DrainPolicyReject:
+	default:
+		errs = append(errs, atPath(fmt.Errorf("drainPolicy must be one of: queue, reject"), "drainPolicy"))
+	}
 
-			if len(modelConfig.Metadata) > 0 {
-				result, err := substituteMacroInValue(modelConfig.Metadata, "PORT", nextPort)
-				if err != nil {
-					return Config{}, fmt.Errorf("model %s metadata: %s", modelId, err.Error())
-				}
-				modelConfig.Metadata = result.(map[string]any)
+	if config.MaxLoadedModels < 0 {
+		errs = append(errs, atPath(fmt.Errorf("maxLoadedModels must not be negative"), "maxLoadedModels"))
+	}
+	if config.MaxLoadedGroups < 0 {
+		errs = append(errs, atPath(fmt.Errorf("maxLoadedGroups must not be negative"), "maxLoadedGroups"))
+	}
+	if config.DetachOnShutdown && config.StateDir == "" {
+		errs = append(errs, atPath(fmt.Errorf("detachOnShutdown requires stateDir"), "detachOnShutdown"))
+	}
+
+	// an API key can only be in one priority class
+	classNames := make([]string, 0, len(config.PriorityClasses))
+	for name := range config.PriorityClasses {
+		classNames = append(classNames, name)
+	}
+	sort.Strings(classNames)
+	classOfKey := make(map[string]string)
+	for _, name := range classNames {
+		for i, apikey := range config.PriorityClasses[name].APIKeys {
+			if apikey == "" {
+				errs = append(errs, atPath(fmt.Errorf("priority class %s: empty api key", name), "priorityClasses", name, "apiKeys", strconv.Itoa(i)))
+				continue
+			}
+			if other, ok := classOfKey[apikey]; ok {
+				errs = append(errs, atPath(fmt.Errorf("priority class %s: api key is already in priority class %s", name, other), "priorityClasses", name, "apiKeys", strconv.Itoa(i)))
+				continue
 			}
+			classOfKey[apikey] = name
+		}
+	}
 
-			nextPort++
+	// Process peers with global macro substitution
+	peerNames := make([]string, 0, len(config.Peers))
+	for peerName := range config.Peers {
+		peerNames = append(peerNames, peerName)
+	}
+	sort.Strings(peerNames)
+
+	for _, peerName := range peerNames {
+		peerConfig, peerErrs := config.resolvePeerConfig(peerName, config.Peers[peerName])
+		if len(peerErrs) > 0 {
+			errs = append(errs, peerErrs...)
+			continue
 		}
+		config.Peers[peerName] = peerConfig
+	}
 
-		// Validate no unknown macros remain
-		fieldMap := map[string]string{
-			"cmd":                 modelConfig.Cmd,
-			"cmdStop":             modelConfig.CmdStop,
-			"proxy":               modelConfig.Proxy,
-			"checkEndpoint":       modelConfig.CheckEndpoint,
-			"filters.stripParams": modelConfig.Filters.StripParams,
+	if len(errs) > 0 {
+		positions.locate(errs)
+		for _, e := range errs {
+			if e.File == "" {
+				e.File = name
+			}
 		}
+		sort.SliceStable(errs, func(i, j int) bool {
+			if errs[i].File != errs[j].File {
+				return errs[i].File == name || (errs[j].File != name && errs[i].File < errs[j].File)
+			}
+			if errs[i].Line != errs[j].Line {
+				return errs[i].Line < errs[j].Line
+			}
+			return errs[i].Column < errs[j].Column
+		})
+		return Config{}, errs
+	}
 
-		for fieldName, fieldValue := range fieldMap {
-			matches := macroPatternRegex.FindAllStringSubmatch(fieldValue, -1)
-			for _, match := range matches {
-				macroName := match[1]
-				if macroName == "PID" && fieldName == "cmdStop" {
-					continue // replaced at runtime
-				}
-				if macroName == "PORT" || macroName == "MODEL_ID" {
-					return Config{}, fmt.Errorf("macro '${%s}' should have been substituted in %s.%s", macroName, modelId, fieldName)
-				}
-				return Config{}, fmt.Errorf("unknown macro '${%s}' found in %s.%s", macroName, modelId, fieldName)
+	return config, nil
+}
+
+// resolveModelConfig substitutes macros and assigns a port to a model's configuration.
+// nextPort is incremented when the model uses ${PORT}.
+func (config *Config) resolveModelConfig(modelId string, modelConfig ModelConfig, nextPort *int) (ModelConfig, ValidationErrors) {
+	var errs ValidationErrors
+
+	// Strip comments from command fields
+	modelConfig.Cmd = StripComments(modelConfig.Cmd)
+	modelConfig.CmdStop = StripComments(modelConfig.CmdStop)
+	modelConfig.HealthCheck.Command = StripComments(modelConfig.HealthCheck.Command)
+
+	// Validate model macros
+	for _, macro := range modelConfig.Macros {
+		if err := validateMacro(macro.Name, macro.Value); err != nil {
+			errs = append(errs, atPath(fmt.Errorf("model %s: %s", modelId, err.Error()), "models", modelId, "macros", macro.Name))
+		}
+	}
+	if len(errs) > 0 {
+		return modelConfig, errs
+	}
+
+	// the global hooks run before the model's own
+	errs = append(errs, modelConfig.Hooks.validate(fmt.Sprintf("model %s: ", modelId), "models", modelId, "hooks")...)
+	modelConfig.Hooks = config.Hooks.LifecycleHooks.merge(modelConfig.Hooks)
+
+	// Build merged macro list: MODEL_ID + global macros + model macros (model overrides global)
+	mergedMacros := make(MacroList, 0, len(config.Macros)+len(modelConfig.Macros)+1)
+	mergedMacros = append(mergedMacros, MacroEntry{Name: "MODEL_ID", Value: modelId})
+	mergedMacros = append(mergedMacros, config.Macros...)
+
+	// Add model macros (override globals with same name)
+	for _, entry := range modelConfig.Macros {
+		found := false
+		for i, existing := range mergedMacros {
+			if existing.Name == entry.Name {
+				mergedMacros[i] = entry
+				found = true
+				break
 			}
 		}
+		if !found {
+			mergedMacros = append(mergedMacros, entry)
+		}
+	}
 
+	// Substitute remaining macros in model fields (LIFO order)
+	for i := len(mergedMacros) - 1; i >= 0; i-- {
+		entry := mergedMacros[i]
+		macroSlug := fmt.Sprintf("${%s}", entry.Name)
+		macroStr := fmt.Sprintf("%v", entry.Value)
+
+		modelConfig.Cmd = strings.ReplaceAll(modelConfig.Cmd, macroSlug, macroStr)
+		modelConfig.CmdStop = strings.ReplaceAll(modelConfig.CmdStop, macroSlug, macroStr)
+		modelConfig.Proxy = strings.ReplaceAll(modelConfig.Proxy, macroSlug, macroStr)
+		modelConfig.WorkingDir = strings.ReplaceAll(modelConfig.WorkingDir, macroSlug, macroStr)
+		modelConfig.CheckEndpoint = strings.ReplaceAll(modelConfig.CheckEndpoint, macroSlug, macroStr)
+		modelConfig.HealthCheck.Path = strings.ReplaceAll(modelConfig.HealthCheck.Path, macroSlug, macroStr)
+		modelConfig.HealthCheck.Command = strings.ReplaceAll(modelConfig.HealthCheck.Command, macroSlug, macroStr)
+		modelConfig.Filters.StripParams = strings.ReplaceAll(modelConfig.Filters.StripParams, macroSlug, macroStr)
+		modelConfig.Hooks = modelConfig.Hooks.replace(func(s string) string {
+			return strings.ReplaceAll(s, macroSlug, macroStr)
+		})
+		modelConfig.Container = modelConfig.Container.replace(func(s string) string {
+			return strings.ReplaceAll(s, macroSlug, macroStr)
+		})
+
+		// Substitute in metadata (type-preserving)
 		if len(modelConfig.Metadata) > 0 {
-			if err := validateNestedForUnknownMacros(modelConfig.Metadata, fmt.Sprintf("model %s metadata", modelId)); err != nil {
-				return Config{}, err
+			result, err := substituteMacroInValue(modelConfig.Metadata, entry.Name, entry.Value)
+			if err != nil {
+				return modelConfig, ValidationErrors{atPath(fmt.Errorf("model %s metadata: %s", modelId, err.Error()), "models", modelId, "metadata")}
 			}
+			modelConfig.Metadata = result.(map[string]any)
 		}
+	}
 
-		if _, err := url.Parse(modelConfig.Proxy); err != nil {
-			return Config{}, fmt.Errorf("model %s: invalid proxy URL: %w", modelId, err)
+	// ${REPLICA} is substituted for each replica by ForReplica()
+	replicaValues := []struct {
+		name  string
+		value int
+	}{
+		{"replicas", modelConfig.Replicas},
+		{"minReplicas", modelConfig.MinReplicas},
+		{"maxReplicas", modelConfig.MaxReplicas},
+		{"scaleUpThreshold", modelConfig.ScaleUpThreshold},
+		{"scaleWindow", modelConfig.ScaleWindow},
+	}
+	for _, v := range replicaValues {
+		if v.value < 0 {
+			errs = append(errs, atPath(fmt.Errorf("model %s: %s must not be negative", modelId, v.name), "models", modelId, v.name))
 		}
+	}
 
-		if modelConfig.SendLoadingState == nil {
-			v := config.SendLoadingState
-			modelConfig.SendLoadingState = &v
+	// with autoscaling there is a process for every replica up to maxReplicas
+	if modelConfig.MaxReplicas > 0 {
+		if modelConfig.Replicas > 1 {
+			errs = append(errs, atPath(fmt.Errorf("model %s: replicas can not be used with maxReplicas", modelId), "models", modelId, "replicas"))
 		}
-
-		config.Models[modelId] = modelConfig
+		if modelConfig.MinReplicas == 0 {
+			modelConfig.MinReplicas = 1
+		}
+		if modelConfig.MinReplicas > modelConfig.MaxReplicas {
+			errs = append(errs, atPath(fmt.Errorf("model %s: minReplicas must not be more than maxReplicas", modelId), "models", modelId, "minReplicas"))
+		}
+		if modelConfig.ScaleUpThreshold == 0 {
+			modelConfig.ScaleUpThreshold = 1
+		}
+		if modelConfig.ScaleWindow == 0 {
+			modelConfig.ScaleWindow = 10
+		}
+		modelConfig.Replicas = modelConfig.MaxReplicas
+	} else if modelConfig.MinReplicas > 0 {
+		errs = append(errs, atPath(fmt.Errorf("model %s: minReplicas requires maxReplicas", modelId), "models", modelId, "minReplicas"))
+	}
+	replicated := modelConfig.Replicas > 1
+	if !replicated {
+		modelConfig = modelConfig.ForReplica(0)
 	}
 
-	config = AddDefaultGroupToConfig(config)
+	// Handle PORT macro - only allocate if cmd or the container uses it or a container
+	// port is published on it
+	cmdHasPort := strings.Contains(modelConfig.Cmd, "${PORT}") || modelConfig.Container.Port > 0 ||
+		slices.ContainsFunc(modelConfig.Container.strings(), func(s string) bool { return strings.Contains(s, "${PORT}") })
+	proxyHasPort := strings.Contains(modelConfig.Proxy, "${PORT}")
+	if cmdHasPort || proxyHasPort {
+		if !cmdHasPort && proxyHasPort {
+			return modelConfig, ValidationErrors{atPath(fmt.Errorf("model %s: proxy uses ${PORT} but cmd does not - ${PORT} is only available when used in cmd", modelId), "models", modelId, "proxy")}
+		}
 
-	// Validate group members
-	memberUsage := make(map[string]string)
-	for groupID, groupConfig := range config.Groups {
-		prevSet := make(map[string]bool)
-		for _, member := range groupConfig.Members {
-			if _, found := prevSet[member]; found {
-				return Config{}, fmt.Errorf("duplicate model member %s found in group: %s", member, groupID)
-			}
-			prevSet[member] = true
+		// every replica gets a port of its own
+		port := *nextPort
+		*nextPort += max(1, modelConfig.Replicas)
+		modelConfig.Port = port
 
-			if existingGroup, exists := memberUsage[member]; exists {
-				return Config{}, fmt.Errorf("model member %s is used in multiple groups: %s and %s", member, existingGroup, groupID)
+		if config.DynamicPorts {
+			// ${PORT} is left in cmd, cmdStop and proxy, the process substitutes it
+			// with a free port, starting from this one, every time it starts
+			modelConfig.DynamicPort = true
+		} else if !replicated {
+			macroSlug := "${PORT}"
+			macroStr := fmt.Sprintf("%v", port)
+
+			modelConfig.Cmd = strings.ReplaceAll(modelConfig.Cmd, macroSlug, macroStr)
+			modelConfig.CmdStop = strings.ReplaceAll(modelConfig.CmdStop, macroSlug, macroStr)
+			modelConfig.Proxy = strings.ReplaceAll(modelConfig.Proxy, macroSlug, macroStr)
+			modelConfig.HealthCheck.Command = strings.ReplaceAll(modelConfig.HealthCheck.Command, macroSlug, macroStr)
+			modelConfig.Container = modelConfig.Container.replace(func(s string) string {
+				return strings.ReplaceAll(s, macroSlug, macroStr)
+			})
+		}
+
+		// the port is not known yet with dynamicPorts so it can not be used in metadata
+		if len(modelConfig.Metadata) > 0 && !config.DynamicPorts && !replicated {
+			result, err := substituteMacroInValue(modelConfig.Metadata, "PORT", port)
+			if err != nil {
+				return modelConfig, ValidationErrors{atPath(fmt.Errorf("model %s metadata: %s", modelId, err.Error()), "models", modelId, "metadata")}
 			}
-			memberUsage[member] = groupID
+			modelConfig.Metadata = result.(map[string]any)
 		}
 	}
 
-	// Clean up hooks preload
-	if len(config.Hooks.OnStartup.Preload) > 0 {
-		var toPreload []string
-		for _, modelID := range config.Hooks.OnStartup.Preload {
-			modelID = strings.TrimSpace(modelID)
-			if modelID == "" {
-				continue
+	// Validate no unknown macros remain
+	type macroField struct {
+		name  string
+		value string
+		path  []string
+	}
+	fields := []macroField{
+		{"cmd", modelConfig.Cmd, []string{"cmd"}},
+		{"cmdStop", modelConfig.CmdStop, []string{"cmdStop"}},
+		{"proxy", modelConfig.Proxy, []string{"proxy"}},
+		{"workingDir", modelConfig.WorkingDir, []string{"workingDir"}},
+		{"checkEndpoint", modelConfig.CheckEndpoint, []string{"checkEndpoint"}},
+		{"healthCheck.path", modelConfig.HealthCheck.Path, []string{"healthCheck", "path"}},
+		{"healthCheck.command", modelConfig.HealthCheck.Command, []string{"healthCheck", "command"}},
+		{"filters.stripParams", modelConfig.Filters.StripParams, []string{"filters", "stripParams"}},
+	}
+	for i, list := range modelConfig.Hooks.lists() {
+		for _, hook := range *list {
+			name := lifecycleHookNames[i]
+			fields = append(fields, macroField{"hooks." + name, hook.Command + " " + hook.URL, []string{"hooks", name}})
+		}
+	}
+	fields = append(fields, macroField{"container", strings.Join(modelConfig.Container.strings(), " "), []string{"container"}})
+
+	for _, field := range fields {
+		fieldPath := append([]string{"models", modelId}, field.path...)
+		matches := macroPatternRegex.FindAllStringSubmatch(field.value, -1)
+		for _, match := range matches {
+			macroName := match[1]
+			if macroName == "PID" && (field.name == "cmdStop" || (strings.HasPrefix(field.name, "hooks.") && field.name != "hooks.beforeStart")) {
+				continue // replaced at runtime
 			}
-			if real, found := config.RealModelName(modelID); found {
-				toPreload = append(toPreload, real)
+			if macroName == "PORT" && (strings.HasPrefix(field.name, "hooks.") || field.name == "container") {
+				continue // replaced when the hook runs or the container starts
+			}
+			if macroName == "PORT" && (modelConfig.DynamicPort || replicated) && (field.name == "cmd" || field.name == "cmdStop" || field.name == "proxy" || field.name == "healthCheck.command") {
+				continue // replaced when the process starts or for each replica
+			}
+			if macroName == "REPLICA" && replicated {
+				continue // replaced for each replica
+			}
+			if macroName == "PORT" || macroName == "MODEL_ID" {
+				errs = append(errs, atPath(fmt.Errorf("macro '${%s}' should have been substituted in %s.%s", macroName, modelId, field.name), fieldPath...))
+				continue
 			}
+			errs = append(errs, atPath(fmt.Errorf("unknown macro '${%s}' found in %s.%s", macroName, modelId, field.name), fieldPath...))
 		}
-		config.Hooks.OnStartup.Preload = toPreload
 	}
 
-	// Validate API keys (env macros already substituted at string level)
-	for i, apikey := range config.RequiredAPIKeys {
-		if apikey == "" {
-			return Config{}, fmt.Errorf("empty api key found in apiKeys")
+	if len(modelConfig.Metadata) > 0 {
+		if err := validateNestedForUnknownMacros(modelConfig.Metadata, fmt.Sprintf("model %s metadata", modelId)); err != nil {
+			errs = append(errs, atPath(err, "models", modelId, "metadata"))
 		}
-		if strings.Contains(apikey, " ") {
-			return Config{}, fmt.Errorf("api key cannot contain spaces: `%s`", apikey)
-		}
-		config.RequiredAPIKeys[i] = apikey
 	}
 
-	// Process peers with global macro substitution
-	for peerName, peerConfig := range config.Peers {
-		// Substitute global macros (LIFO order)
-		for i := len(config.Macros) - 1; i >= 0; i-- {
-			entry := config.Macros[i]
-			macroSlug := fmt.Sprintf("${%s}", entry.Name)
-			macroStr := fmt.Sprintf("%v", entry.Value)
-
-			peerConfig.ApiKey = strings.ReplaceAll(peerConfig.ApiKey, macroSlug, macroStr)
-			peerConfig.Filters.StripParams = strings.ReplaceAll(peerConfig.Filters.StripParams, macroSlug, macroStr)
-
-			// Substitute in setParams (type-preserving)
-			if len(peerConfig.Filters.SetParams) > 0 {
-				result, err := substituteMacroInValue(peerConfig.Filters.SetParams, entry.Name, entry.Value)
-				if err != nil {
-					return Config{}, fmt.Errorf("peers.%s.filters.setParams: %w", peerName, err)
-				}
-				peerConfig.Filters.SetParams = result.(map[string]any)
-			}
+	errs = append(errs, modelConfig.HealthCheck.validate(modelId)...)
+	errs = append(errs, modelConfig.Container.validate(modelId)...)
+
+	for _, device := range sortedDevices(modelConfig.Memory) {
+		memory := modelConfig.Memory[device]
+		budget, ok := config.MemoryBudget[device]
+		switch {
+		case !ok:
+			errs = append(errs, atPath(fmt.Errorf("model %s: memory.%s is not a device in memoryBudget", modelId, device), "models", modelId, "memory", device))
+		case memory < 0:
+			errs = append(errs, atPath(fmt.Errorf("model %s: memory.%s must not be negative", modelId, device), "models", modelId, "memory", device))
+		case memory > budget:
+			errs = append(errs, atPath(fmt.Errorf("model %s: memory.%s is more than the memoryBudget of %d", modelId, device, budget), "models", modelId, "memory", device))
 		}
+	}
+
+	if modelConfig.DrainTimeout < 0 {
+		errs = append(errs, atPath(fmt.Errorf("model %s: drainTimeout must not be negative", modelId), "models", modelId, "drainTimeout"))
+	}
+	switch modelConfig.DrainPolicy {
+	case "", DrainPolicyQueue, DrainPolicyReject:
+	default:
+		errs = append(errs, atPath(fmt.Errorf("model %s: drainPolicy must be one of: queue, reject", modelId), "models", modelId, "drainPolicy"))
+	}
+
+	if modelConfig.MaxQueueSize < 0 {
+		errs = append(errs, atPath(fmt.Errorf("model %s: maxQueueSize must not be negative", modelId), "models", modelId, "maxQueueSize"))
+	}
+	if modelConfig.QueueTimeout < 0 {
+		errs = append(errs, atPath(fmt.Errorf("model %s: queueTimeout must not be negative", modelId), "models", modelId, "queueTimeout"))
+	}
 
-		// Validate no unknown macros remain
-		if matches := macroPatternRegex.FindAllStringSubmatch(peerConfig.ApiKey, -1); len(matches) > 0 {
-			return Config{}, fmt.Errorf("peers.%s.apiKey: unknown macro '${%s}'", peerName, matches[0][1])
+	switch modelConfig.RestartPolicy {
+	case "", RestartPolicyNever, RestartPolicyOnFailure, RestartPolicyAlways:
+	default:
+		errs = append(errs, atPath(fmt.Errorf("model %s: restartPolicy must be one of: never, on-failure, always", modelId), "models", modelId, "restartPolicy"))
+	}
+	restartValues := []struct {
+		name  string
+		value int
+	}{
+		{"maxRestarts", modelConfig.Restart.MaxRestarts},
+		{"window", modelConfig.Restart.Window},
+		{"backoff", modelConfig.Restart.Backoff},
+		{"maxBackoff", modelConfig.Restart.MaxBackoff},
+	}
+	for _, v := range restartValues {
+		if v.value < 0 {
+			errs = append(errs, atPath(fmt.Errorf("model %s: restart.%s must not be negative", modelId, v.name), "models", modelId, "restart", v.name))
 		}
-		if matches := macroPatternRegex.FindAllStringSubmatch(peerConfig.Filters.StripParams, -1); len(matches) > 0 {
-			return Config{}, fmt.Errorf("peers.%s.filters.stripParams: unknown macro '${%s}'", peerName, matches[0][1])
+	}
+
+	limitValues := []struct {
+		name  string
+		path  []string
+		value float64
+	}{
+		{"limits.openFiles", []string{"limits", "openFiles"}, float64(modelConfig.Limits.OpenFiles)},
+		{"limits.memory", []string{"limits", "memory"}, float64(modelConfig.Limits.Memory)},
+		{"limits.cgroup.cpus", []string{"limits", "cgroup", "cpus"}, modelConfig.Limits.Cgroup.CPUs},
+		{"limits.cgroup.memoryMax", []string{"limits", "cgroup", "memoryMax"}, float64(modelConfig.Limits.Cgroup.MemoryMax)},
+	}
+	for _, v := range limitValues {
+		if v.value < 0 {
+			errs = append(errs, atPath(fmt.Errorf("model %s: %s must not be negative", modelId, v.name), append([]string{"models", modelId}, v.path...)...))
 		}
+	}
+	if parent := modelConfig.Limits.Cgroup.Parent; parent != "" && !strings.HasPrefix(parent, "/") {
+		errs = append(errs, atPath(fmt.Errorf("model %s: limits.cgroup.parent must be an absolute path", modelId), "models", modelId, "limits", "cgroup", "parent"))
+	}
+
+	if _, err := url.Parse(strings.ReplaceAll(modelConfig.Proxy, "${PORT}", strconv.Itoa(modelConfig.Port))); err != nil {
+		errs = append(errs, atPath(fmt.Errorf("model %s: invalid proxy URL: %w", modelId, err), "models", modelId, "proxy"))
+	}
+
+	modelConfig.secrets = config.secrets
+
+	if modelConfig.SendLoadingState == nil {
+		v := config.SendLoadingState
+		modelConfig.SendLoadingState = &v
+	}
+	if modelConfig.DrainTimeout == 0 {
+		modelConfig.DrainTimeout = config.DrainTimeout
+	}
+	if modelConfig.DrainPolicy == "" {
+		modelConfig.DrainPolicy = config.DrainPolicy
+	}
+
+	return modelConfig, errs
+}
+
+// resolvePeerConfig substitutes global macros in a peer's configuration
+func (config *Config) resolvePeerConfig(peerName string, peerConfig PeerConfig) (PeerConfig, ValidationErrors) {
+	var errs ValidationErrors
+
+	// Substitute global macros (LIFO order)
+	for i := len(config.Macros) - 1; i >= 0; i-- {
+		entry := config.Macros[i]
+		macroSlug := fmt.Sprintf("${%s}", entry.Name)
+		macroStr := fmt.Sprintf("%v", entry.Value)
+
+		peerConfig.ApiKey = strings.ReplaceAll(peerConfig.ApiKey, macroSlug, macroStr)
+		peerConfig.Filters.StripParams = strings.ReplaceAll(peerConfig.Filters.StripParams, macroSlug, macroStr)
+
+		// Substitute in setParams (type-preserving)
 		if len(peerConfig.Filters.SetParams) > 0 {
-			if err := validateNestedForUnknownMacros(peerConfig.Filters.SetParams, fmt.Sprintf("peers.%s.filters.setParams", peerName)); err != nil {
-				return Config{}, err
+			result, err := substituteMacroInValue(peerConfig.Filters.SetParams, entry.Name, entry.Value)
+			if err != nil {
+				return peerConfig, ValidationErrors{atPath(fmt.Errorf("peers.%s.filters.setParams: %w", peerName, err), "peers", peerName, "filters", "setParams")}
 			}
+			peerConfig.Filters.SetParams = result.(map[string]any)
 		}
-		config.Peers[peerName] = peerConfig
 	}
 
-	return config, nil
+	// Validate no unknown macros remain
+	if matches := macroPatternRegex.FindAllStringSubmatch(peerConfig.ApiKey, -1); len(matches) > 0 {
+		errs = append(errs, atPath(fmt.Errorf("peers.%s.apiKey: unknown macro '${%s}'", peerName, matches[0][1]), "peers", peerName, "apiKey"))
+	}
+	if matches := macroPatternRegex.FindAllStringSubmatch(peerConfig.Filters.StripParams, -1); len(matches) > 0 {
+		errs = append(errs, atPath(fmt.Errorf("peers.%s.filters.stripParams: unknown macro '${%s}'", peerName, matches[0][1]), "peers", peerName, "filters", "stripParams"))
+	}
+	if len(peerConfig.Filters.SetParams) > 0 {
+		if err := validateNestedForUnknownMacros(peerConfig.Filters.SetParams, fmt.Sprintf("peers.%s.filters.setParams", peerName)); err != nil {
+			errs = append(errs, atPath(err, "peers", peerName, "filters", "setParams"))
+		}
+	}
+
+	return peerConfig, errs
+}
+
+// ModelGroup returns the ID of the group the model is a member of
+func (c *Config) ModelGroup(modelID string) (string, bool) {
+	for groupID, groupConfig := range c.Groups {
+		if slices.Contains(groupConfig.Members, modelID) {
+			return groupID, true
+		}
+	}
+	return "", false
 }
 
 // rewrites the yaml to include a default group with any orphaned models
@@ -575,7 +1074,7 @@ func validateMacro(name string, value any) error {
 	}
 
 	switch name {
-	case "PORT", "MODEL_ID":
+	case "PORT", "MODEL_ID", "REPLICA":
 		return fmt.Errorf("macro name '%s' is reserved", name)
 	}
 
@@ -674,19 +1173,22 @@ func substituteMacroInValue(value any, macroName string, macroValue any) (any, e
 // Env macros inside YAML comments are ignored by unmarshalling the YAML first
 // (which strips comments) and only checking the comment-free version for macros.
 func substituteEnvMacros(s string) (string, error) {
-	// Unmarshal and remarshal to strip YAML comments
+	return substituteEnvMacrosInString(s, commentFreeYAML(s))
+}
+
+// commentFreeYAML unmarshals and remarshals s to strip YAML comments. If s is not
+// valid YAML it is returned as is so the user gets the macro error rather than a
+// confusing YAML parse error.
+func commentFreeYAML(s string) string {
 	var raw any
 	if err := yaml.Unmarshal([]byte(s), &raw); err != nil {
-		// If YAML is invalid, fall back to scanning the original string
-		// so the user gets the env var error rather than a confusing YAML parse error
-		return substituteEnvMacrosInString(s, s)
+		return s
 	}
 	clean, err := yaml.Marshal(raw)
 	if err != nil {
-		return substituteEnvMacrosInString(s, s)
+		return s
 	}
-
-	return substituteEnvMacrosInString(s, string(clean))
+	return string(clean)
 }
 
 // substituteEnvMacrosInString finds ${env.VAR} macros in scanStr and substitutes
@@ -694,34 +1196,57 @@ func substituteEnvMacros(s string) (string, error) {
 // substituting in the original string.
 func substituteEnvMacrosInString(target, scanStr string) (string, error) {
 	result := target
+	var errs ValidationErrors
+	seen := make(map[string]bool)
 	matches := envMacroRegex.FindAllStringSubmatch(scanStr, -1)
 	for _, match := range matches {
 		fullMatch := match[0] // ${env.VAR_NAME}
 		varName := match[1]   // VAR_NAME
 
+		if seen[fullMatch] {
+			continue
+		}
+		seen[fullMatch] = true
+
 		value, exists := os.LookupEnv(varName)
 		if !exists {
-			return "", fmt.Errorf("environment variable '%s' is not set", varName)
+			errs = append(errs, stringError(target, fullMatch, fmt.Errorf("environment variable '%s' is not set", varName)))
+			continue
 		}
 
 		// Sanitize the value for safe YAML substitution
-		value, err := sanitizeEnvValueForYAML(value, varName)
+		value, err := sanitizeValueForYAML(value, fmt.Sprintf("environment variable '%s'", varName))
 		if err != nil {
-			return "", err
+			errs = append(errs, stringError(target, fullMatch, err))
+			continue
 		}
 
 		result = strings.ReplaceAll(result, fullMatch, value)
 	}
+
+	if len(errs) > 0 {
+		return "", errs
+	}
 	return result, nil
 }
 
-// sanitizeEnvValueForYAML ensures an environment variable value is safe for YAML substitution.
+// stringError creates a ValidationError at the first occurrence of substr in s
+func stringError(s, substr string, err error) *ValidationError {
+	e := &ValidationError{Err: err}
+	if i := strings.Index(s, substr); i >= 0 {
+		e.Line = strings.Count(s[:i], "\n") + 1
+		e.Column = i - strings.LastIndex(s[:i], "\n")
+	}
+	return e
+}
+
+// sanitizeValueForYAML ensures a substituted value is safe for YAML substitution.
 // It rejects values with characters that break YAML structure and escapes quotes/backslashes
 // for compatibility with double-quoted YAML strings.
-func sanitizeEnvValueForYAML(value, varName string) (string, error) {
+func sanitizeValueForYAML(value, source string) (string, error) {
 	// Reject values that would break YAML structure regardless of quoting context
 	if strings.ContainsAny(value, "\n\r\x00") {
-		return "", fmt.Errorf("environment variable '%s' contains newlines or null bytes which are not allowed in YAML substitution", varName)
+		return "", fmt.Errorf("%s contains newlines or null bytes which are not allowed in YAML substitution", source)
 	}
 
 	// Escape backslashes and double quotes for safe use in double-quoted YAML strings.
@@ -732,3 +1257,13 @@ func sanitizeEnvValueForYAML(value, varName string) (string, error) {
 
 	return value, nil
 }
+
+// sortedDevices returns the device names of a memoryBudget or a model's memory
+func sortedDevices(memory map[string]int) []string {
+	devices := make([]string, 0, len(memory))
+	for device := range memory {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+	return devices
+}
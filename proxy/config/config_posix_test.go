@@ -251,3 +251,38 @@ groups:
 	assert.True(t, found)
 	assert.Equal(t, "model1", realname)
 }
+
+func TestConfig_CmdMacros(t *testing.T) {
+	content := `
+allowCommandMacros: true
+apiKeys:
+  - ${cmd:printf "  sk-from-cmd\n"}
+models:
+  model1:
+    cmd: server --port ${PORT}
+    env:
+      - TOKEN=${cmd:echo token-value}
+`
+	config, err := LoadConfigFromReader(strings.NewReader(content))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"sk-from-cmd"}, config.RequiredAPIKeys)
+
+	model := config.Models["model1"]
+	assert.Equal(t, []string{"TOKEN=token-value"}, model.Env)
+	assert.Equal(t, "TOKEN=********", model.Redact(model.Env[0]))
+
+	t.Run("command fails", func(t *testing.T) {
+		content := `
+allowCommandMacros: true
+apiKeys:
+  - ${cmd:sh -c "echo nope >&2; exit 3"}
+`
+		_, err := LoadConfigFromReader(strings.NewReader(content))
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "main config:4:5: cmd macro")
+			assert.Contains(t, err.Error(), "exit status 3: nope")
+		}
+	})
+}
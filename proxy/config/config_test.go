@@ -1,6 +1,7 @@
 package config
 
 import (
+	"fmt"
 	"slices"
 	"strings"
 	"testing"
@@ -41,6 +42,28 @@ groups:
 	assert.Contains(t, err.Error(), "model member model2 is used in multiple groups:")
 }
 
+func TestConfig_GroupMemberIsAModel(t *testing.T) {
+	content := `
+models:
+  model1:
+    cmd: path/to/cmd --arg1 one
+    proxy: "http://localhost:8080"
+groups:
+  group1:
+    members: [model1, typo-model]
+`
+	_, err := LoadConfigFromReader(strings.NewReader(content))
+	if !assert.Error(t, err) {
+		return
+	}
+	assert.Contains(t, err.Error(), "group group1: unknown model typo-model")
+
+	var validationErrs ValidationErrors
+	if assert.ErrorAs(t, err, &validationErrs) {
+		assert.Len(t, validationErrs, 1)
+	}
+}
+
 func TestConfig_ModelAliasesAreUnique(t *testing.T) {
 	content := `
 models:
@@ -176,6 +199,51 @@ models:
 		assert.Equal(t, "svr --port 1999", config.Models["model3"].Cmd)
 		assert.Equal(t, "http://1.2.3.4:1999", config.Models["model3"].Proxy)
 
+		assert.Equal(t, 5800, config.Models["model1"].Port)
+		assert.Equal(t, 5801, config.Models["model2"].Port)
+		assert.Equal(t, 0, config.Models["model3"].Port)
+	})
+
+	t.Run("Dynamic ports are substituted when the process starts", func(t *testing.T) {
+		content := `
+startPort: 5800
+dynamicPorts: true
+models:
+  model1:
+    cmd: svr --port ${PORT}
+    cmdStop: stop --port ${PORT} --pid ${PID}
+  model2:
+    cmd: svr --port 1999
+    proxy: "http://1.2.3.4:1999"
+`
+		config, err := LoadConfigFromReader(strings.NewReader(content))
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		model1 := config.Models["model1"]
+		assert.True(t, model1.DynamicPort)
+		assert.Equal(t, 5800, model1.Port)
+		assert.Equal(t, "svr --port ${PORT}", model1.Cmd)
+		assert.Equal(t, "stop --port ${PORT} --pid ${PID}", model1.CmdStop)
+		assert.Equal(t, "http://localhost:${PORT}", model1.Proxy)
+
+		model2 := config.Models["model2"]
+		assert.False(t, model2.DynamicPort)
+		assert.Equal(t, 0, model2.Port)
+	})
+
+	t.Run("Dynamic ports can not be used in metadata", func(t *testing.T) {
+		content := `
+dynamicPorts: true
+models:
+  model1:
+    cmd: svr --port ${PORT}
+    metadata:
+      port: ${PORT}
+`
+		_, err := LoadConfigFromReader(strings.NewReader(content))
+		assert.ErrorContains(t, err, "model model1 metadata: unknown macro '${PORT}'")
 	})
 
 	t.Run("Proxy value required if no ${PORT} in cmd", func(t *testing.T) {
@@ -185,10 +253,63 @@ models:
     cmd: svr --port 111
 `
 		_, err := LoadConfigFromReader(strings.NewReader(content))
-		assert.Equal(t, "model model1: proxy uses ${PORT} but cmd does not - ${PORT} is only available when used in cmd", err.Error())
+		assert.Equal(t, "model model1: proxy uses ${PORT} but cmd does not - ${PORT} is only available when used in cmd", validationMessage(t, err))
 	})
 }
 
+func TestConfig_CollectsAllErrors(t *testing.T) {
+	content := `
+logToStdout: sometimes
+models:
+  model1:
+    cmd: svr --port ${PORT} ${unknown1}
+    aliases: [dupe]
+  model2:
+    cmd: svr --port ${PORT} ${unknown2}
+    aliases: [dupe]
+groups:
+  group1:
+    members: [model1, model1]
+`
+	_, err := LoadConfigFromReader(strings.NewReader(content))
+	if !assert.Error(t, err) {
+		return
+	}
+	assert.Contains(t, err.Error(), "logToStdout must be one of")
+	assert.Contains(t, err.Error(), "duplicate alias dupe found in model: model2")
+	assert.Contains(t, err.Error(), "unknown macro '${unknown1}' found in model1.cmd")
+	assert.Contains(t, err.Error(), "unknown macro '${unknown2}' found in model2.cmd")
+	assert.Contains(t, err.Error(), "duplicate model member model1 found in group: group1")
+}
+
+func TestConfig_ModelGroup(t *testing.T) {
+	content := `
+models:
+  model1:
+    cmd: svr --port ${PORT}
+  model2:
+    cmd: svr --port ${PORT}
+groups:
+  group1:
+    members: [model1]
+`
+	config, err := LoadConfigFromReader(strings.NewReader(content))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	group, found := config.ModelGroup("model1")
+	assert.True(t, found)
+	assert.Equal(t, "group1", group)
+
+	group, found = config.ModelGroup("model2")
+	assert.True(t, found)
+	assert.Equal(t, DEFAULT_GROUP_ID, group)
+
+	_, found = config.ModelGroup("nope")
+	assert.False(t, found)
+}
+
 func TestConfig_MacroReplacement(t *testing.T) {
 	content := `
 startPort: 9990
@@ -277,7 +398,7 @@ models:
 		t.Run(tt.name, func(t *testing.T) {
 			_, err := LoadConfigFromReader(strings.NewReader(tt.config))
 			assert.NotNil(t, err)
-			assert.Equal(t, tt.expectedError, err.Error())
+			assert.Equal(t, tt.expectedError, validationMessage(t, err))
 		})
 	}
 }
@@ -806,7 +927,7 @@ func TestConfig_APIKeys_Invalid(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			_, err := LoadConfigFromReader(strings.NewReader(tt.content))
 			if assert.Error(t, err) {
-				assert.Equal(t, tt.expectedErr, err.Error())
+				assert.Equal(t, tt.expectedErr, validationMessage(t, err))
 			}
 		})
 	}
@@ -846,7 +967,7 @@ func TestConfig_APIKeys_EnvMacros(t *testing.T) {
 		content := `apiKeys: ["${env.TEST_EMPTY_KEY}"]`
 		_, err := LoadConfigFromReader(strings.NewReader(content))
 		assert.Error(t, err)
-		assert.Equal(t, "empty api key found in apiKeys", err.Error())
+		assert.Equal(t, "empty api key found in apiKeys", validationMessage(t, err))
 	})
 }
 
@@ -1375,3 +1496,409 @@ models:
 	})
 
 }
+
+func TestConfig_Profiles(t *testing.T) {
+	content := `
+models:
+  model1:
+    cmd: path/to/cmd --port ${PORT}
+    aliases: [m1]
+  model2:
+    cmd: path/to/cmd --port ${PORT}
+  model3:
+    cmd: path/to/cmd --port ${PORT}
+
+profiles:
+  coding: [m1, model2]
+`
+	config, err := LoadConfigFromReader(strings.NewReader(content))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// aliases are stored as model IDs
+	assert.Equal(t, []string{"model1", "model2"}, config.Profiles["coding"])
+
+	profile, modelID, found := config.ProfileModel("coding:m1")
+	assert.True(t, found)
+	assert.Equal(t, "coding", profile)
+	assert.Equal(t, "model1", modelID)
+
+	for _, search := range []string{"model1", "coding:model3", "other:model1", "coding:"} {
+		_, _, found := config.ProfileModel(search)
+		assert.False(t, found, search)
+	}
+}
+
+func TestConfig_ProfilesInvalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		profiles string
+		expected string
+	}{
+		{"unknown model", `coding: [model1, nope]`, "profile coding: unknown model nope"},
+		{"duplicate model", `coding: [model1, m1]`, "profile coding: duplicate model m1"},
+		{"split char in name", `"a:b": [model1]`, "invalid profile name `a:b`, it can not be empty or contain `:`"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := `
+models:
+  model1:
+    cmd: path/to/cmd --port ${PORT}
+    aliases: [m1]
+profiles:
+  ` + tt.profiles + "\n"
+			_, err := LoadConfigFromReader(strings.NewReader(content))
+			if assert.Error(t, err) {
+				assert.Equal(t, tt.expected, validationMessage(t, err))
+			}
+		})
+	}
+}
+
+func TestConfig_MaxLoaded(t *testing.T) {
+	config, err := LoadConfigFromReader(strings.NewReader("maxLoadedModels: 3\nmaxLoadedGroups: 2\n"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, 3, config.MaxLoadedModels)
+		assert.Equal(t, 2, config.MaxLoadedGroups)
+	}
+
+	_, err = LoadConfigFromReader(strings.NewReader("maxLoadedModels: -1\n"))
+	if assert.Error(t, err) {
+		assert.Equal(t, "maxLoadedModels must not be negative", validationMessage(t, err))
+	}
+	_, err = LoadConfigFromReader(strings.NewReader("maxLoadedGroups: -1\n"))
+	if assert.Error(t, err) {
+		assert.Equal(t, "maxLoadedGroups must not be negative", validationMessage(t, err))
+	}
+}
+
+func TestConfig_Drain(t *testing.T) {
+	content := `
+drainTimeout: 30
+drainPolicy: reject
+models:
+  model1:
+    cmd: path/to/cmd --port ${PORT}
+  model2:
+    cmd: path/to/cmd --port ${PORT}
+    drainTimeout: 5
+    drainPolicy: queue
+`
+	config, err := LoadConfigFromReader(strings.NewReader(content))
+	if assert.NoError(t, err) {
+		assert.Equal(t, 30, config.Models["model1"].DrainTimeout)
+		assert.Equal(t, DrainPolicyReject, config.Models["model1"].DrainPolicy)
+		assert.Equal(t, 5, config.Models["model2"].DrainTimeout)
+		assert.Equal(t, DrainPolicyQueue, config.Models["model2"].DrainPolicy)
+	}
+
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{"negative timeout", "drainTimeout: -1\n", "drainTimeout must not be negative"},
+		{"invalid policy", "drainPolicy: wait\n", "drainPolicy must be one of: queue, reject"},
+		{
+			"negative model timeout",
+			"models:\n  model1: {cmd: 'cmd --port ${PORT}', drainTimeout: -1}\n",
+			"model model1: drainTimeout must not be negative",
+		},
+		{
+			"invalid model policy",
+			"models:\n  model1: {cmd: 'cmd --port ${PORT}', drainPolicy: wait}\n",
+			"model model1: drainPolicy must be one of: queue, reject",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfigFromReader(strings.NewReader(tt.content))
+			if assert.Error(t, err) {
+				assert.Equal(t, tt.expected, validationMessage(t, err))
+			}
+		})
+	}
+}
+
+func TestConfig_ModelLimits(t *testing.T) {
+	content := `
+macros:
+  models: /srv/models
+models:
+  model1:
+    cmd: path/to/cmd --port ${PORT}
+    workingDir: ${models}/${MODEL_ID}
+    limits:
+      openFiles: 4096
+      memory: 32768
+      cgroup:
+        parent: /sys/fs/cgroup/llama
+        cpus: 2.5
+        memoryMax: 16384
+`
+	config, err := LoadConfigFromReader(strings.NewReader(content))
+	if assert.NoError(t, err) {
+		model := config.Models["model1"]
+		assert.Equal(t, "/srv/models/model1", model.WorkingDir)
+		assert.Equal(t, LimitsConfig{
+			OpenFiles: 4096,
+			Memory:    32768,
+			Cgroup: CgroupConfig{
+				Parent:    "/sys/fs/cgroup/llama",
+				CPUs:      2.5,
+				MemoryMax: 16384,
+			},
+		}, model.Limits)
+	}
+
+	tests := []struct {
+		name     string
+		limits   string
+		expected string
+	}{
+		{"negative open files", "{openFiles: -1}", "model model1: limits.openFiles must not be negative"},
+		{"negative memory", "{memory: -1}", "model model1: limits.memory must not be negative"},
+		{"negative cpus", "{cgroup: {cpus: -0.5}}", "model model1: limits.cgroup.cpus must not be negative"},
+		{"negative memory max", "{cgroup: {memoryMax: -1}}", "model model1: limits.cgroup.memoryMax must not be negative"},
+		{"relative parent", "{cgroup: {parent: llama}}", "model model1: limits.cgroup.parent must be an absolute path"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := fmt.Sprintf("models:\n  model1: {cmd: 'cmd --port ${PORT}', limits: %s}\n", tt.limits)
+			_, err := LoadConfigFromReader(strings.NewReader(content))
+			if assert.Error(t, err) {
+				assert.Equal(t, tt.expected, validationMessage(t, err))
+			}
+		})
+	}
+}
+
+func TestConfig_ModelReplicas(t *testing.T) {
+	content := `
+startPort: 9000
+models:
+  model1:
+    cmd: path/to/cmd --port ${PORT}
+    replicas: 3
+    env:
+      - CUDA_VISIBLE_DEVICES=${REPLICA}
+  model2:
+    cmd: path/to/cmd --port ${PORT} --seed ${REPLICA}
+`
+	config, err := LoadConfigFromReader(strings.NewReader(content))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// each replica has a port of its own
+	model1 := config.Models["model1"]
+	assert.Equal(t, 9000, model1.Port)
+	assert.Equal(t, "path/to/cmd --port ${PORT}", model1.Cmd)
+	assert.Equal(t, 9003, config.Models["model2"].Port)
+
+	replica := model1.ForReplica(2)
+	assert.Equal(t, 9002, replica.Port)
+	assert.Equal(t, "path/to/cmd --port 9002", replica.Cmd)
+	assert.Equal(t, "http://localhost:9002", replica.Proxy)
+	assert.Equal(t, []string{"CUDA_VISIBLE_DEVICES=2"}, replica.Env)
+	assert.Equal(t, []string{"CUDA_VISIBLE_DEVICES=${REPLICA}"}, model1.Env)
+
+	// without replicas it is the first one
+	assert.Equal(t, "path/to/cmd --port 9003 --seed 0", config.Models["model2"].Cmd)
+
+	_, err = LoadConfigFromReader(strings.NewReader("models:\n  model1: {cmd: 'cmd --port ${PORT}', replicas: -1}\n"))
+	assert.ErrorContains(t, err, "model model1: replicas must not be negative")
+
+	_, err = LoadConfigFromReader(strings.NewReader("macros:\n  REPLICA: 1\nmodels:\n  model1: {cmd: 'cmd --port ${PORT}'}\n"))
+	assert.ErrorContains(t, err, "macro name 'REPLICA' is reserved")
+}
+
+func TestConfig_ModelAutoscaling(t *testing.T) {
+	content := `
+models:
+  model1:
+    cmd: path/to/cmd --port ${PORT}
+    maxReplicas: 3
+  model2:
+    cmd: path/to/cmd --port ${PORT}
+`
+	config, err := LoadConfigFromReader(strings.NewReader(content))
+	if assert.NoError(t, err) {
+		model1 := config.Models["model1"]
+		assert.Equal(t, 3, model1.Replicas)
+		assert.Equal(t, 1, model1.MinReplicas)
+		assert.Equal(t, 1, model1.ScaleUpThreshold)
+		assert.Equal(t, 10, model1.ScaleWindow)
+
+		// ports for every replica up to maxReplicas
+		assert.Equal(t, model1.Port+3, config.Models["model2"].Port)
+		assert.Equal(t, 0, config.Models["model2"].ScaleWindow)
+	}
+
+	tests := []struct {
+		name     string
+		scaling  string
+		expected string
+	}{
+		{"negative max", "maxReplicas: -1", "model model1: maxReplicas must not be negative"},
+		{"negative threshold", "maxReplicas: 2, scaleUpThreshold: -1", "model model1: scaleUpThreshold must not be negative"},
+		{"negative window", "maxReplicas: 2, scaleWindow: -1", "model model1: scaleWindow must not be negative"},
+		{"min over max", "minReplicas: 3, maxReplicas: 2", "model model1: minReplicas must not be more than maxReplicas"},
+		{"min without max", "minReplicas: 2", "model model1: minReplicas requires maxReplicas"},
+		{"with replicas", "replicas: 2, maxReplicas: 2", "model model1: replicas can not be used with maxReplicas"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := fmt.Sprintf("models:\n  model1: {cmd: 'cmd --port ${PORT}', %s}\n", tt.scaling)
+			_, err := LoadConfigFromReader(strings.NewReader(content))
+			assert.ErrorContains(t, err, tt.expected)
+		})
+	}
+}
+
+func TestConfig_LifecycleHooks(t *testing.T) {
+	content := `
+macros:
+  hooks_url: http://hooks.local
+hooks:
+  beforeStart:
+    - command: mount-model ${MODEL_ID}
+      timeout: 120
+  onCrash:
+    - url: ${hooks_url}/crash?model=${MODEL_ID}&pid=${PID}
+models:
+  model1:
+    cmd: path/to/cmd --port ${PORT}
+    hooks:
+      beforeStart:
+        - command: warm-cache --port ${PORT}
+      afterStop:
+        - command: kill-children ${PID}
+  model2:
+    cmd: path/to/cmd --port ${PORT}
+`
+	config, err := LoadConfigFromReader(strings.NewReader(content))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// the global hooks run first
+	assert.Equal(t, LifecycleHooks{
+		BeforeStart: []Hook{
+			{Command: "mount-model model1", Timeout: 120},
+			{Command: "warm-cache --port ${PORT}"},
+		},
+		AfterStop: []Hook{{Command: "kill-children ${PID}"}},
+		OnCrash:   []Hook{{URL: "http://hooks.local/crash?model=model1&pid=${PID}"}},
+	}, config.Models["model1"].Hooks)
+	assert.Equal(t, LifecycleHooks{
+		BeforeStart: []Hook{{Command: "mount-model model2", Timeout: 120}},
+		OnCrash:     []Hook{{URL: "http://hooks.local/crash?model=model2&pid=${PID}"}},
+	}, config.Models["model2"].Hooks)
+
+	tests := []struct {
+		name     string
+		hooks    string
+		expected string
+	}{
+		{"empty hook", "{afterReady: [{timeout: 5}]}", "model model1: hooks.afterReady[0]: command or url is required"},
+		{"command and url", "{afterStop: [{command: a, url: 'http://b'}]}", "model model1: hooks.afterStop[0]: command and url can not be used together"},
+		{"invalid url", "{onCrash: [{url: 'ftp://b'}]}", "model model1: hooks.onCrash[0]: url must start with http:// or https://"},
+		{"negative timeout", "{afterReady: [{command: a, timeout: -1}]}", "model model1: hooks.afterReady[0]: timeout must not be negative"},
+		{"pid before start", "{beforeStart: [{command: 'a ${PID}'}]}", "unknown macro '${PID}' found in model1.hooks.beforeStart"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := fmt.Sprintf("models:\n  model1: {cmd: 'cmd --port ${PORT}', hooks: %s}\n", tt.hooks)
+			_, err := LoadConfigFromReader(strings.NewReader(content))
+			assert.ErrorContains(t, err, tt.expected)
+		})
+	}
+
+	_, err = LoadConfigFromReader(strings.NewReader("hooks:\n  afterReady: [{}]\nmodels:\n  model1: {cmd: 'cmd --port ${PORT}'}\n"))
+	assert.ErrorContains(t, err, "hooks.afterReady[0]: command or url is required")
+}
+
+func TestConfig_Container(t *testing.T) {
+	content := `
+startPort: 10000
+macros:
+  models_dir: /mnt/models
+models:
+  vllm:
+    cmd: --model /models/${MODEL_ID}
+    container:
+      image: vllm/vllm-openai:latest
+      port: 8000
+      mounts:
+        - ${models_dir}:/models:ro
+      env:
+        - HF_HOME=/models/.cache
+      gpus: all
+  llama:
+    container:
+      image: ghcr.io/ggml-org/llama.cpp:server
+      runtime: podman
+      network: host
+      devices: [nvidia.com/gpu=all]
+      args: [--port, "${PORT}"]
+`
+	config, err := LoadConfigFromReader(strings.NewReader(content))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// container.port gives the model a port without ${PORT} in cmd
+	vllm := config.Models["vllm"]
+	assert.Equal(t, ContainerConfig{
+		Image:  "vllm/vllm-openai:latest",
+		Port:   8000,
+		Mounts: []string{"/mnt/models:/models:ro"},
+		Env:    []string{"HF_HOME=/models/.cache"},
+		GPUs:   "all",
+	}, vllm.Container)
+	assert.Equal(t, "--model /models/vllm", vllm.Cmd)
+	assert.Equal(t, "http://localhost:10001", vllm.Proxy)
+	assert.Equal(t, DefaultContainerRuntime, vllm.Container.RuntimeCommand())
+
+	// an empty cmd uses the command of the image
+	llama := config.Models["llama"]
+	assert.Equal(t, "podman", llama.Container.RuntimeCommand())
+	assert.Equal(t, []string{"--port", "10000"}, llama.Container.Args)
+	args, err := llama.SanitizedCommand()
+	assert.NoError(t, err)
+	assert.Empty(t, args)
+
+	tests := []struct {
+		name      string
+		container string
+		expected  string
+	}{
+		{"no image", "{runtime: podman}", "model model1: container.image is required"},
+		{"image with spaces", "{image: 'vllm --gpus all'}", "model model1: container.image must not contain spaces"},
+		{"invalid port", "{image: vllm, port: 70000}", "model model1: container.port must be between 1 and 65535"},
+		{"invalid env", "{image: vllm, env: [HF_HOME]}", `model model1: container.env must be KEY=value, got "HF_HOME"`},
+		{"unknown macro", "{image: vllm, mounts: ['${nope}:/models']}", "unknown macro '${nope}' found in model1.container"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := fmt.Sprintf("models:\n  model1: {cmd: 'cmd --port ${PORT}', container: %s}\n", tt.container)
+			_, err := LoadConfigFromReader(strings.NewReader(content))
+			assert.ErrorContains(t, err, tt.expected)
+		})
+	}
+}
+
+func TestConfig_StateDir(t *testing.T) {
+	config, err := LoadConfigFromReader(strings.NewReader("stateDir: /var/lib/llama-swap\ndetachOnShutdown: true\nmodels:\n  model1: {cmd: 'cmd --port ${PORT}'}\n"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "/var/lib/llama-swap", config.StateDir)
+		assert.True(t, config.DetachOnShutdown)
+	}
+
+	_, err = LoadConfigFromReader(strings.NewReader("detachOnShutdown: true\nmodels:\n  model1: {cmd: 'cmd --port ${PORT}'}\n"))
+	assert.ErrorContains(t, err, "detachOnShutdown requires stateDir")
+}
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+const DefaultContainerRuntime = "docker"
+
+// ContainerConfig runs the model in a container with the Docker or Podman CLI. The
+// model's cmd is the command of the container, an empty cmd uses the image's.
+type ContainerConfig struct {
+	// the image to run, required to run the model in a container
+	Image string `json:"image" yaml:"image"`
+
+	// docker, podman or the path to a compatible CLI, default docker
+	Runtime string `json:"runtime,omitempty" yaml:"runtime,omitempty"`
+
+	// the port the upstream listens on in the container, it is published on ${PORT}
+	Port int `json:"port,omitempty" yaml:"port,omitempty"`
+
+	// the network the container joins, e.g. host
+	Network string `json:"network,omitempty" yaml:"network,omitempty"`
+
+	// volumes, host:container[:options]
+	Mounts []string `json:"mounts,omitempty" yaml:"mounts,omitempty"`
+
+	// environment variables of the container, KEY=value
+	Env []string `json:"env,omitempty" yaml:"env,omitempty"`
+
+	// GPUs passed to the container, e.g. all or device=0,1
+	GPUs string `json:"gpus,omitempty" yaml:"gpus,omitempty"`
+
+	// devices passed to the container, e.g. /dev/dri or nvidia.com/gpu=all
+	Devices []string `json:"devices,omitempty" yaml:"devices,omitempty"`
+
+	// more arguments for the run command, placed before the image
+	Args []string `json:"args,omitempty" yaml:"args,omitempty"`
+}
+
+// Enabled is true when the model runs in a container
+func (c ContainerConfig) Enabled() bool {
+	return c.Image != ""
+}
+
+// RuntimeCommand returns the CLI used to run the container
+func (c ContainerConfig) RuntimeCommand() string {
+	if c.Runtime == "" {
+		return DefaultContainerRuntime
+	}
+	return c.Runtime
+}
+
+// replace returns a copy of the container settings with replace applied to the
+// strings that support macros
+func (c ContainerConfig) replace(replace func(string) string) ContainerConfig {
+	replaceAll := func(values []string) []string {
+		if len(values) == 0 {
+			return values
+		}
+		replaced := make([]string, len(values))
+		for i, v := range values {
+			replaced[i] = replace(v)
+		}
+		return replaced
+	}
+
+	c.Image = replace(c.Image)
+	c.Network = replace(c.Network)
+	c.Mounts = replaceAll(c.Mounts)
+	c.Env = replaceAll(c.Env)
+	c.GPUs = replace(c.GPUs)
+	c.Devices = replaceAll(c.Devices)
+	c.Args = replaceAll(c.Args)
+	return c
+}
+
+// strings returns the settings that support macros, for validation
+func (c ContainerConfig) strings() []string {
+	values := []string{c.Image, c.Network, c.GPUs}
+	values = append(values, c.Mounts...)
+	values = append(values, c.Env...)
+	values = append(values, c.Devices...)
+	return append(values, c.Args...)
+}
+
+// validate checks the container settings of modelId
+func (c ContainerConfig) validate(modelId string) ValidationErrors {
+	var errs ValidationErrors
+	add := func(field string, err error) {
+		errs = append(errs, atPath(fmt.Errorf("model %s: %w", modelId, err), "models", modelId, "container", field))
+	}
+
+	if !c.Enabled() {
+		if c.Runtime != "" || c.Port != 0 || c.Network != "" || c.GPUs != "" || len(c.Mounts) > 0 || len(c.Env) > 0 || len(c.Devices) > 0 || len(c.Args) > 0 {
+			add("image", fmt.Errorf("container.image is required"))
+		}
+		return errs
+	}
+
+	if strings.ContainsAny(c.Image, " \t\n") {
+		add("image", fmt.Errorf("container.image must not contain spaces"))
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		add("port", fmt.Errorf("container.port must be between 1 and 65535"))
+	}
+	for _, env := range c.Env {
+		if !strings.Contains(env, "=") {
+			add("env", fmt.Errorf("container.env must be KEY=value, got %q", env))
+		}
+	}
+	return errs
+}
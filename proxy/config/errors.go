@@ -0,0 +1,85 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ValidationError is a single problem found in the configuration. File, Line and
+// Column point at the YAML node where the problem is. Line and Column are 0 when
+// the position is not known.
+type ValidationError struct {
+	File   string
+	Line   int
+	Column int
+	Err    error
+
+	// keys leading to the problem, used to look up the position
+	path []string
+}
+
+func (e *ValidationError) Error() string {
+	switch {
+	case e.File != "" && e.Line > 0 && e.Column > 0:
+		return fmt.Sprintf("%s:%d:%d: %v", e.File, e.Line, e.Column, e.Err)
+	case e.File != "" && e.Line > 0:
+		return fmt.Sprintf("%s:%d: %v", e.File, e.Line, e.Err)
+	case e.File != "":
+		return fmt.Sprintf("%s: %v", e.File, e.Err)
+	default:
+		return e.Err.Error()
+	}
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationErrors is every problem found while loading a configuration. It is
+// returned by LoadConfig and LoadConfigFromReader so callers can show each one.
+type ValidationErrors []*ValidationError
+
+func (e ValidationErrors) Error() string {
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (e ValidationErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, err := range e {
+		errs[i] = err
+	}
+	return errs
+}
+
+// atPath creates a ValidationError for the config key at path, ie: "models", "llama", "cmd".
+// The position is filled in once all validation is done.
+func atPath(err error, path ...string) *ValidationError {
+	return &ValidationError{Err: err, path: path}
+}
+
+// inFile turns err into ValidationErrors, setting file on errors that do not have one
+func inFile(err error, file string) ValidationErrors {
+	var errs ValidationErrors
+	var validationErrs ValidationErrors
+	var validationErr *ValidationError
+	switch {
+	case errors.As(err, &validationErrs):
+		errs = validationErrs
+	case errors.As(err, &validationErr):
+		errs = ValidationErrors{validationErr}
+	default:
+		errs = ValidationErrors{{Err: err}}
+	}
+
+	for _, e := range errs {
+		if e.File == "" {
+			e.File = file
+		}
+	}
+	return errs
+}
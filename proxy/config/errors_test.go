@@ -0,0 +1,131 @@
+package config
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// validationMessage returns the message of the only validation error in err, without its position
+func validationMessage(t *testing.T, err error) string {
+	t.Helper()
+	errs, ok := err.(ValidationErrors)
+	if !assert.True(t, ok, "expected ValidationErrors, got %T", err) || !assert.Len(t, errs, 1) {
+		return err.Error()
+	}
+	return errs[0].Err.Error()
+}
+
+func TestConfig_ValidationErrorPositions(t *testing.T) {
+	content := `startPort: 5800
+models:
+  model1:
+    cmd: svr --port ${PORT} ${unknown}
+    aliases: [shared]
+  model2:
+    cmd: svr --port ${PORT}
+    aliases:
+      - shared
+  model3:
+    cmd: svr --port ${PORT}
+    proxy: "http://localhost:${PORT}"
+    ttl: forever
+peers:
+  peer1:
+    proxy: http://192.168.1.23
+groups:
+  group1:
+    members: [model1, model2, model1]
+`
+	_, err := LoadConfigFromReader(strings.NewReader(content))
+
+	var errs ValidationErrors
+	if !assert.ErrorAs(t, err, &errs) {
+		return
+	}
+
+	var found []string
+	for _, e := range errs {
+		assert.Equal(t, "main config", e.File)
+		found = append(found, strings.TrimPrefix(e.Error(), "main config:"))
+	}
+
+	assert.Equal(t, []string{
+		"4:5: unknown macro '${unknown}' found in model1.cmd",
+		"9:9: duplicate alias shared found in model: model2",
+		"10:3: models.model3: yaml: unmarshal errors:\n  line 13: cannot unmarshal !!str `forever` into int",
+		"15:3: peers.peer1: peer models can not be empty",
+		"19:31: duplicate model member model1 found in group: group1",
+	}, found)
+}
+
+func TestConfig_ValidationErrorsInIncludes(t *testing.T) {
+	tempDir := t.TempDir()
+	configFile := filepath.Join(tempDir, "config.yaml")
+	writeTestFile(t, configFile, `include: [models.yaml]
+models:
+  model1:
+    cmd: svr --port ${PORT}
+`)
+	includeFile := filepath.Join(tempDir, "models.yaml")
+	writeTestFile(t, includeFile, `models:
+  model1:
+    cmd: other --port ${PORT}
+  model2:
+    cmd: svr --port ${PORT}
+    checkEndpoint: /health/${nope}
+`)
+
+	_, err := LoadConfig(configFile)
+	var errs ValidationErrors
+	if !assert.ErrorAs(t, err, &errs) || !assert.Len(t, errs, 2) {
+		return
+	}
+
+	assert.Equal(t, includeFile, errs[0].File)
+	assert.Equal(t, 2, errs[0].Line)
+	assert.Contains(t, errs[0].Error(), "duplicate model ID model1")
+
+	assert.Equal(t, includeFile, errs[1].File)
+	assert.Equal(t, 6, errs[1].Line)
+	assert.Equal(t, 5, errs[1].Column)
+	assert.Contains(t, errs[1].Error(), "unknown macro '${nope}' found in model2.checkEndpoint")
+}
+
+func TestConfig_ValidationErrorsFromTemplates(t *testing.T) {
+	content := `modelTemplates:
+  base:
+    cmd: svr --port ${PORT} ${unknown}
+models:
+  model1:
+    extends: base
+`
+	_, err := LoadConfigFromReader(strings.NewReader(content))
+	var errs ValidationErrors
+	if !assert.ErrorAs(t, err, &errs) || !assert.Len(t, errs, 1) {
+		return
+	}
+
+	// the field came from the template so the model is reported
+	assert.Equal(t, 5, errs[0].Line)
+	assert.Equal(t, 3, errs[0].Column)
+}
+
+func TestConfig_ValidationErrorsEnvMacros(t *testing.T) {
+	content := `models:
+  model1:
+    cmd: svr --port ${PORT} ${env.LLAMA_SWAP_TEST_UNSET_1}
+    env:
+      - KEY=${env.LLAMA_SWAP_TEST_UNSET_2}
+`
+	_, err := LoadConfigFromReader(strings.NewReader(content))
+	var errs ValidationErrors
+	if !assert.ErrorAs(t, err, &errs) || !assert.Len(t, errs, 2) {
+		return
+	}
+
+	assert.Equal(t, "main config:3:29: environment variable 'LLAMA_SWAP_TEST_UNSET_1' is not set", errs[0].Error())
+	assert.Equal(t, "main config:5:13: environment variable 'LLAMA_SWAP_TEST_UNSET_2' is not set", errs[1].Error())
+}
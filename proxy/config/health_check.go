@@ -0,0 +1,162 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+const (
+	HealthCheckHTTP    = "http"
+	HealthCheckTCP     = "tcp"
+	HealthCheckCommand = "command"
+	HealthCheckNone    = "none"
+)
+
+// HealthCheck configures how llama-swap decides an upstream is ready. Without it the
+// upstream is ready when checkEndpoint returns an HTTP 200.
+type HealthCheck struct {
+	// http, tcp, command or none. Default: http, or none when checkEndpoint is "none"
+	Type string `json:"type,omitempty" yaml:"type,omitempty"`
+
+	// http: the path requested on the upstream, default: checkEndpoint
+	Path string `json:"path,omitempty" yaml:"path,omitempty"`
+
+	// http: a gjson path the JSON response must match, e.g. `status == "ok"`
+	Expect string `json:"expect,omitempty" yaml:"expect,omitempty"`
+
+	// command: ready when it exits with 0. Supports ${PORT} and ${MODEL_ID}.
+	Command string `json:"command,omitempty" yaml:"command,omitempty"`
+
+	// seconds between checks, default 5
+	Interval int `json:"interval,omitempty" yaml:"interval,omitempty"`
+
+	// seconds a single check can take, default 5
+	Timeout int `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+
+	// re-checks the upstream while it is ready
+	Liveness LivenessCheck `json:"liveness,omitempty" yaml:"liveness,omitempty"`
+}
+
+// LivenessCheck runs the health check while the upstream is ready and stops it when
+// the check keeps failing
+type LivenessCheck struct {
+	// seconds between checks, 0 disables liveness checks
+	Interval int `json:"interval,omitempty" yaml:"interval,omitempty"`
+
+	// consecutive failed checks before the upstream is stopped, default 3
+	Failures int `json:"failures,omitempty" yaml:"failures,omitempty"`
+}
+
+// HealthCheckSettings returns the model's health check with the defaults filled in
+func (m *ModelConfig) HealthCheckSettings() HealthCheck {
+	hc := m.HealthCheck
+	checkEndpoint := strings.TrimSpace(m.CheckEndpoint)
+	if hc.Type == "" {
+		hc.Type = HealthCheckHTTP
+		if checkEndpoint == "none" {
+			hc.Type = HealthCheckNone
+		}
+	}
+	if hc.Type == HealthCheckHTTP && hc.Path == "" {
+		hc.Path = checkEndpoint
+	}
+	if hc.Interval == 0 {
+		hc.Interval = 5
+	}
+	if hc.Timeout == 0 {
+		hc.Timeout = 5
+	}
+	if hc.Liveness.Interval > 0 && hc.Liveness.Failures == 0 {
+		hc.Liveness.Failures = 3
+	}
+	return hc
+}
+
+// validate checks the health check of modelId
+func (hc HealthCheck) validate(modelId string) ValidationErrors {
+	var errs ValidationErrors
+	add := func(field string, err error) {
+		errs = append(errs, atPath(fmt.Errorf("model %s: %w", modelId, err), "models", modelId, "healthCheck", field))
+	}
+
+	switch hc.Type {
+	case "", HealthCheckHTTP, HealthCheckTCP, HealthCheckNone:
+	case HealthCheckCommand:
+		if strings.TrimSpace(hc.Command) == "" {
+			add("command", fmt.Errorf("healthCheck.command is required with type command"))
+		}
+	default:
+		add("type", fmt.Errorf("healthCheck.type must be one of: http, tcp, command, none"))
+	}
+
+	if hc.Expect != "" {
+		if _, err := ParseHealthExpect(hc.Expect); err != nil {
+			add("expect", fmt.Errorf("healthCheck.expect: %w", err))
+		}
+	}
+	if hc.Interval < 0 {
+		add("interval", fmt.Errorf("healthCheck.interval must not be negative"))
+	}
+	if hc.Timeout < 0 {
+		add("timeout", fmt.Errorf("healthCheck.timeout must not be negative"))
+	}
+	if hc.Liveness.Interval < 0 {
+		errs = append(errs, atPath(fmt.Errorf("model %s: healthCheck.liveness.interval must not be negative", modelId), "models", modelId, "healthCheck", "liveness", "interval"))
+	}
+	if hc.Liveness.Failures < 0 {
+		errs = append(errs, atPath(fmt.Errorf("model %s: healthCheck.liveness.failures must not be negative", modelId), "models", modelId, "healthCheck", "liveness", "failures"))
+	}
+	return errs
+}
+
+// ParseHealthExpect parses a health check predicate: a gjson path, optionally followed
+// by == or != and a JSON value. Without a comparison the path must exist and not be
+// false or null.
+func ParseHealthExpect(expect string) (func(body []byte) bool, error) {
+	path, op, value := strings.TrimSpace(expect), "", ""
+	for _, candidate := range []string{"==", "!="} {
+		if left, right, found := strings.Cut(expect, candidate); found {
+			path, op, value = strings.TrimSpace(left), candidate, strings.TrimSpace(right)
+			break
+		}
+	}
+	if path == "" {
+		return nil, fmt.Errorf("missing gjson path in %q", expect)
+	}
+
+	if op == "" {
+		return func(body []byte) bool {
+			result := gjson.GetBytes(body, path)
+			return result.Exists() && result.Type != gjson.False && result.Type != gjson.Null
+		}, nil
+	}
+
+	var matches func(result gjson.Result) bool
+	switch {
+	case value == "true" || value == "false":
+		matches = func(result gjson.Result) bool {
+			return (result.Type == gjson.True || result.Type == gjson.False) && result.Bool() == (value == "true")
+		}
+	case value == "null":
+		matches = func(result gjson.Result) bool { return result.Exists() && result.Type == gjson.Null }
+	case strings.HasPrefix(value, `"`) || strings.HasPrefix(value, `'`):
+		if len(value) < 2 || value[len(value)-1] != value[0] {
+			return nil, fmt.Errorf("invalid string %s in %q", value, expect)
+		}
+		unquoted := value[1 : len(value)-1]
+		matches = func(result gjson.Result) bool { return result.Type == gjson.String && result.Str == unquoted }
+	default:
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %s in %q, use a quoted string, number, true, false or null", value, expect)
+		}
+		matches = func(result gjson.Result) bool { return result.Type == gjson.Number && result.Num == number }
+	}
+
+	return func(body []byte) bool {
+		return matches(gjson.GetBytes(body, path)) == (op == "==")
+	}, nil
+}
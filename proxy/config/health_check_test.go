@@ -0,0 +1,104 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseHealthExpect(t *testing.T) {
+	body := []byte(`{"status":"ok","ready":true,"loaded":2,"error":null,"model":{"name":"llama"}}`)
+
+	tests := []struct {
+		expect  string
+		matches bool
+	}{
+		{`status == "ok"`, true},
+		{`status == 'ok'`, true},
+		{`status != "ok"`, false},
+		{`status == "loading"`, false},
+		{`ready == true`, true},
+		{`ready == false`, false},
+		{`loaded == 2`, true},
+		{`loaded != 3`, true},
+		{`error == null`, true},
+		{`model.name == "llama"`, true},
+		{`ready`, true},
+		{`error`, false},
+		{`missing`, false},
+		{`missing == "ok"`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expect, func(t *testing.T) {
+			matches, err := ParseHealthExpect(tt.expect)
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.matches, matches(body))
+			}
+		})
+	}
+
+	for _, invalid := range []string{``, `== "ok"`, `status == ok`, `status == "ok`} {
+		_, err := ParseHealthExpect(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestConfig_HealthCheck(t *testing.T) {
+	content := `
+models:
+  model1:
+    cmd: path/to/cmd --port ${PORT}
+    healthCheck:
+      type: command
+      command: check-model --port ${PORT} --model ${MODEL_ID}
+      interval: 1
+      liveness:
+        interval: 30
+  model2:
+    cmd: path/to/cmd --port ${PORT}
+    checkEndpoint: none
+`
+	config, err := LoadConfigFromReader(strings.NewReader(content))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	model1 := config.Models["model1"]
+	assert.Equal(t, HealthCheck{
+		Type:     HealthCheckCommand,
+		Command:  "check-model --port 5800 --model model1",
+		Interval: 1,
+		Timeout:  5,
+		Liveness: LivenessCheck{Interval: 30, Failures: 3},
+	}, model1.HealthCheckSettings())
+
+	model2 := config.Models["model2"]
+	assert.Equal(t, HealthCheckNone, model2.HealthCheckSettings().Type)
+
+	tests := []struct {
+		name        string
+		healthCheck string
+		expected    string
+	}{
+		{"unknown type", "{type: grpc}", "model model1: healthCheck.type must be one of: http, tcp, command, none"},
+		{"missing command", "{type: command}", "model model1: healthCheck.command is required with type command"},
+		{"invalid expect", `{expect: "status == ok"}`, `model model1: healthCheck.expect: invalid value ok in "status == ok", use a quoted string, number, true, false or null`},
+		{"negative interval", "{interval: -1}", "model model1: healthCheck.interval must not be negative"},
+		{"negative liveness failures", "{liveness: {failures: -1}}", "model model1: healthCheck.liveness.failures must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := `
+models:
+  model1:
+    cmd: path/to/cmd --port ${PORT}
+    healthCheck: ` + tt.healthCheck + "\n"
+			_, err := LoadConfigFromReader(strings.NewReader(content))
+			if assert.Error(t, err) {
+				assert.Equal(t, tt.expected, validationMessage(t, err))
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// LifecycleHooks run commands or webhooks when a model starts, stops or crashes. They
+// are set for every model in hooks and per model, the global ones run first.
+type LifecycleHooks struct {
+	// before the command starts, a failing hook stops the model from starting
+	BeforeStart []Hook `yaml:"beforeStart"`
+
+	// when the model passed its health check
+	AfterReady []Hook `yaml:"afterReady"`
+
+	// after llama-swap stopped the command
+	AfterStop []Hook `yaml:"afterStop"`
+
+	// after the command exited without being stopped
+	OnCrash []Hook `yaml:"onCrash"`
+}
+
+// Hook is a command or a webhook. Both support ${MODEL_ID}, ${PORT} and ${PID}.
+type Hook struct {
+	// run without a shell, it fails when it exits non-zero
+	Command string `yaml:"command"`
+
+	// receives a POST with the event as JSON, it fails without a 2xx response
+	URL string `yaml:"url"`
+
+	// seconds the hook can take, default 30
+	Timeout int `yaml:"timeout"`
+}
+
+// lifecycleHookNames are the yaml names of the hooks in LifecycleHooks
+var lifecycleHookNames = []string{"beforeStart", "afterReady", "afterStop", "onCrash"}
+
+// lists returns the hooks of every event, in the order of lifecycleHookNames
+func (h *LifecycleHooks) lists() []*[]Hook {
+	return []*[]Hook{&h.BeforeStart, &h.AfterReady, &h.AfterStop, &h.OnCrash}
+}
+
+// merge returns the hooks of h followed by the ones of other
+func (h LifecycleHooks) merge(other LifecycleHooks) LifecycleHooks {
+	merged := LifecycleHooks{}
+	mergedLists, otherLists := merged.lists(), other.lists()
+	for i, list := range h.lists() {
+		if len(*list) > 0 || len(*otherLists[i]) > 0 {
+			*mergedLists[i] = append(append([]Hook{}, *list...), *otherLists[i]...)
+		}
+	}
+	return merged
+}
+
+// replace returns a copy of the hooks with replace applied to every command and URL
+func (h LifecycleHooks) replace(replace func(string) string) LifecycleHooks {
+	for _, list := range h.lists() {
+		if len(*list) == 0 {
+			continue
+		}
+		hooks := make([]Hook, len(*list))
+		for i, hook := range *list {
+			hook.Command = replace(hook.Command)
+			hook.URL = replace(hook.URL)
+			hooks[i] = hook
+		}
+		*list = hooks
+	}
+	return h
+}
+
+// validate checks the hooks, prefix is added to the messages and path is where the
+// hooks are in the configuration
+func (h LifecycleHooks) validate(prefix string, path ...string) ValidationErrors {
+	var errs ValidationErrors
+	for i, list := range h.lists() {
+		name := lifecycleHookNames[i]
+		for j, hook := range *list {
+			hookPath := slices.Concat(path, []string{name, strconv.Itoa(j)})
+			field := fmt.Sprintf("hooks.%s[%d]", name, j)
+			command, url := strings.TrimSpace(hook.Command), strings.TrimSpace(hook.URL)
+			switch {
+			case command == "" && url == "":
+				errs = append(errs, atPath(fmt.Errorf("%s%s: command or url is required", prefix, field), hookPath...))
+			case command != "" && url != "":
+				errs = append(errs, atPath(fmt.Errorf("%s%s: command and url can not be used together", prefix, field), hookPath...))
+			case url != "" && !strings.HasPrefix(url, "${") && !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://"):
+				errs = append(errs, atPath(fmt.Errorf("%s%s: url must start with http:// or https://", prefix, field), slices.Concat(hookPath, []string{"url"})...))
+			}
+			if hook.Timeout < 0 {
+				errs = append(errs, atPath(fmt.Errorf("%s%s: timeout must not be negative", prefix, field), slices.Concat(hookPath, []string{"timeout"})...))
+			}
+		}
+	}
+	return errs
+}
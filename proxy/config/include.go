@@ -0,0 +1,233 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// includeFragment is the subset of the configuration that can be defined in
+// an included file. Everything else must live in the main configuration file.
+type includeFragment struct {
+	Models  map[string]ModelConfig `yaml:"models"`
+	Groups  map[string]GroupConfig `yaml:"groups"`
+	Macros  MacroList              `yaml:"macros"`
+	Peers   PeerDictionaryConfig   `yaml:"peers"`
+	Include []string               `yaml:"include"`
+}
+
+// IncludePaths returns the absolute file paths and glob patterns listed in
+// include. They are used to watch included files for changes.
+func (c *Config) IncludePaths() []string {
+	return c.includePaths
+}
+
+// resolveIncludePaths makes include patterns absolute, relative to baseDir
+func resolveIncludePaths(includes []string, baseDir string) ([]string, error) {
+	resolved := make([]string, 0, len(includes))
+	for _, pattern := range includes {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			return nil, fmt.Errorf("include: empty path")
+		}
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(baseDir, pattern)
+		}
+		abs, err := filepath.Abs(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("include: %s: %w", pattern, err)
+		}
+		resolved = append(resolved, abs)
+	}
+	return resolved, nil
+}
+
+// expandIncludePaths turns include patterns into a list of files. Globs that match
+// nothing are allowed, a plain path that does not exist is an error.
+func expandIncludePaths(patterns []string) ([]string, error) {
+	seen := make(map[string]bool)
+	var files []string
+	for _, pattern := range patterns {
+		var matches []string
+		if strings.ContainsAny(pattern, "*?[") {
+			m, err := filepath.Glob(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("include: invalid pattern %s: %w", pattern, err)
+			}
+			matches = m
+		} else {
+			if _, err := os.Stat(pattern); err != nil {
+				return nil, fmt.Errorf("include: %w", err)
+			}
+			matches = []string{pattern}
+		}
+
+		for _, file := range matches {
+			if seen[file] {
+				continue
+			}
+			seen[file] = true
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+// includeDocument is a parsed included file
+type includeDocument struct {
+	file string
+	doc  *yaml.Node
+}
+
+// loadIncludes reads and parses every file referenced in config.Include.
+// Env and secret macros are substituted in each file before it is parsed.
+func loadIncludes(config *Config, baseDir string, secrets *secretSources) ([]includeDocument, error) {
+	if len(config.Include) == 0 {
+		return nil, nil
+	}
+
+	patterns, err := resolveIncludePaths(config.Include, baseDir)
+	if err != nil {
+		return nil, err
+	}
+	config.includePaths = patterns
+
+	files, err := expandIncludePaths(patterns)
+	if err != nil {
+		return nil, err
+	}
+
+	docs := make([]includeDocument, 0, len(files))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("include: %w", err)
+		}
+
+		yamlStr, err := substituteEnvMacros(string(data))
+		if err != nil {
+			return nil, inFile(err, file)
+		}
+		yamlStr, err = secrets.substitute(yamlStr)
+		if err != nil {
+			return nil, inFile(err, file)
+		}
+
+		var doc yaml.Node
+		if err := yaml.Unmarshal([]byte(yamlStr), &doc); err != nil {
+			return nil, inFile(err, file)
+		}
+		docs = append(docs, includeDocument{file: file, doc: &doc})
+	}
+
+	return docs, nil
+}
+
+// mergeIncludes decodes the included documents and merges their models, groups,
+// macros and peers into config. mainName is used in error messages to identify
+// the main configuration file.
+func mergeIncludes(config *Config, mainName string, includes []includeDocument) ValidationErrors {
+	if len(includes) == 0 {
+		return nil
+	}
+
+	// track where things were defined for clearer error messages
+	modelSource := make(map[string]string)
+	for modelID := range config.Models {
+		modelSource[modelID] = mainName
+	}
+	groupSource := make(map[string]string)
+	for groupID := range config.Groups {
+		groupSource[groupID] = mainName
+	}
+	peerSource := make(map[string]string)
+	for peerID := range config.Peers {
+		peerSource[peerID] = mainName
+	}
+	macroSource := make(map[string]string)
+	for _, macro := range config.Macros {
+		macroSource[macro.Name] = mainName
+	}
+
+	var errs ValidationErrors
+	for _, include := range includes {
+		file := include.file
+		root := documentRoot(include.doc)
+
+		// keyError reports a problem at the definition of key in section
+		keyError := func(section, key string, err error) *ValidationError {
+			return nodeError(file, mappingKey(mappingValue(root, section), key), err)
+		}
+
+		var fragment includeFragment
+		if err := decodeDocument(include.doc, &fragment); err != nil {
+			errs = append(errs, decodeErrors(file, err)...)
+			continue
+		}
+
+		if len(fragment.Include) > 0 {
+			errs = append(errs, nodeError(file, mappingKey(root, "include"),
+				fmt.Errorf("include %s: nested include is not supported, list all files in %s", file, mainName)))
+		}
+
+		if config.Models == nil && len(fragment.Models) > 0 {
+			config.Models = make(map[string]ModelConfig)
+		}
+		for modelID, modelConfig := range fragment.Models {
+			if existing, found := modelSource[modelID]; found {
+				errs = append(errs, keyError("models", modelID, fmt.Errorf("duplicate model ID %s in %s, already defined in %s", modelID, file, existing)))
+				continue
+			}
+			modelSource[modelID] = file
+			config.Models[modelID] = modelConfig
+		}
+
+		if config.Groups == nil && len(fragment.Groups) > 0 {
+			config.Groups = make(map[string]GroupConfig)
+		}
+		for groupID, groupConfig := range fragment.Groups {
+			if existing, found := groupSource[groupID]; found {
+				errs = append(errs, keyError("groups", groupID, fmt.Errorf("duplicate group %s in %s, already defined in %s", groupID, file, existing)))
+				continue
+			}
+			groupSource[groupID] = file
+			config.Groups[groupID] = groupConfig
+		}
+
+		if config.Peers == nil && len(fragment.Peers) > 0 {
+			config.Peers = make(PeerDictionaryConfig)
+		}
+		for peerID, peerConfig := range fragment.Peers {
+			if existing, found := peerSource[peerID]; found {
+				errs = append(errs, keyError("peers", peerID, fmt.Errorf("duplicate peer %s in %s, already defined in %s", peerID, file, existing)))
+				continue
+			}
+			peerSource[peerID] = file
+			config.Peers[peerID] = peerConfig
+		}
+
+		// macros are appended in file order so macro-in-macro references keep working
+		for _, macro := range fragment.Macros {
+			if existing, found := macroSource[macro.Name]; found {
+				errs = append(errs, keyError("macros", macro.Name, fmt.Errorf("duplicate macro %s in %s, already defined in %s", macro.Name, file, existing)))
+				continue
+			}
+			macroSource[macro.Name] = file
+			config.Macros = append(config.Macros, macro)
+		}
+	}
+
+	return errs
+}
+
+// decodeDocument decodes a parsed YAML document into v. Empty documents are
+// left untouched.
+func decodeDocument(doc *yaml.Node, v any) error {
+	if doc == nil || len(doc.Content) == 0 {
+		return nil
+	}
+	return doc.Decode(v)
+}
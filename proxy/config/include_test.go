@@ -0,0 +1,231 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestFile(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+}
+
+func TestConfig_IncludeMergesFiles(t *testing.T) {
+	tempDir := t.TempDir()
+	configFile := filepath.Join(tempDir, "config.yaml")
+
+	writeTestFile(t, configFile, `
+include:
+  - models.d/*.yaml
+  - peers.yaml
+macros:
+  server: /usr/bin/llama-server
+models:
+  main:
+    cmd: ${server} --port ${PORT} -m main.gguf
+`)
+	writeTestFile(t, filepath.Join(tempDir, "models.d", "a.yaml"), `
+macros:
+  ctx: 4096
+models:
+  model-a:
+    cmd: ${server} --port ${PORT} -c ${ctx}
+    aliases: [a]
+groups:
+  team-a:
+    swap: false
+    members: ["model-a"]
+`)
+	writeTestFile(t, filepath.Join(tempDir, "models.d", "b.yaml"), `
+models:
+  model-b:
+    cmd: ${server} --port ${PORT} -c ${ctx}
+`)
+	writeTestFile(t, filepath.Join(tempDir, "peers.yaml"), `
+peers:
+  remote:
+    proxy: http://192.168.1.10
+    models: [remote-model]
+`)
+
+	config, err := LoadConfig(configFile)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, "/usr/bin/llama-server --port 5800 -m main.gguf", config.Models["main"].Cmd)
+	assert.Equal(t, "/usr/bin/llama-server --port 5801 -c 4096", config.Models["model-a"].Cmd)
+	assert.Equal(t, "/usr/bin/llama-server --port 5802 -c 4096", config.Models["model-b"].Cmd)
+
+	realName, found := config.RealModelName("a")
+	assert.True(t, found)
+	assert.Equal(t, "model-a", realName)
+
+	assert.Equal(t, []string{"model-a"}, config.Groups["team-a"].Members)
+	assert.Equal(t, []string{"main", "model-b"}, config.Groups[DEFAULT_GROUP_ID].Members)
+	assert.Contains(t, config.Peers, "remote")
+
+	assert.Equal(t, []string{
+		filepath.Join(tempDir, "models.d", "*.yaml"),
+		filepath.Join(tempDir, "peers.yaml"),
+	}, config.IncludePaths())
+}
+
+func TestConfig_IncludeErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		main        string
+		included    string
+		expectedErr string
+	}{
+		{
+			name: "duplicate model ID",
+			main: `
+include: [other.yaml]
+models:
+  model1:
+    cmd: server --port ${PORT}
+`,
+			included: `
+models:
+  model1:
+    cmd: server --port ${PORT}
+`,
+			expectedErr: "duplicate model ID model1 in",
+		},
+		{
+			name: "duplicate alias",
+			main: `
+include: [other.yaml]
+models:
+  model1:
+    cmd: server --port ${PORT}
+    aliases: [m]
+`,
+			included: `
+models:
+  model2:
+    cmd: server --port ${PORT}
+    aliases: [m]
+`,
+			expectedErr: "duplicate alias m found in model: model",
+		},
+		{
+			name: "duplicate group",
+			main: `
+include: [other.yaml]
+models:
+  model1:
+    cmd: server --port ${PORT}
+groups:
+  g1:
+    members: [model1]
+`,
+			included: `
+models:
+  model2:
+    cmd: server --port ${PORT}
+groups:
+  g1:
+    members: [model2]
+`,
+			expectedErr: "duplicate group g1 in",
+		},
+		{
+			name: "group member in multiple groups",
+			main: `
+include: [other.yaml]
+models:
+  model1:
+    cmd: server --port ${PORT}
+groups:
+  g1:
+    members: [model1]
+`,
+			included: `
+groups:
+  g2:
+    members: [model1]
+`,
+			expectedErr: "model member model1 is used in multiple groups",
+		},
+		{
+			name: "duplicate macro",
+			main: `
+include: [other.yaml]
+macros:
+  m: 1
+models:
+  model1:
+    cmd: server --port ${PORT}
+`,
+			included: `
+macros:
+  m: 2
+`,
+			expectedErr: "duplicate macro m in",
+		},
+		{
+			name: "nested include",
+			main: `
+include: [other.yaml]
+models:
+  model1:
+    cmd: server --port ${PORT}
+`,
+			included: `
+include: [more.yaml]
+`,
+			expectedErr: "nested include is not supported",
+		},
+		{
+			name: "missing file",
+			main: `
+include: [does-not-exist.yaml]
+models:
+  model1:
+    cmd: server --port ${PORT}
+`,
+			expectedErr: "does-not-exist.yaml",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir := t.TempDir()
+			configFile := filepath.Join(tempDir, "config.yaml")
+			writeTestFile(t, configFile, tt.main)
+			if tt.included != "" {
+				writeTestFile(t, filepath.Join(tempDir, "other.yaml"), tt.included)
+			}
+
+			_, err := LoadConfig(configFile)
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tt.expectedErr)
+			}
+		})
+	}
+}
+
+func TestConfig_IncludeEmptyGlob(t *testing.T) {
+	tempDir := t.TempDir()
+	configFile := filepath.Join(tempDir, "config.yaml")
+	writeTestFile(t, configFile, `
+include: [models.d/*.yaml]
+models:
+  model1:
+    cmd: server --port ${PORT}
+`)
+
+	config, err := LoadConfig(configFile)
+	assert.NoError(t, err)
+	assert.Len(t, config.Models, 1)
+}
@@ -2,7 +2,10 @@ package config
 
 import (
 	"errors"
+	"reflect"
 	"runtime"
+	"strconv"
+	"strings"
 )
 
 type ModelConfig struct {
@@ -23,6 +26,13 @@ type ModelConfig struct {
 	// Limit concurrency of HTTP requests to process
 	ConcurrencyLimit int `yaml:"concurrencyLimit"`
 
+	// MaxQueueSize: requests that wait for a free slot when the concurrency limit is
+	// reached. 0 rejects them right away with a 429.
+	MaxQueueSize int `yaml:"maxQueueSize"`
+
+	// QueueTimeout: seconds a request waits in the queue, default 60
+	QueueTimeout int `yaml:"queueTimeout"`
+
 	// Model filters see issue #174
 	Filters ModelFilters `yaml:"filters"`
 
@@ -41,6 +51,73 @@ type ModelConfig struct {
 	// These are merged with request-level values, with request values taking precedence
 	// Useful for setting model-specific defaults like enable_thinking for Qwen3
 	ChatTemplateKwargs map[string]any `yaml:"chatTemplateKwargs"`
+
+	// Extends: name of the entry in modelTemplates this model is based on
+	Extends string `yaml:"extends"`
+
+	// HealthCheck: how to check the upstream is ready, replaces checkEndpoint
+	HealthCheck HealthCheck `yaml:"healthCheck"`
+
+	// RestartPolicy: never, on-failure or always restart the process when it exits
+	// while it is ready. Empty is the same as never.
+	RestartPolicy string `yaml:"restartPolicy"`
+
+	// Restart limits how often a crashed process is restarted
+	Restart RestartConfig `yaml:"restart"`
+
+	// Replicas: how many instances of the model run at once, requests go to the one
+	// with the fewest in-flight requests. Each one has its own ${PORT} and ${REPLICA}.
+	Replicas int `yaml:"replicas"`
+
+	// MinReplicas, MaxReplicas: scale the replicas with the requests instead. minReplicas
+	// start when the model is loaded, more are started up to maxReplicas when there are
+	// more than ScaleUpThreshold in-flight or queued requests per replica for ScaleWindow
+	// seconds. Replicas above minReplicas are stopped by their ttl, or after ScaleWindow
+	// seconds without requests when the model has no ttl. The ttl stops the last
+	// minReplicas only when all of them reached it.
+	MinReplicas      int `yaml:"minReplicas"`
+	MaxReplicas      int `yaml:"maxReplicas"`
+	ScaleUpThreshold int `yaml:"scaleUpThreshold"`
+	ScaleWindow      int `yaml:"scaleWindow"`
+
+	// KeepWarm: load the model in the background on startup and after it was unloaded
+	// by its ttl or crashed, when no other model has to be unloaded for it
+	KeepWarm bool `yaml:"keepWarm"`
+
+	// DrainTimeout: seconds in-flight requests can take when the model is stopped before
+	// they are cancelled, 0 uses the global drainTimeout
+	DrainTimeout int `yaml:"drainTimeout"`
+
+	// DrainPolicy: queue or reject requests that arrive while the model is stopped,
+	// empty uses the global drainPolicy
+	DrainPolicy string `yaml:"drainPolicy"`
+
+	// WorkingDir: directory the cmd runs in, empty uses llama-swap's working directory
+	WorkingDir string `yaml:"workingDir"`
+
+	// Limits: resource limits of the upstream process, only applied on Linux
+	Limits LimitsConfig `yaml:"limits"`
+
+	// Hooks: commands or webhooks run when the model starts, stops or crashes, after
+	// the global hooks
+	Hooks LifecycleHooks `yaml:"hooks"`
+
+	// Container: run the model in a container instead of running cmd directly
+	Container ContainerConfig `yaml:"container"`
+
+	// Memory: MB the model uses on each device of the memoryBudget. When empty it is
+	// estimated from the model's GGUF file and split evenly over the devices.
+	Memory map[string]int `yaml:"memory"`
+
+	// Port assigned to ${PORT}, 0 when the model does not use it. With dynamicPorts
+	// it is the first port tried when the process starts.
+	Port int `yaml:"-"`
+
+	// DynamicPort is true when ${PORT} is substituted by the process when it starts
+	DynamicPort bool `yaml:"-"`
+
+	// values from secret macros, see Redact()
+	secrets []string
 }
 
 func (m *ModelConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -73,8 +150,112 @@ func (m *ModelConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return nil
 }
 
+const (
+	RestartPolicyNever     = "never"
+	RestartPolicyOnFailure = "on-failure"
+	RestartPolicyAlways    = "always"
+)
+
+const (
+	DrainPolicyQueue  = "queue"
+	DrainPolicyReject = "reject"
+)
+
+// RestartConfig limits automatic restarts. Zero values use the defaults.
+type RestartConfig struct {
+	// restarts allowed within Window before giving up, default 5
+	MaxRestarts int `yaml:"maxRestarts"`
+
+	// seconds, default 600
+	Window int `yaml:"window"`
+
+	// seconds to wait before a restart, doubled for every recent restart, default 1
+	Backoff int `yaml:"backoff"`
+
+	// seconds, the longest wait before a restart, default 60
+	MaxBackoff int `yaml:"maxBackoff"`
+}
+
+// LimitsConfig limits the resources of an upstream process so a runaway model can not
+// take down the host. Zero values are unlimited.
+type LimitsConfig struct {
+	// max open files, RLIMIT_NOFILE
+	OpenFiles int `yaml:"openFiles"`
+
+	// max MB of virtual memory, RLIMIT_AS. Not for GPU backends, CUDA and ROCm reserve
+	// more virtual memory than the host has.
+	Memory int `yaml:"memory"`
+
+	// a cgroup v2 for the process, created when CPUs or MemoryMax is set
+	Cgroup CgroupConfig `yaml:"cgroup"`
+}
+
+type CgroupConfig struct {
+	// directory the model's cgroup is created in, default /sys/fs/cgroup/llama-swap
+	Parent string `yaml:"parent"`
+
+	// CPUs the process can use, cpu.max
+	CPUs float64 `yaml:"cpus"`
+
+	// MB of memory the process can use, memory.max
+	MemoryMax int `yaml:"memoryMax"`
+}
+
+// ForReplica returns the configuration of a replica with ${REPLICA} substituted by its
+// number, starting from 0. Without dynamic ports ${PORT} is substituted by the model's
+// port plus the replica number.
+func (m ModelConfig) ForReplica(replica int) ModelConfig {
+	replace := func(s string) string {
+		s = strings.ReplaceAll(s, "${REPLICA}", strconv.Itoa(replica))
+		if m.Port > 0 && !m.DynamicPort {
+			s = strings.ReplaceAll(s, "${PORT}", strconv.Itoa(m.Port+replica))
+		}
+		return s
+	}
+
+	m.Cmd = replace(m.Cmd)
+	m.CmdStop = replace(m.CmdStop)
+	m.Proxy = replace(m.Proxy)
+	m.WorkingDir = replace(m.WorkingDir)
+	m.HealthCheck.Command = replace(m.HealthCheck.Command)
+	m.Hooks = m.Hooks.replace(replace)
+	m.Container = m.Container.replace(replace)
+	if len(m.Env) > 0 {
+		env := make([]string, len(m.Env))
+		for i, e := range m.Env {
+			env[i] = replace(e)
+		}
+		m.Env = env
+	}
+	if m.Port > 0 {
+		m.Port += replica
+	}
+	return m
+}
+
+// Equal is true when both configurations start the same model. The values of secret
+// macros are not compared, they are the same for every model and a model whose
+// settings use a changed secret differs anyway.
+func (m ModelConfig) Equal(other ModelConfig) bool {
+	m.secrets, other.secrets = nil, nil
+	return reflect.DeepEqual(m, other)
+}
+
 func (m *ModelConfig) SanitizedCommand() ([]string, error) {
-	return SanitizeCommand(m.Cmd)
+	return m.sanitizedCommand(m.Cmd)
+}
+
+// SanitizedCommandWithPort is SanitizedCommand with ${PORT} substituted
+func (m *ModelConfig) SanitizedCommandWithPort(port int) ([]string, error) {
+	return m.sanitizedCommand(strings.ReplaceAll(m.Cmd, "${PORT}", strconv.Itoa(port)))
+}
+
+func (m *ModelConfig) sanitizedCommand(cmd string) ([]string, error) {
+	// a container runs the command of its image without a cmd
+	if m.Container.Enabled() && strings.TrimSpace(StripComments(cmd)) == "" {
+		return nil, nil
+	}
+	return SanitizeCommand(cmd)
 }
 
 // ModelFilters embeds Filters and adds legacy support for strip_params field
@@ -104,3 +104,129 @@ models:
 	assert.Equal(t, 0.7, setParams["temperature"])
 	assert.Equal(t, 0.9, setParams["top_p"])
 }
+
+func TestConfig_ModelRestartPolicy(t *testing.T) {
+	content := `
+models:
+  model1:
+    cmd: path/to/cmd --port ${PORT}
+    restartPolicy: on-failure
+    restart:
+      maxRestarts: 3
+      window: 60
+`
+	config, err := LoadConfigFromReader(strings.NewReader(content))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, RestartPolicyOnFailure, config.Models["model1"].RestartPolicy)
+	assert.Equal(t, RestartConfig{MaxRestarts: 3, Window: 60}, config.Models["model1"].Restart)
+
+	tests := []struct {
+		name     string
+		model    string
+		expected string
+	}{
+		{"unknown policy", "restartPolicy: sometimes", "model model1: restartPolicy must be one of: never, on-failure, always"},
+		{"negative value", "restart: {backoff: -1}", "model model1: restart.backoff must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := `
+models:
+  model1:
+    cmd: path/to/cmd --port ${PORT}
+    ` + tt.model + "\n"
+			_, err := LoadConfigFromReader(strings.NewReader(content))
+			if assert.Error(t, err) {
+				assert.Equal(t, tt.expected, validationMessage(t, err))
+			}
+		})
+	}
+}
+
+func TestConfig_ModelRequestQueue(t *testing.T) {
+	content := `
+priorityClasses:
+  interactive:
+    priority: 10
+    apiKeys: ["sk-chat"]
+  batch:
+    priority: -5
+models:
+  model1:
+    cmd: path/to/cmd --port ${PORT}
+    concurrencyLimit: 2
+    maxQueueSize: 20
+    queueTimeout: 300
+`
+	config, err := LoadConfigFromReader(strings.NewReader(content))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 20, config.Models["model1"].MaxQueueSize)
+	assert.Equal(t, 300, config.Models["model1"].QueueTimeout)
+
+	assert.Equal(t, 10, config.RequestPriority("", "sk-chat"))
+	assert.Equal(t, -5, config.RequestPriority("batch", ""))
+	assert.Equal(t, 10, config.RequestPriority("batch", "sk-chat"), "the api key wins over the header")
+	assert.Equal(t, 0, config.RequestPriority("unknown", "sk-other"))
+
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{"negative queue size", "models: {model1: {cmd: 'cmd --port ${PORT}', maxQueueSize: -1}}", "model model1: maxQueueSize must not be negative"},
+		{"negative timeout", "models: {model1: {cmd: 'cmd --port ${PORT}', queueTimeout: -1}}", "model model1: queueTimeout must not be negative"},
+		{"empty api key", "priorityClasses: {batch: {apiKeys: ['']}}", "priority class batch: empty api key"},
+		{"api key in two classes", "priorityClasses: {a: {apiKeys: [k]}, b: {apiKeys: [k]}}", "priority class b: api key is already in priority class a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfigFromReader(strings.NewReader(tt.content))
+			if assert.Error(t, err) {
+				assert.Equal(t, tt.expected, validationMessage(t, err))
+			}
+		})
+	}
+}
+
+func TestConfig_MemoryBudget(t *testing.T) {
+	content := `
+memoryBudget:
+  gpu0: 24000
+  gpu1: 12000
+models:
+  model1:
+    cmd: path/to/cmd --port ${PORT}
+    memory:
+      gpu0: 8000
+      gpu1: 2000
+`
+	config, err := LoadConfigFromReader(strings.NewReader(content))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, map[string]int{"gpu0": 24000, "gpu1": 12000}, config.MemoryBudget)
+	assert.Equal(t, map[string]int{"gpu0": 8000, "gpu1": 2000}, config.Models["model1"].Memory)
+
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{"empty budget", "memoryBudget: {gpu0: 0}", "memoryBudget.gpu0 must be greater than 0"},
+		{"unknown device", "memoryBudget: {gpu0: 10}\nmodels: {model1: {cmd: 'cmd --port ${PORT}', memory: {gpu1: 5}}}", "model model1: memory.gpu1 is not a device in memoryBudget"},
+		{"negative memory", "memoryBudget: {gpu0: 10}\nmodels: {model1: {cmd: 'cmd --port ${PORT}', memory: {gpu0: -5}}}", "model model1: memory.gpu0 must not be negative"},
+		{"more than the budget", "memoryBudget: {gpu0: 10}\nmodels: {model1: {cmd: 'cmd --port ${PORT}', memory: {gpu0: 11}}}", "model model1: memory.gpu0 is more than the memoryBudget of 10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfigFromReader(strings.NewReader(tt.content))
+			if assert.Error(t, err) {
+				assert.Equal(t, tt.expected, validationMessage(t, err))
+			}
+		})
+	}
+}
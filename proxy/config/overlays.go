@@ -0,0 +1,158 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// used for testing to override the machine's hostname
+var hostname = os.Hostname
+
+// Overlays returns the names of the overlays applied to the configuration
+func (c *Config) Overlays() []string {
+	return c.overlays
+}
+
+// applyOverlays merges the selected overlays from the top level `overlays` key onto
+// the configuration before it is decoded. names is a comma separated list of overlays
+// to apply in order. When it is empty the overlay named after the machine's hostname
+// is applied if there is one. The names of the applied overlays are returned.
+//
+// Overlays are merged like model templates: mappings are merged key by key and
+// everything else, including lists, is replaced. A model is changed in the file that
+// defines it so models from included files can be overlaid too.
+func applyOverlays(mainName string, doc *yaml.Node, includes []includeDocument, names string) ([]string, error) {
+	root := documentRoot(doc)
+	overlaysKey := mappingKey(root, "overlays")
+	overlaysNode := resolveAlias(mappingValue(root, "overlays"))
+
+	var selected []string
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			selected = append(selected, name)
+		}
+	}
+
+	if overlaysNode == nil {
+		if len(selected) > 0 {
+			return nil, fmt.Errorf("overlay %s not found, the config has no overlays", selected[0])
+		}
+		return nil, nil
+	}
+	removeMappingKey(root, "overlays")
+
+	if overlaysNode.Kind == yaml.ScalarNode && overlaysNode.Tag == "!!null" {
+		overlaysNode = &yaml.Node{Kind: yaml.MappingNode}
+	}
+	if overlaysNode.Kind != yaml.MappingNode {
+		return nil, nodeError(mainName, overlaysKey, fmt.Errorf("overlays must be a mapping"))
+	}
+
+	if len(selected) == 0 {
+		if name := hostOverlay(overlaysNode); name != "" {
+			selected = append(selected, name)
+		}
+	}
+
+	for _, name := range selected {
+		overlayKey := mappingKey(overlaysNode, name)
+		if overlayKey == nil {
+			return nil, nodeError(mainName, overlaysKey, fmt.Errorf("overlay %s not found", name))
+		}
+		overlay := resolveAlias(mappingValue(overlaysNode, name))
+		if overlay.Kind == yaml.ScalarNode && overlay.Tag == "!!null" {
+			continue
+		}
+		if overlay.Kind != yaml.MappingNode {
+			return nil, nodeError(mainName, overlayKey, fmt.Errorf("overlay %s must be a mapping", name))
+		}
+
+		for i := 0; i+1 < len(overlay.Content); i += 2 {
+			key := overlay.Content[i]
+			value := resolveAlias(overlay.Content[i+1])
+
+			switch key.Value {
+			case "overlays", "include":
+				return nil, nodeError(mainName, key, fmt.Errorf("overlay %s can not set %s", name, key.Value))
+			case "models":
+				if value.Kind != yaml.MappingNode {
+					return nil, nodeError(mainName, key, fmt.Errorf("overlay %s: models must be a mapping", name))
+				}
+				overlayModels(doc, includes, value)
+			default:
+				overlayValue(root, key, value)
+			}
+		}
+	}
+
+	return selected, nil
+}
+
+// hostOverlay returns the overlay named after the machine's hostname, with or
+// without its domain
+func hostOverlay(overlays *yaml.Node) string {
+	host, err := hostname()
+	if err != nil || host == "" {
+		return ""
+	}
+	shortHost, _, _ := strings.Cut(host, ".")
+
+	for i := 0; i+1 < len(overlays.Content); i += 2 {
+		name := overlays.Content[i].Value
+		if strings.EqualFold(name, host) || strings.EqualFold(name, shortHost) {
+			return name
+		}
+	}
+	return ""
+}
+
+// overlayModels merges each model onto the document that defines it. New models are
+// added to the main document.
+func overlayModels(doc *yaml.Node, includes []includeDocument, models *yaml.Node) {
+	docs := []*yaml.Node{doc}
+	for _, include := range includes {
+		docs = append(docs, include.doc)
+	}
+
+	for i := 0; i+1 < len(models.Content); i += 2 {
+		key := models.Content[i]
+		value := resolveAlias(models.Content[i+1])
+
+		target := documentRoot(doc)
+		for _, d := range docs {
+			if mappingKey(mappingValue(documentRoot(d), "models"), key.Value) != nil {
+				target = documentRoot(d)
+				break
+			}
+		}
+
+		targetModels := mappingValue(target, "models")
+		if targetModels == nil || targetModels.Kind != yaml.MappingNode {
+			targetModels = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			overlayValue(target, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "models"}, targetModels)
+			targetModels = mappingValue(target, "models")
+		}
+		overlayValue(targetModels, key, value)
+	}
+}
+
+// overlayValue sets key in mapping to value, merging it with the existing value
+// when both are mappings
+func overlayValue(mapping, key, value *yaml.Node) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value != key.Value {
+			continue
+		}
+		existing := resolveAlias(mapping.Content[i+1])
+		if existing.Kind == yaml.MappingNode && value.Kind == yaml.MappingNode {
+			mapping.Content[i+1] = mergeMappingNodes(existing, value, nil)
+		} else {
+			mapping.Content[i+1] = copyNode(value)
+		}
+		return
+	}
+	mapping.Content = append(mapping.Content, copyNode(key), copyNode(value))
+}
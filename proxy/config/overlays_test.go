@@ -0,0 +1,141 @@
+package config
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const overlayTestConfig = `
+macros:
+  ngl: 99
+models:
+  model1:
+    cmd: svr --port ${PORT} -ngl ${ngl} --ctx-size ${ctx}
+    macros:
+      ctx: 32768
+  model2:
+    cmd: svr --port ${PORT}
+groups:
+  big:
+    members: [model1, model2]
+overlays:
+  box-3090:
+    macros:
+      ngl: 40
+    models:
+      model1:
+        macros:
+          ctx: 8192
+    groups:
+      big:
+        members: [model1]
+  box-4090:
+    healthCheckTimeout: 300
+`
+
+func setTestHostname(t *testing.T, name string) {
+	t.Helper()
+	original := hostname
+	hostname = func() (string, error) { return name, nil }
+	t.Cleanup(func() { hostname = original })
+}
+
+func TestConfig_OverlaySelectedByName(t *testing.T) {
+	setTestHostname(t, "box-4090")
+
+	config, err := (&Source{Data: []byte(overlayTestConfig), Overlay: "box-3090"}).Load()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, []string{"box-3090"}, config.Overlays())
+	assert.Equal(t, "svr --port 5800 -ngl 40 --ctx-size 8192", config.Models["model1"].Cmd)
+	assert.Equal(t, []string{"model1"}, config.Groups["big"].Members)
+
+	// model2 is no longer in a group so it is added to the default group
+	group, _ := config.ModelGroup("model2")
+	assert.Equal(t, DEFAULT_GROUP_ID, group)
+	assert.Equal(t, 120, config.HealthCheckTimeout)
+}
+
+func TestConfig_OverlaySelectedByHostname(t *testing.T) {
+	setTestHostname(t, "BOX-3090.lan")
+
+	config, err := LoadConfigFromReader(strings.NewReader(overlayTestConfig))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"box-3090"}, config.Overlays())
+	assert.Equal(t, "svr --port 5800 -ngl 40 --ctx-size 8192", config.Models["model1"].Cmd)
+
+	// no overlay for this host, the base config is used
+	setTestHostname(t, "laptop")
+	config, err = LoadConfigFromReader(strings.NewReader(overlayTestConfig))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Empty(t, config.Overlays())
+	assert.Equal(t, "svr --port 5800 -ngl 99 --ctx-size 32768", config.Models["model1"].Cmd)
+	assert.Equal(t, []string{"model1", "model2"}, config.Groups["big"].Members)
+}
+
+func TestConfig_OverlaysAppliedInOrder(t *testing.T) {
+	setTestHostname(t, "laptop")
+
+	config, err := (&Source{Data: []byte(overlayTestConfig), Overlay: "box-4090, box-3090"}).Load()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"box-4090", "box-3090"}, config.Overlays())
+	assert.Equal(t, 300, config.HealthCheckTimeout)
+	assert.Equal(t, "svr --port 5800 -ngl 40 --ctx-size 8192", config.Models["model1"].Cmd)
+}
+
+func TestConfig_OverlayNotFound(t *testing.T) {
+	_, err := (&Source{Data: []byte(overlayTestConfig), Overlay: "nope"}).Load()
+	assert.Equal(t, "overlay nope not found", validationMessage(t, err))
+
+	_, err = (&Source{Data: []byte("models: {}\n"), Overlay: "nope"}).Load()
+	assert.Equal(t, "overlay nope not found, the config has no overlays", validationMessage(t, err))
+
+	_, err = (&Source{Data: []byte("overlays:\n  a:\n    include: [more.yaml]\n"), Overlay: "a"}).Load()
+	assert.Equal(t, "overlay a can not set include", validationMessage(t, err))
+}
+
+func TestConfig_OverlayModelsInIncludes(t *testing.T) {
+	setTestHostname(t, "laptop")
+
+	tempDir := t.TempDir()
+	configFile := filepath.Join(tempDir, "config.yaml")
+	writeTestFile(t, configFile, `
+include: [models.yaml]
+overlays:
+  small:
+    models:
+      model1:
+        cmd: svr --port ${PORT} --small
+`)
+	writeTestFile(t, filepath.Join(tempDir, "models.yaml"), `
+models:
+  model1:
+    cmd: svr --port ${PORT}
+    ttl: 60
+`)
+
+	source, err := ReadSource(configFile)
+	if !assert.NoError(t, err) {
+		return
+	}
+	source.Overlay = "small"
+	config, err := source.Load()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// merged where the model is defined, not added as a duplicate
+	assert.Equal(t, "svr --port 5800 --small", config.Models["model1"].Cmd)
+	assert.Equal(t, 60, config.Models["model1"].UnloadAfter)
+}
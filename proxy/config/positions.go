@@ -0,0 +1,156 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type position struct {
+	file   string
+	line   int
+	column int
+}
+
+// positionIndex maps config keys to where they are defined in the YAML files
+type positionIndex map[string]position
+
+func positionKey(path []string) string {
+	return strings.Join(path, "\x00")
+}
+
+// add records the position of every key and list item in doc. Keys that are
+// already in the index are kept so the main config file takes precedence.
+func (idx positionIndex) add(file string, doc *yaml.Node) {
+	idx.addNode(file, documentRoot(doc), nil, 0)
+}
+
+func (idx positionIndex) addNode(file string, node *yaml.Node, path []string, depth int) {
+	// anchors can make the tree very deep, model fields are never that far down
+	if node == nil || depth > 32 {
+		return
+	}
+
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			childPath := append(path[:len(path):len(path)], key.Value)
+			idx.set(childPath, position{file, key.Line, key.Column})
+			idx.addNode(file, resolveAlias(node.Content[i+1]), childPath, depth+1)
+		}
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			childPath := append(path[:len(path):len(path)], strconv.Itoa(i))
+			idx.set(childPath, position{file, item.Line, item.Column})
+			idx.addNode(file, resolveAlias(item), childPath, depth+1)
+		}
+	}
+}
+
+func (idx positionIndex) set(path []string, pos position) {
+	key := positionKey(path)
+	if _, found := idx[key]; !found {
+		idx[key] = pos
+	}
+}
+
+// locate fills in the position of errors created with atPath. When a key does not
+// exist, ie: a model field that came from a template, the closest parent is used.
+func (idx positionIndex) locate(errs ValidationErrors) {
+	for _, e := range errs {
+		if e.File != "" || len(e.path) == 0 {
+			continue
+		}
+		for i := len(e.path); i > 0; i-- {
+			if pos, found := idx[positionKey(e.path[:i])]; found {
+				e.File, e.Line, e.Column = pos.file, pos.line, pos.column
+				break
+			}
+		}
+	}
+}
+
+// removeInvalidEntries decodes each model, group and peer on its own so a bad
+// entry does not hide problems in the others. Entries that fail to decode are
+// removed from the document and reported with their position.
+func removeInvalidEntries(file string, doc *yaml.Node) ValidationErrors {
+	sections := []struct {
+		name   string
+		decode func(*yaml.Node) error
+	}{
+		{"models", func(n *yaml.Node) error { var v ModelConfig; return n.Decode(&v) }},
+		{"groups", func(n *yaml.Node) error { var v GroupConfig; return n.Decode(&v) }},
+		{"peers", func(n *yaml.Node) error { var v PeerConfig; return n.Decode(&v) }},
+	}
+
+	var errs ValidationErrors
+	root := documentRoot(doc)
+	for _, section := range sections {
+		node := mappingValue(root, section.name)
+		if node == nil || node.Kind != yaml.MappingNode {
+			continue
+		}
+
+		kept := make([]*yaml.Node, 0, len(node.Content))
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if err := section.decode(value); err != nil {
+				errs = append(errs, &ValidationError{
+					File:   file,
+					Line:   key.Line,
+					Column: key.Column,
+					Err:    fmt.Errorf("%s.%s: %w", section.name, key.Value, err),
+				})
+				continue
+			}
+			kept = append(kept, key, value)
+		}
+		node.Content = kept
+	}
+	return errs
+}
+
+// decodeErrors splits a yaml.TypeError into one ValidationError per line
+func decodeErrors(file string, err error) ValidationErrors {
+	typeErr, ok := err.(*yaml.TypeError)
+	if !ok {
+		return inFile(err, file)
+	}
+
+	errs := make(ValidationErrors, 0, len(typeErr.Errors))
+	for _, msg := range typeErr.Errors {
+		e := &ValidationError{File: file, Err: fmt.Errorf("%s", msg)}
+		var line int
+		if _, scanErr := fmt.Sscanf(msg, "line %d:", &line); scanErr == nil {
+			e.Line = line
+			e.Err = fmt.Errorf("%s", strings.TrimSpace(strings.TrimPrefix(msg, fmt.Sprintf("line %d:", line))))
+		}
+		errs = append(errs, e)
+	}
+	return errs
+}
+
+// nodeError creates a ValidationError at the position of node
+func nodeError(file string, node *yaml.Node, err error) *ValidationError {
+	e := &ValidationError{File: file, Err: err}
+	if node != nil {
+		e.Line, e.Column = node.Line, node.Column
+	}
+	return e
+}
+
+// mappingKey returns the key node for key in a mapping node or nil if it does not exist
+func mappingKey(mapping *yaml.Node, key string) *yaml.Node {
+	if mapping == nil || mapping.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package config
+
+import "sort"
+
+// Resolved is the final configuration llama-swap uses for each model and peer
+// with secrets redacted. It is printed by `llama-swap config check` and returned
+// by GET /api/config.
+type Resolved struct {
+	Overlays []string                 `json:"overlays,omitempty" yaml:"overlays,omitempty"`
+	Models   map[string]ResolvedModel `json:"models" yaml:"models"`
+	Peers    map[string]ResolvedPeer  `json:"peers,omitempty" yaml:"peers,omitempty"`
+}
+
+type ResolvedModel struct {
+	Cmd           string       `json:"cmd" yaml:"cmd"`
+	CmdStop       string       `json:"cmdStop,omitempty" yaml:"cmdStop,omitempty"`
+	Proxy         string       `json:"proxy" yaml:"proxy"`
+	CheckEndpoint string       `json:"checkEndpoint" yaml:"checkEndpoint"`
+	HealthCheck   *HealthCheck `json:"healthCheck,omitempty" yaml:"healthCheck,omitempty"`
+	Port          int          `json:"port,omitempty" yaml:"port,omitempty"`
+	Group         string       `json:"group" yaml:"group"`
+	Aliases       []string     `json:"aliases,omitempty" yaml:"aliases,omitempty"`
+
+	Container *ContainerConfig `json:"container,omitempty" yaml:"container,omitempty"`
+}
+
+type ResolvedPeer struct {
+	Proxy  string   `json:"proxy" yaml:"proxy"`
+	ApiKey string   `json:"apiKey,omitempty" yaml:"apiKey,omitempty"`
+	Models []string `json:"models" yaml:"models"`
+}
+
+// Resolve builds the final values llama-swap will use for each model and peer
+func (c *Config) Resolve() Resolved {
+	resolved := Resolved{
+		Overlays: c.overlays,
+		Models:   make(map[string]ResolvedModel, len(c.Models)),
+	}
+
+	for modelID, modelConfig := range c.Models {
+		group, _ := c.ModelGroup(modelID)
+		var healthCheck *HealthCheck
+		if modelConfig.HealthCheck != (HealthCheck{}) {
+			settings := modelConfig.HealthCheckSettings()
+			settings.Command = c.Redact(settings.Command)
+			healthCheck = &settings
+		}
+		var container *ContainerConfig
+		if modelConfig.Container.Enabled() {
+			redacted := modelConfig.Container.replace(c.Redact)
+			container = &redacted
+		}
+		resolved.Models[modelID] = ResolvedModel{
+			Cmd:           c.Redact(modelConfig.Cmd),
+			CmdStop:       c.Redact(modelConfig.CmdStop),
+			Proxy:         c.Redact(modelConfig.Proxy),
+			CheckEndpoint: c.Redact(modelConfig.CheckEndpoint),
+			HealthCheck:   healthCheck,
+			Port:          modelConfig.Port,
+			Group:         group,
+			Aliases:       modelConfig.Aliases,
+			Container:     container,
+		}
+	}
+
+	if len(c.Peers) > 0 {
+		resolved.Peers = make(map[string]ResolvedPeer, len(c.Peers))
+		for peerID, peerConfig := range c.Peers {
+			peer := ResolvedPeer{
+				Proxy:  c.Redact(peerConfig.Proxy),
+				Models: append([]string(nil), peerConfig.Models...),
+			}
+			sort.Strings(peer.Models)
+			// never print secrets
+			if peerConfig.ApiKey != "" {
+				peer.ApiKey = redactedValue
+			}
+			resolved.Peers[peerID] = peer
+		}
+	}
+
+	return resolved
+}
@@ -0,0 +1,163 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// secretCommandTimeout is how long a ${cmd:...} macro can run for
+	secretCommandTimeout = 10 * time.Second
+
+	// redactedValue replaces secret values in logs and config dumps
+	redactedValue = "********"
+)
+
+var (
+	fileMacroRegex = regexp.MustCompile(`\$\{file:([^}]+)\}`)
+	cmdMacroRegex  = regexp.MustCompile(`\$\{cmd:([^}]+)\}`)
+)
+
+// secretSources substitutes ${file:...} and ${cmd:...} macros. They are substituted
+// at string level right after env macros and every value is remembered so it can be
+// redacted later.
+type secretSources struct {
+	// relative file paths are resolved from here
+	baseDir string
+
+	// ${cmd:...} runs arbitrary commands so it must be enabled with allowCommandMacros
+	allowCommands bool
+
+	values []string
+}
+
+// substitute replaces the secret macros in s. Macros inside YAML comments are ignored.
+func (src *secretSources) substitute(s string) (string, error) {
+	scanStr := commentFreeYAML(s)
+	result := s
+	var errs ValidationErrors
+
+	seen := make(map[string]bool)
+	replace := func(fullMatch, value, source string) {
+		if value == "" {
+			result = strings.ReplaceAll(result, fullMatch, value)
+			return
+		}
+		sanitized, err := sanitizeValueForYAML(value, source)
+		if err != nil {
+			errs = append(errs, stringError(s, fullMatch, err))
+			return
+		}
+		src.remember(value)
+		src.remember(sanitized)
+		result = strings.ReplaceAll(result, fullMatch, sanitized)
+	}
+
+	for _, match := range fileMacroRegex.FindAllStringSubmatch(scanStr, -1) {
+		fullMatch, path := match[0], strings.TrimSpace(match[1])
+		if seen[fullMatch] {
+			continue
+		}
+		seen[fullMatch] = true
+
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(src.baseDir, path)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			errs = append(errs, stringError(s, fullMatch, fmt.Errorf("file macro: %w", err)))
+			continue
+		}
+		replace(fullMatch, strings.TrimSpace(string(data)), fmt.Sprintf("file '%s'", path))
+	}
+
+	for _, match := range cmdMacroRegex.FindAllStringSubmatch(scanStr, -1) {
+		fullMatch, command := match[0], match[1]
+		if seen[fullMatch] {
+			continue
+		}
+		seen[fullMatch] = true
+
+		if !src.allowCommands {
+			errs = append(errs, stringError(s, fullMatch, fmt.Errorf("cmd macros are disabled, set allowCommandMacros: true to use them")))
+			continue
+		}
+		value, err := runSecretCommand(command)
+		if err != nil {
+			errs = append(errs, stringError(s, fullMatch, err))
+			continue
+		}
+		replace(fullMatch, value, fmt.Sprintf("output of command '%s'", command))
+	}
+
+	if len(errs) > 0 {
+		return "", errs
+	}
+	return result, nil
+}
+
+func (src *secretSources) remember(value string) {
+	if value == "" || slices.Contains(src.values, value) {
+		return
+	}
+	src.values = append(src.values, value)
+
+	// longest first so a secret that contains another is redacted whole
+	slices.SortStableFunc(src.values, func(a, b string) int {
+		return len(b) - len(a)
+	})
+}
+
+// runSecretCommand runs command and returns its trimmed stdout
+func runSecretCommand(command string) (string, error) {
+	args, err := SanitizeCommand(command)
+	if err != nil {
+		return "", fmt.Errorf("cmd macro: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), secretCommandTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("cmd macro '%s' timed out after %s", command, secretCommandTimeout)
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("cmd macro '%s' failed: %w: %s", command, err, msg)
+		}
+		return "", fmt.Errorf("cmd macro '%s' failed: %w", command, err)
+	}
+
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// redact replaces every value in secrets found in s
+func redact(s string, secrets []string) string {
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, redactedValue)
+	}
+	return s
+}
+
+// Redact replaces values that came from ${file:...} and ${cmd:...} macros in s.
+// Use it before logging or showing configuration values.
+func (c *Config) Redact(s string) string {
+	return redact(s, c.secrets)
+}
+
+// Redact replaces values that came from ${file:...} and ${cmd:...} macros in s.
+func (m *ModelConfig) Redact(s string) string {
+	return redact(s, m.secrets)
+}
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig_FileMacros(t *testing.T) {
+	tempDir := t.TempDir()
+	writeTestFile(t, filepath.Join(tempDir, "secrets", "api_key"), "sk-from-file\n")
+	writeTestFile(t, filepath.Join(tempDir, "secrets", "peer_key"), "  peer-secret  \n")
+	writeTestFile(t, filepath.Join(tempDir, "secrets", "hf_token"), "hf_abc123")
+
+	configFile := filepath.Join(tempDir, "config.yaml")
+	writeTestFile(t, configFile, `
+apiKeys:
+  - ${file:secrets/api_key}
+  # - ${file:secrets/does-not-exist}
+models:
+  model1:
+    cmd: server --port ${PORT} --hf-token ${file:`+filepath.Join(tempDir, "secrets", "hf_token")+`}
+peers:
+  peer1:
+    proxy: http://192.168.1.23
+    apiKey: "${file:secrets/peer_key}"
+    models: [model-a]
+`)
+
+	config, err := LoadConfig(configFile)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, []string{"sk-from-file"}, config.RequiredAPIKeys)
+	assert.Equal(t, "peer-secret", config.Peers["peer1"].ApiKey)
+
+	model := config.Models["model1"]
+	assert.Equal(t, "server --port 5800 --hf-token hf_abc123", model.Cmd)
+	assert.Equal(t, "server --port 5800 --hf-token ********", model.Redact(model.Cmd))
+	assert.Equal(t, "key: ********, peer: ********", config.Redact("key: sk-from-file, peer: peer-secret"))
+}
+
+func TestConfig_FileMacroErrors(t *testing.T) {
+	content := `models:
+  model1:
+    cmd: server --port ${PORT} --key ${file:/does/not/exist}
+    env:
+      - TOKEN=${cmd:cat /etc/hostname}
+`
+	_, err := LoadConfigFromReader(strings.NewReader(content))
+
+	var errs ValidationErrors
+	if !assert.ErrorAs(t, err, &errs) || !assert.Len(t, errs, 2) {
+		return
+	}
+
+	assert.Equal(t, 3, errs[0].Line)
+	assert.Equal(t, 38, errs[0].Column)
+	assert.Contains(t, errs[0].Error(), "file macro: open /does/not/exist")
+
+	assert.Equal(t, 5, errs[1].Line)
+	assert.Contains(t, errs[1].Error(), "cmd macros are disabled, set allowCommandMacros: true to use them")
+}
+
+func TestConfig_FileMacroInInclude(t *testing.T) {
+	tempDir := t.TempDir()
+	writeTestFile(t, filepath.Join(tempDir, "token"), "multi\nline\n")
+
+	configFile := filepath.Join(tempDir, "config.yaml")
+	writeTestFile(t, configFile, `include: [models.yaml]`)
+	writeTestFile(t, filepath.Join(tempDir, "models.yaml"), `models:
+  model1:
+    cmd: server --port ${PORT} --token ${file:token}
+`)
+
+	_, err := LoadConfig(configFile)
+	var errs ValidationErrors
+	if !assert.ErrorAs(t, err, &errs) || !assert.Len(t, errs, 1) {
+		return
+	}
+	assert.Equal(t, filepath.Join(tempDir, "models.yaml"), errs[0].File)
+	assert.Equal(t, 3, errs[0].Line)
+	assert.Contains(t, errs[0].Error(), "contains newlines or null bytes")
+}
@@ -0,0 +1,399 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ErrModelNotInSource is returned when a model is not in the main config file,
+// it may come from an included file
+var ErrModelNotInSource = errors.New("model is not defined in the main config file")
+
+// Source is the YAML text of the main configuration file. Models can be added,
+// replaced and removed without changing the rest of the text so formatting and
+// comments are kept when it is written back.
+type Source struct {
+	// Path is the file the source was read from. It is empty when the
+	// source only exists in memory.
+	Path string
+	Data []byte
+
+	// Overlay selects the overlays to apply when loading, see applyOverlays()
+	Overlay string
+}
+
+// ReadSource reads the configuration file at path
+func ReadSource(path string) (*Source, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Source{Path: path, Data: data}, nil
+}
+
+// Load parses and validates the source the same way as LoadConfig
+func (s *Source) Load() (Config, error) {
+	if s.Path == "" {
+		return loadConfigFromReader(bytes.NewReader(s.Data), "main config", ".", s.Overlay)
+	}
+	return loadConfigFromReader(bytes.NewReader(s.Data), s.Path, filepath.Dir(s.Path), s.Overlay)
+}
+
+// Save writes the source back to Path. The file is replaced atomically so a
+// config watcher never sees it half written.
+func (s *Source) Save() error {
+	if s.Path == "" {
+		return fmt.Errorf("configuration was not loaded from a file")
+	}
+
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(s.Path); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), "."+filepath.Base(s.Path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(s.Data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.Path)
+}
+
+// HasModel reports if modelID is defined in the models section of the source.
+// Models from included files are not part of the source.
+func (s *Source) HasModel(modelID string) (bool, error) {
+	doc, err := s.parse()
+	if err != nil {
+		return false, err
+	}
+	return mappingKey(mappingValue(documentRoot(doc), "models"), modelID) != nil, nil
+}
+
+// SetModel returns a copy of the source with modelID added or replaced. model is
+// the model's configuration as a YAML or JSON object.
+func (s *Source) SetModel(modelID string, model []byte) (*Source, error) {
+	var body yaml.Node
+	if err := yaml.Unmarshal(model, &body); err != nil {
+		return nil, fmt.Errorf("invalid model configuration: %w", err)
+	}
+	modelNode := documentRoot(&body)
+	if modelNode == nil || modelNode.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("invalid model configuration: must be an object")
+	}
+	blockStyle(modelNode)
+
+	doc, err := s.parse()
+	if err != nil {
+		return nil, err
+	}
+	lines := sourceLines(s.Data)
+	root := documentRoot(doc)
+
+	modelsKey := mappingKey(root, "models")
+	if modelsKey == nil {
+		// no models section yet, add one at the end
+		entry, err := renderEntry(modelID, modelNode, 2, 2)
+		if err != nil {
+			return nil, err
+		}
+		if root != nil && root.Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("config must be a mapping")
+		}
+		return s.withLines(append(trimTrailingBlank(lines), append([]string{"models:"}, entry...)...)), nil
+	}
+
+	models := mappingValue(root, "models")
+	if models.Kind == yaml.ScalarNode && models.Tag == "!!null" {
+		entry, err := renderEntry(modelID, modelNode, modelsKey.Column+1, 2)
+		if err != nil {
+			return nil, err
+		}
+		return s.withLines(spliceLines(lines, modelsKey.Line+1, modelsKey.Line+1, entry)), nil
+	}
+	if models.Kind != yaml.MappingNode || models.Style&yaml.FlowStyle != 0 {
+		return nil, fmt.Errorf("models must be a block mapping to be edited")
+	}
+
+	indent := models.Content[0].Column - 1
+	entry, err := renderEntry(modelID, modelNode, indent, childIndent(models))
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i+1 < len(models.Content); i += 2 {
+		if models.Content[i].Value == modelID {
+			// comments above the model are kept
+			_, end := entrySpan(lines, models, i)
+			return s.withLines(spliceLines(lines, models.Content[i].Line, end, entry)), nil
+		}
+	}
+
+	// add after the last model, separated by a blank line when the others are
+	last := len(models.Content) - 2
+	start, end := entrySpan(lines, models, last)
+	if start > 1 && strings.TrimSpace(lines[start-2]) == "" {
+		entry = append([]string{""}, entry...)
+	}
+	return s.withLines(spliceLines(lines, end, end, entry)), nil
+}
+
+// DeleteModel returns a copy of the source with modelID removed from the models
+// section and from the members of any group.
+func (s *Source) DeleteModel(modelID string) (*Source, error) {
+	doc, err := s.parse()
+	if err != nil {
+		return nil, err
+	}
+	lines := sourceLines(s.Data)
+	root := documentRoot(doc)
+
+	models := mappingValue(root, "models")
+	index := -1
+	if models != nil && models.Kind == yaml.MappingNode && models.Style&yaml.FlowStyle == 0 {
+		for i := 0; i+1 < len(models.Content); i += 2 {
+			if models.Content[i].Value == modelID {
+				index = i
+			}
+		}
+	}
+	if index < 0 {
+		return nil, ErrModelNotInSource
+	}
+
+	// edits are done bottom up so earlier line numbers stay valid
+	type edit struct {
+		start, end int
+		lines      []string
+	}
+	var edits []edit
+
+	start, end := entrySpan(lines, models, index)
+	// drop the blank line after the model when it would be doubled or end up first
+	if end <= len(lines) && strings.TrimSpace(lines[end-1]) == "" {
+		if start == 1 || strings.TrimSpace(lines[start-2]) == "" || lineIndent(lines[start-2]) < models.Content[index].Column-1 {
+			end++
+		}
+	}
+	edits = append(edits, edit{start, end, nil})
+
+	groups := mappingValue(root, "groups")
+	if groups != nil && groups.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(groups.Content); i += 2 {
+			members := mappingValue(groups.Content[i+1], "members")
+			if members == nil || members.Kind != yaml.SequenceNode {
+				continue
+			}
+			for _, member := range members.Content {
+				if member.Value != modelID {
+					continue
+				}
+				if members.Style&yaml.FlowStyle != 0 {
+					line, err := removeFlowItem(lines[member.Line-1], members, modelID)
+					if err != nil {
+						return nil, fmt.Errorf("unable to remove %s from group %s: %w", modelID, groups.Content[i].Value, err)
+					}
+					edits = append(edits, edit{member.Line, member.Line + 1, []string{line}})
+				} else {
+					edits = append(edits, edit{member.Line, member.Line + 1, nil})
+				}
+			}
+		}
+	}
+
+	sort.Slice(edits, func(i, j int) bool {
+		return edits[i].start > edits[j].start
+	})
+	for _, e := range edits {
+		lines = spliceLines(lines, e.start, e.end, e.lines)
+	}
+	return s.withLines(lines), nil
+}
+
+func (s *Source) parse() (*yaml.Node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(s.Data, &doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+func (s *Source) withLines(lines []string) *Source {
+	data := strings.Join(lines, "\n")
+	if !strings.HasSuffix(data, "\n") {
+		data += "\n"
+	}
+	return &Source{Path: s.Path, Data: []byte(data), Overlay: s.Overlay}
+}
+
+// sourceLines splits data into lines, line N of the YAML is at index N-1
+func sourceLines(data []byte) []string {
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// spliceLines replaces lines [start, end), 1 based, with replacement
+func spliceLines(lines []string, start, end int, replacement []string) []string {
+	result := make([]string, 0, len(lines)+len(replacement))
+	result = append(result, lines[:start-1]...)
+	result = append(result, replacement...)
+	if end-1 < len(lines) {
+		result = append(result, lines[end-1:]...)
+	}
+	return result
+}
+
+func trimTrailingBlank(lines []string) []string {
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+func lineIndent(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " \t"))
+}
+
+func isBlankOrComment(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	return trimmed == "" || strings.HasPrefix(trimmed, "#")
+}
+
+// entrySpan returns the lines [start, end), 1 based, of the mapping entry with
+// its key at index i. Comments right above the key, at the same indentation,
+// belong to the entry. Trailing blank lines do not.
+func entrySpan(lines []string, mapping *yaml.Node, i int) (int, int) {
+	key := mapping.Content[i]
+	indent := key.Column - 1
+
+	start := key.Line
+	for start > 1 {
+		prev := lines[start-2]
+		if !strings.HasPrefix(strings.TrimSpace(prev), "#") || lineIndent(prev) != indent {
+			break
+		}
+		start--
+	}
+
+	end := key.Line + 1
+	for end <= len(lines) {
+		line := lines[end-1]
+		if strings.TrimSpace(line) != "" && lineIndent(line) <= indent {
+			break
+		}
+		end++
+	}
+
+	// give trailing blank lines and the next entry's comments back
+	for end-1 > key.Line {
+		line := lines[end-2]
+		if strings.TrimSpace(line) != "" && !(isBlankOrComment(line) && lineIndent(line) == indent) {
+			break
+		}
+		end--
+	}
+
+	return start, end
+}
+
+// childIndent finds how far the fields of a model are indented from its ID
+func childIndent(models *yaml.Node) int {
+	for i := 0; i+1 < len(models.Content); i += 2 {
+		value := models.Content[i+1]
+		if value.Kind == yaml.MappingNode && value.Style&yaml.FlowStyle == 0 && len(value.Content) > 0 {
+			if indent := value.Content[0].Column - models.Content[i].Column; indent >= 2 {
+				return indent
+			}
+		}
+	}
+	return 2
+}
+
+// renderEntry formats `modelID: model` as lines indented by indent spaces
+func renderEntry(modelID string, model *yaml.Node, indent, childIndent int) ([]string, error) {
+	entry := &yaml.Node{
+		Kind: yaml.MappingNode,
+		Content: []*yaml.Node{
+			{Kind: yaml.ScalarNode, Tag: "!!str", Value: modelID},
+			model,
+		},
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(childIndent)
+	if err := encoder.Encode(entry); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+
+	lines := sourceLines(buf.Bytes())
+	prefix := strings.Repeat(" ", indent)
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = prefix + line
+		}
+	}
+	return lines, nil
+}
+
+// blockStyle clears the styles from a parsed JSON object so it is written as
+// regular block YAML. Strings keep their quotes only where YAML needs them.
+func blockStyle(node *yaml.Node) {
+	switch node.Kind {
+	case yaml.MappingNode, yaml.SequenceNode:
+		node.Style = 0
+	case yaml.ScalarNode:
+		if node.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle) != 0 {
+			node.Style = 0
+		}
+	}
+	for _, child := range node.Content {
+		blockStyle(child)
+	}
+}
+
+// removeFlowItem removes item from a flow sequence, like `members: [a, b]`, that
+// is on a single line
+func removeFlowItem(line string, sequence *yaml.Node, item string) (string, error) {
+	open := sequence.Column - 1
+	if open >= len(line) || line[open] != '[' {
+		return "", fmt.Errorf("unsupported sequence format")
+	}
+	closing := strings.Index(line[open:], "]")
+	if closing < 0 {
+		return "", fmt.Errorf("sequence spans multiple lines")
+	}
+	closing += open
+
+	remaining := &yaml.Node{Kind: yaml.SequenceNode, Style: yaml.FlowStyle}
+	for _, member := range sequence.Content {
+		if member.Value != item {
+			remaining.Content = append(remaining.Content, member)
+		}
+	}
+	out, err := yaml.Marshal(remaining)
+	if err != nil {
+		return "", err
+	}
+	return line[:open] + strings.TrimSpace(string(out)) + line[closing+1:], nil
+}
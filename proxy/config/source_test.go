@@ -0,0 +1,197 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testSource = `# llama-swap config
+logLevel: info
+
+models:
+  # the first model
+  model1:
+    cmd: svr --port ${PORT}   # keep this comment
+
+  model2:
+      cmd: |
+        svr
+        --port ${PORT}
+      aliases: [m2]
+
+# groups section
+groups:
+  g1:
+    members: [model1, model2]
+`
+
+func TestSource_SetModelAdds(t *testing.T) {
+	source := &Source{Data: []byte(testSource)}
+	updated, err := source.SetModel("model3", []byte(`{"cmd": "svr --port ${PORT}", "ttl": 300, "name": "123", "aliases": ["m3"]}`))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// the fields are indented like the first model
+	assert.Equal(t, `# llama-swap config
+logLevel: info
+
+models:
+  # the first model
+  model1:
+    cmd: svr --port ${PORT}   # keep this comment
+
+  model2:
+      cmd: |
+        svr
+        --port ${PORT}
+      aliases: [m2]
+
+  model3:
+    cmd: svr --port ${PORT}
+    ttl: 300
+    name: "123"
+    aliases:
+      - m3
+
+# groups section
+groups:
+  g1:
+    members: [model1, model2]
+`, string(updated.Data))
+
+	// the original is not changed
+	assert.Equal(t, testSource, string(source.Data))
+
+	config, err := updated.Load()
+	if assert.NoError(t, err) {
+		assert.Equal(t, 300, config.Models["model3"].UnloadAfter)
+		assert.Equal(t, "123", config.Models["model3"].Name)
+	}
+}
+
+func TestSource_SetModelReplaces(t *testing.T) {
+	source := &Source{Data: []byte(testSource)}
+	updated, err := source.SetModel("model1", []byte("cmd: other --port ${PORT}\n"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, `# llama-swap config
+logLevel: info
+
+models:
+  # the first model
+  model1:
+    cmd: other --port ${PORT}
+
+  model2:
+      cmd: |
+        svr
+        --port ${PORT}
+      aliases: [m2]
+
+# groups section
+groups:
+  g1:
+    members: [model1, model2]
+`, string(updated.Data))
+}
+
+func TestSource_SetModelWithoutModels(t *testing.T) {
+	for name, content := range map[string]string{
+		"no models":    "logLevel: info\n",
+		"empty models": "logLevel: info\nmodels:\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			updated, err := (&Source{Data: []byte(content)}).SetModel("model1", []byte(`{"cmd": "svr --port ${PORT}"}`))
+			if assert.NoError(t, err) {
+				assert.Equal(t, "logLevel: info\nmodels:\n  model1:\n    cmd: svr --port ${PORT}\n", string(updated.Data))
+			}
+		})
+	}
+}
+
+func TestSource_SetModelInvalid(t *testing.T) {
+	source := &Source{Data: []byte(testSource)}
+	_, err := source.SetModel("model3", []byte(`["not", "a", "model"]`))
+	assert.EqualError(t, err, "invalid model configuration: must be an object")
+
+	_, err = (&Source{Data: []byte("models: {}\n")}).SetModel("model3", []byte(`{"cmd": "svr"}`))
+	assert.EqualError(t, err, "models must be a block mapping to be edited")
+}
+
+func TestSource_DeleteModel(t *testing.T) {
+	source := &Source{Data: []byte(testSource + `  g2:
+    members:
+      - model3
+      - model1
+`)}
+
+	updated, err := source.DeleteModel("model1")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.Equal(t, `# llama-swap config
+logLevel: info
+
+models:
+  model2:
+      cmd: |
+        svr
+        --port ${PORT}
+      aliases: [m2]
+
+# groups section
+groups:
+  g1:
+    members: [model2]
+  g2:
+    members:
+      - model3
+`, string(updated.Data))
+
+	has, err := source.HasModel("model1")
+	assert.NoError(t, err)
+	assert.True(t, has)
+
+	_, err = updated.DeleteModel("model1")
+	assert.ErrorIs(t, err, ErrModelNotInSource)
+}
+
+func TestSource_Save(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeTestFile(t, path, testSource)
+	if !assert.NoError(t, os.Chmod(path, 0600)) {
+		return
+	}
+
+	source, err := ReadSource(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	updated, err := source.DeleteModel("model2")
+	if !assert.NoError(t, err) || !assert.NoError(t, updated.Save()) {
+		return
+	}
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, string(updated.Data), string(data))
+
+	info, err := os.Stat(path)
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+
+	// no temporary files are left behind
+	entries, err := os.ReadDir(filepath.Dir(path))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	assert.Error(t, (&Source{Data: []byte(testSource)}).Save())
+}
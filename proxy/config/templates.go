@@ -0,0 +1,252 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// model fields where the template's list is extended instead of replaced
+var appendOnExtendFields = []string{"env", "aliases"}
+
+// applyModelTemplates resolves `extends` for every model in the main document and
+// the included documents. Templates are defined under the top level `modelTemplates`
+// key in any of the files. Templates are never models themselves so they do not get
+// a process or a port.
+//
+// Merging is done on the YAML nodes before the models are decoded so only the fields
+// a model actually sets override the template, and the order of macros is preserved.
+func applyModelTemplates(mainName string, doc *yaml.Node, includes []includeDocument) error {
+	type source struct {
+		file string
+		doc  *yaml.Node
+	}
+	sources := []source{{mainName, doc}}
+	for _, include := range includes {
+		sources = append(sources, source{include.file, include.doc})
+	}
+
+	// collect the templates from all files
+	templates := make(map[string]*yaml.Node)
+	templateSource := make(map[string]string)
+	templateKeys := make(map[string]*yaml.Node)
+	for _, src := range sources {
+		root := documentRoot(src.doc)
+		templatesNode := mappingValue(root, "modelTemplates")
+		if templatesNode == nil {
+			continue
+		}
+		if templatesNode.Kind != yaml.MappingNode {
+			return nodeError(src.file, mappingKey(root, "modelTemplates"), fmt.Errorf("modelTemplates must be a mapping"))
+		}
+		for i := 0; i < len(templatesNode.Content); i += 2 {
+			keyNode := templatesNode.Content[i]
+			name := keyNode.Value
+			if existing, found := templateSource[name]; found {
+				return nodeError(src.file, keyNode, fmt.Errorf("duplicate model template %s in %s, already defined in %s", name, src.file, existing))
+			}
+			templateNode := resolveAlias(templatesNode.Content[i+1])
+			if templateNode.Kind != yaml.MappingNode {
+				return nodeError(src.file, keyNode, fmt.Errorf("model template %s must be a mapping", name))
+			}
+			templates[name] = templateNode
+			templateSource[name] = src.file
+			templateKeys[name] = keyNode
+		}
+	}
+
+	// templateError reports a problem at the definition of a template
+	templateError := func(name string, err error) error {
+		return nodeError(templateSource[name], templateKeys[name], err)
+	}
+
+	// templates can extend other templates, resolve them first
+	resolved := make(map[string]*yaml.Node, len(templates))
+	var resolveTemplate func(name string, chain []string) (*yaml.Node, error)
+	resolveTemplate = func(name string, chain []string) (*yaml.Node, error) {
+		if node, found := resolved[name]; found {
+			return node, nil
+		}
+		for _, seen := range chain {
+			if seen == name {
+				return nil, templateError(name, fmt.Errorf("model template %s has a circular extends: %s", name, strings.Join(append(chain, name), " -> ")))
+			}
+		}
+
+		templateNode := templates[name]
+		parentName, err := extendsName(templateNode)
+		if err != nil {
+			return nil, templateError(name, fmt.Errorf("model template %s: %w", name, err))
+		}
+
+		result := copyNode(templateNode)
+		if parentName != "" {
+			if _, found := templates[parentName]; !found {
+				return nil, templateError(name, fmt.Errorf("model template %s extends unknown template %s", name, parentName))
+			}
+			parent, err := resolveTemplate(parentName, append(chain, name))
+			if err != nil {
+				return nil, err
+			}
+			result = mergeModelNodes(parent, templateNode)
+		}
+		removeMappingKey(result, "extends")
+		resolved[name] = result
+		return result, nil
+	}
+
+	for name := range templates {
+		if _, err := resolveTemplate(name, nil); err != nil {
+			return err
+		}
+	}
+
+	// apply the templates to the models
+	for _, src := range sources {
+		modelsNode := mappingValue(documentRoot(src.doc), "models")
+		if modelsNode == nil || modelsNode.Kind != yaml.MappingNode {
+			continue
+		}
+		for i := 0; i < len(modelsNode.Content); i += 2 {
+			keyNode := modelsNode.Content[i]
+			modelID := keyNode.Value
+			modelNode := resolveAlias(modelsNode.Content[i+1])
+			if modelNode.Kind != yaml.MappingNode {
+				continue
+			}
+
+			templateName, err := extendsName(modelNode)
+			if err != nil {
+				return nodeError(src.file, keyNode, fmt.Errorf("model %s: %w", modelID, err))
+			}
+			if templateName == "" {
+				continue
+			}
+
+			template, found := resolved[templateName]
+			if !found {
+				return nodeError(src.file, keyNode, fmt.Errorf("model %s extends unknown template %s", modelID, templateName))
+			}
+			modelsNode.Content[i+1] = mergeModelNodes(template, modelNode)
+		}
+	}
+
+	return nil
+}
+
+// extendsName returns the template name in a model's extends field
+func extendsName(modelNode *yaml.Node) (string, error) {
+	extendsNode := mappingValue(modelNode, "extends")
+	if extendsNode == nil {
+		return "", nil
+	}
+	if extendsNode.Kind != yaml.ScalarNode {
+		return "", fmt.Errorf("extends must be the name of a model template")
+	}
+	return strings.TrimSpace(extendsNode.Value), nil
+}
+
+// mergeModelNodes returns a new mapping with override deep merged on top of base.
+// Lists in appendOnExtendFields are appended to, everything else is replaced.
+func mergeModelNodes(base, override *yaml.Node) *yaml.Node {
+	return mergeMappingNodes(base, override, appendOnExtendFields)
+}
+
+func mergeMappingNodes(base, override *yaml.Node, appendFields []string) *yaml.Node {
+	result := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Style: base.Style}
+
+	for i := 0; i < len(base.Content); i += 2 {
+		key := base.Content[i]
+		baseValue := resolveAlias(base.Content[i+1])
+		overrideValue := mappingValue(override, key.Value)
+
+		var value *yaml.Node
+		switch {
+		case overrideValue == nil:
+			value = copyNode(baseValue)
+		case baseValue.Kind == yaml.MappingNode && overrideValue.Kind == yaml.MappingNode:
+			value = mergeMappingNodes(baseValue, overrideValue, nil)
+		case baseValue.Kind == yaml.SequenceNode && overrideValue.Kind == yaml.SequenceNode && slices.Contains(appendFields, key.Value):
+			value = copyNode(baseValue)
+			for _, item := range overrideValue.Content {
+				value.Content = append(value.Content, copyNode(item))
+			}
+		default:
+			value = copyNode(overrideValue)
+		}
+		result.Content = append(result.Content, copyNode(key), value)
+	}
+
+	// fields that are only in the override
+	for i := 0; i < len(override.Content); i += 2 {
+		key := override.Content[i]
+		if mappingValue(base, key.Value) != nil {
+			continue
+		}
+		result.Content = append(result.Content, copyNode(key), copyNode(resolveAlias(override.Content[i+1])))
+	}
+
+	return result
+}
+
+// documentRoot returns the top level mapping of a YAML document
+func documentRoot(doc *yaml.Node) *yaml.Node {
+	if doc == nil {
+		return nil
+	}
+	if doc.Kind == yaml.DocumentNode {
+		if len(doc.Content) == 0 {
+			return nil
+		}
+		return resolveAlias(doc.Content[0])
+	}
+	return doc
+}
+
+// mappingValue returns the value for key in a mapping node or nil if it does not exist
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	if mapping == nil || mapping.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return resolveAlias(mapping.Content[i+1])
+		}
+	}
+	return nil
+}
+
+func removeMappingKey(mapping *yaml.Node, key string) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			mapping.Content = append(mapping.Content[:i], mapping.Content[i+2:]...)
+			return
+		}
+	}
+}
+
+func resolveAlias(node *yaml.Node) *yaml.Node {
+	for node != nil && node.Kind == yaml.AliasNode && node.Alias != nil {
+		node = node.Alias
+	}
+	return node
+}
+
+// copyNode makes a deep copy of a node so merged models do not share nodes
+func copyNode(node *yaml.Node) *yaml.Node {
+	if node == nil {
+		return nil
+	}
+	node = resolveAlias(node)
+	c := *node
+	c.Anchor = ""
+	if len(node.Content) > 0 {
+		c.Content = make([]*yaml.Node, len(node.Content))
+		for i, child := range node.Content {
+			c.Content[i] = copyNode(child)
+		}
+	}
+	return &c
+}
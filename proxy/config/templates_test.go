@@ -0,0 +1,177 @@
+package config
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig_ModelTemplatesExtends(t *testing.T) {
+	content := `
+startPort: 9000
+macros:
+  server: /usr/bin/llama-server
+
+modelTemplates:
+  base:
+    macros:
+      ctx: 4096
+      ngl: 99
+    cmd: ${server} --port ${PORT} -m ${model} -c ${ctx} -ngl ${ngl}
+    env:
+      - CUDA_VISIBLE_DEVICES=0
+    ttl: 300
+    filters:
+      stripParams: "temperature"
+      setParams:
+        top_p: 0.9
+    chatTemplateKwargs:
+      enable_thinking: false
+
+  big:
+    extends: base
+    macros:
+      ctx: 32768
+    env:
+      - GGML_CUDA_ENABLE_UNIFIED_MEMORY=1
+    aliases: [big-model]
+
+models:
+  small:
+    extends: base
+    macros:
+      model: small.gguf
+    aliases: [s]
+
+  large:
+    extends: big
+    macros:
+      model: large.gguf
+    ttl: 0
+    aliases: [l]
+    env:
+      - CUDA_VISIBLE_DEVICES=0,1
+    filters:
+      setParams:
+        top_k: 40
+    chatTemplateKwargs:
+      enable_thinking: true
+`
+
+	config, err := LoadConfigFromReader(strings.NewReader(content))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// templates are never models
+	assert.Len(t, config.Models, 2)
+	_, found := config.Models["base"]
+	assert.False(t, found)
+	_, found = config.Models["big"]
+	assert.False(t, found)
+
+	small := config.Models["small"]
+	assert.Equal(t, "base", small.Extends)
+	assert.Equal(t, "/usr/bin/llama-server --port 9001 -m small.gguf -c 4096 -ngl 99", small.Cmd)
+	assert.Equal(t, []string{"CUDA_VISIBLE_DEVICES=0"}, small.Env)
+	assert.Equal(t, []string{"s"}, small.Aliases)
+	assert.Equal(t, 300, small.UnloadAfter)
+	assert.Equal(t, "temperature", small.Filters.StripParams)
+	assert.Equal(t, map[string]any{"enable_thinking": false}, small.ChatTemplateKwargs)
+
+	large := config.Models["large"]
+	assert.Equal(t, "big", large.Extends)
+	assert.Equal(t, "/usr/bin/llama-server --port 9000 -m large.gguf -c 32768 -ngl 99", large.Cmd)
+	assert.Equal(t, []string{
+		"CUDA_VISIBLE_DEVICES=0",
+		"GGML_CUDA_ENABLE_UNIFIED_MEMORY=1",
+		"CUDA_VISIBLE_DEVICES=0,1",
+	}, large.Env)
+	assert.Equal(t, []string{"big-model", "l"}, large.Aliases)
+	assert.Equal(t, 0, large.UnloadAfter)
+	assert.Equal(t, map[string]any{"top_p": 0.9, "top_k": 40}, large.Filters.SetParams)
+	assert.Equal(t, map[string]any{"enable_thinking": true}, large.ChatTemplateKwargs)
+}
+
+func TestConfig_ModelTemplatesErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     string
+		expectedErr string
+	}{
+		{
+			name: "unknown template",
+			content: `
+models:
+  m1:
+    extends: nope
+    cmd: server --port ${PORT}
+`,
+			expectedErr: "model m1 extends unknown template nope",
+		},
+		{
+			name: "circular templates",
+			content: `
+modelTemplates:
+  a:
+    extends: b
+  b:
+    extends: a
+models:
+  m1:
+    extends: a
+    cmd: server --port ${PORT}
+`,
+			expectedErr: "circular extends",
+		},
+		{
+			name: "extends is not a name",
+			content: `
+modelTemplates:
+  a:
+    cmd: server --port ${PORT}
+models:
+  m1:
+    extends: [a]
+`,
+			expectedErr: "extends must be the name of a model template",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfigFromReader(strings.NewReader(tt.content))
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tt.expectedErr)
+			}
+		})
+	}
+}
+
+func TestConfig_ModelTemplatesFromInclude(t *testing.T) {
+	tempDir := t.TempDir()
+	configFile := filepath.Join(tempDir, "config.yaml")
+	writeTestFile(t, configFile, `
+include: [templates.yaml, models.d/*.yaml]
+`)
+	writeTestFile(t, filepath.Join(tempDir, "templates.yaml"), `
+modelTemplates:
+  llama:
+    cmd: llama-server --port ${PORT} -m ${MODEL_ID}.gguf
+    ttl: 60
+`)
+	writeTestFile(t, filepath.Join(tempDir, "models.d", "qwen.yaml"), `
+models:
+  qwen:
+    extends: llama
+`)
+
+	config, err := LoadConfig(configFile)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "llama-server --port 5800 -m qwen.gguf", config.Models["qwen"].Cmd)
+	assert.Equal(t, 60, config.Models["qwen"].UnloadAfter)
+}
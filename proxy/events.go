@@ -1,5 +1,7 @@
 package proxy
 
+import "time"
+
 // package level registry of the different event types
 
 const ProcessStateChangeEventID = 0x01
@@ -8,11 +10,18 @@ const ConfigFileChangedEventID = 0x03
 const LogDataEventID = 0x04
 const TokenMetricsEventID = 0x05
 const ModelPreloadedEventID = 0x06
+const ModelReloadEventID = 0x07
+const ProcessCrashEventID = 0x08
+const ModelEvictedEventID = 0x09
+const ModelScaledEventID = 0x0A
 
 type ProcessStateChangeEvent struct {
 	ProcessName string
 	NewState    ProcessState
 	OldState    ProcessState
+
+	// Reason is set when llama-swap stopped the process on its own, e.g. a failed liveness check
+	Reason string
 }
 
 func (e ProcessStateChangeEvent) Type() uint32 {
@@ -58,3 +67,74 @@ type ModelPreloadedEvent struct {
 func (e ModelPreloadedEvent) Type() uint32 {
 	return ModelPreloadedEventID
 }
+
+// ModelReloadAction is what happened to a model when the configuration was reloaded
+type ModelReloadAction string
+
+const (
+	ModelReloadKept      ModelReloadAction = "kept"
+	ModelReloadUpdated   ModelReloadAction = "updated"
+	ModelReloadRestarted ModelReloadAction = "restarted"
+	ModelReloadAdded     ModelReloadAction = "added"
+	ModelReloadRemoved   ModelReloadAction = "removed"
+)
+
+type ModelReloadEvent struct {
+	ModelID string
+	Action  ModelReloadAction
+	Reason  string
+}
+
+func (e ModelReloadEvent) Type() uint32 {
+	return ModelReloadEventID
+}
+
+// ProcessCrashEvent is emitted when an upstream process exits without being stopped
+type ProcessCrashEvent struct {
+	ProcessName string
+	ExitCode    int
+	State       ProcessState // the state of the process when it exited
+	Logs        string       // the last lines of the process's output
+
+	// Restart is true when a restart is scheduled after RestartDelay
+	Restart      bool
+	RestartDelay time.Duration
+}
+
+func (e ProcessCrashEvent) Type() uint32 {
+	return ProcessCrashEventID
+}
+
+// ModelEvictedEvent is emitted when a model is unloaded to make room for another one,
+// see memoryScheduler
+type ModelEvictedEvent struct {
+	ProcessName string
+	LoadedModel string // the model that needed the room
+	Reason      string
+}
+
+func (e ModelEvictedEvent) Type() uint32 {
+	return ModelEvictedEventID
+}
+
+// ModelScaleAction is what the autoscaler did to the replicas of a model
+type ModelScaleAction string
+
+const (
+	ModelScaleUp   ModelScaleAction = "up"
+	ModelScaleDown ModelScaleAction = "down"
+)
+
+// ModelScaledEvent is emitted when a replica of a model is started or stopped by the
+// autoscaler, or stopped by its ttl
+type ModelScaledEvent struct {
+	ModelID  string           `json:"model"`
+	Replica  int              `json:"replica"`
+	Action   ModelScaleAction `json:"action"`
+	Replicas int              `json:"replicas"` // running replicas after scaling
+	Reason   string           `json:"reason"`
+}
+
+func (e ModelScaledEvent) Type() uint32 {
+	return ModelScaledEventID
+}
@@ -22,6 +22,11 @@ var (
 
 // Check if the binary exists
 func TestMain(m *testing.M) {
+	// upstreams with limits run the test binary as the shim that sets them
+	if len(os.Args) > 1 && os.Args[1] == LimitsShimArg {
+		os.Exit(RunLimitsShim(os.Args[2:], os.Stderr))
+	}
+
 	binaryPath := getSimpleResponderPath()
 	if _, err := os.Stat(binaryPath); os.IsNotExist(err) {
 		fmt.Printf("simple-responder not found at %s, did you `make simple-responder`?\n", binaryPath)
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mostlygeek/llama-swap/event"
+)
+
+// keepWarm loads models with keepWarm in the background when llama-swap starts and
+// again after they were unloaded by their ttl or crashed. A model is only loaded when
+// no other model has to be unloaded for it.
+type keepWarm struct {
+	pm *ProxyManager
+
+	// warm ups after crashes, limited like restarts, see restartLimits()
+	mu         sync.Mutex
+	crashTimes map[*Process][]time.Time
+}
+
+// newKeepWarm sets a keepWarm on every process with keepWarm and starts loading them
+func newKeepWarm(pm *ProxyManager) *keepWarm {
+	k := &keepWarm{
+		pm:         pm,
+		crashTimes: make(map[*Process][]time.Time),
+	}
+
+	var processes []*Process
+	for _, group := range pm.processGroups {
+		for _, process := range group.allProcesses() {
+			if process.config.KeepWarm {
+				process.keepWarm.Store(k)
+				// the other replicas are started with the first one
+				if process.replica == 0 {
+					processes = append(processes, process)
+				}
+			} else {
+				// kept processes may have been kept warm by the previous configuration
+				process.keepWarm.Store(nil)
+			}
+		}
+	}
+
+	if len(processes) > 0 {
+		go func() {
+			for _, process := range processes {
+				k.warmUp(process, "keepWarm")
+			}
+		}()
+	}
+	return k
+}
+
+// unloaded is called when the ttl of p was reached or p crashed while ready
+func (k *keepWarm) unloaded(p *Process, crashed bool) {
+	// replicas over minReplicas are started by the autoscaler
+	if p.config.MaxReplicas > 0 && p.replica >= p.config.MinReplicas {
+		return
+	}
+
+	reason := "TTL reached"
+	if crashed {
+		if !k.allowAfterCrash(p) {
+			return
+		}
+		reason = "crashed"
+	}
+	go k.warmUp(p, reason)
+}
+
+// allowAfterCrash limits loading a crashing model again to maxRestarts in the window
+// of its restart settings
+func (k *keepWarm) allowAfterCrash(p *Process) bool {
+	maxRestarts, window := p.restartLimits()
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	now := time.Now()
+	recent := k.crashTimes[p][:0]
+	for _, t := range k.crashTimes[p] {
+		if now.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= maxRestarts {
+		k.crashTimes[p] = recent
+		k.pm.proxyLogger.Errorf("<%s> Not keeping warm, it crashed %d times in the last %v", p.ID, len(recent), window)
+		return false
+	}
+	k.crashTimes[p] = append(recent, now)
+	return true
+}
+
+// warmUp loads p unless it is already loaded or another model would be unloaded
+func (k *keepWarm) warmUp(p *Process, reason string) {
+	if k.pm.shutdownCtx.Err() != nil || !k.canLoad(p) {
+		return
+	}
+
+	k.pm.proxyLogger.Infof("<%s> Keeping warm, loading it in the background (%s)", p.ID, reason)
+	err := k.pm.loadModel(p.ID)
+	if err != nil {
+		k.pm.proxyLogger.Errorf("<%s> Failed to keep warm: %v", p.ID, err)
+	}
+	event.Emit(ModelPreloadedEvent{
+		ModelName: p.ID,
+		Success:   err == nil,
+	})
+}
+
+// canLoad is true when p is stopped and loading it does not unload another model
+func (k *keepWarm) canLoad(p *Process) bool {
+	if p.CurrentState() != StateStopped {
+		return false
+	}
+
+	// loading a model outside of swapProfile() leaves the active profile
+	k.pm.Lock()
+	activeProfile := k.pm.activeProfile
+	k.pm.Unlock()
+	if activeProfile != "" {
+		return false
+	}
+
+	if scheduler := p.scheduler.Load(); scheduler != nil {
+		scheduler.Lock()
+		_, reason := scheduler.nextEviction(p)
+		scheduler.Unlock()
+		if reason != "" {
+			k.pm.proxyLogger.Debugf("<%s> Not keeping warm, %s", p.ID, reason)
+			return false
+		}
+	}
+
+	group := k.pm.findGroupByModelName(p.ID)
+	if group == nil {
+		return false
+	}
+	for groupID, otherGroup := range k.pm.processGroups {
+		for _, process := range otherGroup.allProcesses() {
+			if process.ID == p.ID || !isLoaded(process) {
+				continue
+			}
+			sameGroup := groupID == group.id
+			if (sameGroup && group.swap) || (!sameGroup && group.exclusive && !otherGroup.persistent) {
+				k.pm.proxyLogger.Debugf("<%s> Not keeping warm, %s would be unloaded", p.ID, process.ID)
+				return false
+			}
+		}
+	}
+	return true
+}
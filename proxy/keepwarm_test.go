@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mostlygeek/llama-swap/event"
+	"github.com/mostlygeek/llama-swap/proxy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyManager_KeepWarm(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping long keepWarm test")
+	}
+
+	warm := getTestSimpleResponderConfig("model1")
+	warm.KeepWarm = true
+	warm.UnloadAfter = 1
+
+	cfg := config.AddDefaultGroupToConfig(config.Config{
+		HealthCheckTimeout: 15,
+		Models: map[string]config.ModelConfig{
+			"model1": warm,
+			"model2": getTestSimpleResponderConfig("model2"),
+		},
+		LogLevel: "error",
+	})
+
+	var mu sync.Mutex
+	loaded := 0
+	defer event.On(func(e ProcessStateChangeEvent) {
+		if e.ProcessName == "model1" && e.NewState == StateReady {
+			mu.Lock()
+			loaded++
+			mu.Unlock()
+		}
+	})()
+	waitForLoaded := func(n int) {
+		t.Helper()
+		assert.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return loaded >= n
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	proxy := New(cfg)
+	defer proxy.StopProcesses(StopWaitForInflightRequest)
+	process1 := proxy.findGroupByModelName("model1").processes["model1"]
+
+	// loaded on startup, then again after the ttl unloads it
+	waitForLoaded(1)
+	waitForLoaded(2)
+
+	// not loaded again when it was swapped out
+	req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"model2"}`))
+	w := CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Never(t, func() bool { return process1.CurrentState() != StateStopped }, 2*time.Second, 50*time.Millisecond)
+
+	// loaded again after a crash
+	assert.NoError(t, proxy.loadModel("model1"))
+	mu.Lock()
+	n := loaded
+	mu.Unlock()
+	assert.NoError(t, process1.cmd.Process.Kill())
+	waitForLoaded(n + 1)
+}
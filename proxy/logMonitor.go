@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
@@ -166,6 +167,43 @@ func (w *LogMonitor) GetHistory() []byte {
 	return w.buffer.GetHistory()
 }
 
+// Tail returns the last n lines of the history
+func (w *LogMonitor) Tail(n int) []byte {
+	history := bytes.TrimRight(w.GetHistory(), "\n")
+	if n <= 0 || len(history) == 0 {
+		return nil
+	}
+
+	start := len(history)
+	for ; n > 0 && start > 0; n-- {
+		start = bytes.LastIndexByte(history[:start], '\n')
+		if start < 0 {
+			return history
+		}
+	}
+	return history[start+1:]
+}
+
+// TailBytes returns at most the last n bytes of the history. When the cut is in the
+// middle of a line it starts at the next line.
+func (w *LogMonitor) TailBytes(n int) []byte {
+	history := bytes.TrimRight(w.GetHistory(), "\n")
+	if n <= 0 || len(history) == 0 {
+		return nil
+	}
+	if len(history) <= n {
+		return history
+	}
+
+	tail := history[len(history)-n:]
+	if history[len(history)-n-1] != '\n' {
+		if i := bytes.IndexByte(tail, '\n'); i >= 0 {
+			tail = tail[i+1:]
+		}
+	}
+	return tail
+}
+
 // Clear releases the buffer memory, making it eligible for GC.
 // The buffer will be lazily re-allocated on the next Write.
 func (w *LogMonitor) Clear() {
@@ -215,10 +253,15 @@ func (w *LogMonitor) formatMessage(level string, msg string) []byte {
 }
 
 func (w *LogMonitor) log(level LogLevel, msg string) {
+	// the level and format change when the configuration is reloaded
+	w.mu.RLock()
 	if level < w.level {
+		w.mu.RUnlock()
 		return
 	}
-	w.Write(w.formatMessage(level.String(), msg))
+	formatted := w.formatMessage(level.String(), msg)
+	w.mu.RUnlock()
+	w.Write(formatted)
 }
 
 func (w *LogMonitor) Debug(msg string) {
@@ -224,6 +224,54 @@ func TestLogMonitor_ClearAndReuse(t *testing.T) {
 	}
 }
 
+func TestLogMonitor_Tail(t *testing.T) {
+	lm := NewLogMonitorWriter(io.Discard)
+	if got := lm.Tail(2); got != nil {
+		t.Errorf("Expected nil tail without history, got %q", got)
+	}
+
+	lm.Write([]byte("one\ntwo\nthree\n"))
+	tests := []struct {
+		lines    int
+		expected string
+	}{
+		{0, ""},
+		{1, "three"},
+		{2, "two\nthree"},
+		{3, "one\ntwo\nthree"},
+		{10, "one\ntwo\nthree"},
+	}
+	for _, tt := range tests {
+		if got := string(lm.Tail(tt.lines)); got != tt.expected {
+			t.Errorf("Tail(%d): expected %q, got %q", tt.lines, tt.expected, got)
+		}
+	}
+}
+
+func TestLogMonitor_TailBytes(t *testing.T) {
+	lm := NewLogMonitorWriter(io.Discard)
+	if got := lm.TailBytes(10); got != nil {
+		t.Errorf("Expected nil tail without history, got %q", got)
+	}
+
+	lm.Write([]byte("one\ntwo\nthree\n"))
+	tests := []struct {
+		bytes    int
+		expected string
+	}{
+		{0, ""},
+		{5, "three"},
+		{7, "three"},
+		{9, "two\nthree"},
+		{100, "one\ntwo\nthree"},
+	}
+	for _, tt := range tests {
+		if got := string(lm.TailBytes(tt.bytes)); got != tt.expected {
+			t.Errorf("TailBytes(%d): expected %q, got %q", tt.bytes, tt.expected, got)
+		}
+	}
+}
+
 func BenchmarkLogMonitorWrite(b *testing.B) {
 	// Test data of varying sizes
 	smallMsg := []byte("small message\n")
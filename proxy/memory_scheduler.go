@@ -0,0 +1,327 @@
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	gguf_parser "github.com/gpustack/gguf-parser-go"
+	"github.com/mostlygeek/llama-swap/event"
+	"github.com/mostlygeek/llama-swap/proxy/config"
+)
+
+// how often makeRoom checks if the models that are stopping have stopped
+const schedulerPollInterval = 100 * time.Millisecond
+
+// memoryScheduler decides which models stay loaded when memoryBudget, maxLoadedModels
+// or maxLoadedGroups is set. A process asks it to make room before it starts, see
+// Process.start(). Models stay loaded until the room is needed, then the least
+// recently used ones are unloaded. It replaces the exclusive setting of groups.
+type memoryScheduler struct {
+	sync.Mutex
+
+	budget    map[string]int
+	devices   []string
+	maxModels int
+	maxGroups int
+	logger    *LogMonitor
+
+	// the scheduled processes and the group of each one
+	processes []*Process
+	groups    map[*Process]*ProcessGroup
+
+	// MB per device used by each process, see memoryCost(). It has its own lock as
+	// estimates are made while the scheduler is not locked.
+	costsMutex sync.Mutex
+	costs      map[*Process]map[string]int
+}
+
+// schedulerEnabled is true when models are loaded and unloaded by a memoryScheduler
+func schedulerEnabled(proxyConfig config.Config) bool {
+	return len(proxyConfig.MemoryBudget) > 0 || proxyConfig.MaxLoadedModels > 0 || proxyConfig.MaxLoadedGroups > 0
+}
+
+// newMemoryScheduler creates a scheduler for the processes of the groups and sets it on
+// every process
+func newMemoryScheduler(proxyConfig config.Config, groups map[string]*ProcessGroup, logger *LogMonitor) *memoryScheduler {
+	s := &memoryScheduler{
+		budget:    proxyConfig.MemoryBudget,
+		maxModels: proxyConfig.MaxLoadedModels,
+		maxGroups: proxyConfig.MaxLoadedGroups,
+		logger:    logger,
+		groups:    make(map[*Process]*ProcessGroup),
+		costs:     make(map[*Process]map[string]int),
+	}
+
+	for device := range s.budget {
+		s.devices = append(s.devices, device)
+	}
+	sort.Strings(s.devices)
+
+	for _, group := range groups {
+		for _, process := range group.allProcesses() {
+			s.processes = append(s.processes, process)
+			s.groups[process] = group
+			process.scheduler.Store(s)
+		}
+	}
+	return s
+}
+
+// makeRoom unloads the least recently used models until p can be loaded. The scheduler
+// stays locked until the returned function is called so p can be marked as starting
+// before the next process is scheduled. It is unlocked while the models finish their
+// in-flight requests so other models can be scheduled in the meantime.
+func (s *memoryScheduler) makeRoom(p *Process) (func(), error) {
+	// estimates read GGUF files from disk, they are made before locking so other
+	// models can be scheduled in the meantime
+	s.memoryCost(p)
+	for _, process := range s.processes {
+		if isLoaded(process) {
+			s.memoryCost(process)
+		}
+	}
+
+	s.Lock()
+
+	for {
+		// already running or starting
+		if p.CurrentState() != StateStopped {
+			return s.Unlock, nil
+		}
+
+		victims, reason := s.nextEviction(p)
+		if reason == "" {
+			return s.Unlock, nil
+		}
+
+		// models that are stopping still use their room, wait for them before
+		// unloading more
+		if s.stopping() {
+			s.Unlock()
+			time.Sleep(schedulerPollInterval)
+			s.Lock()
+			continue
+		}
+
+		if len(victims) == 0 {
+			s.Unlock()
+			return nil, fmt.Errorf("unable to load %s, %s and no model can be unloaded", p.ID, reason)
+		}
+
+		for _, victim := range victims {
+			s.logger.Infof("<%s> Unloading %s, %s", p.ID, victim.ID, reason)
+			event.Emit(ModelEvictedEvent{
+				ProcessName: victim.ID,
+				LoadedModel: p.ID,
+				Reason:      reason,
+			})
+		}
+
+		s.Unlock()
+		var wg sync.WaitGroup
+		for _, victim := range victims {
+			wg.Add(1)
+			go func(victim *Process) {
+				defer wg.Done()
+				victim.Stop()
+			}(victim)
+		}
+		wg.Wait()
+		s.Lock()
+	}
+}
+
+// stopping is true when one of the processes is finishing its in-flight requests
+// before it stops, or stopping
+func (s *memoryScheduler) stopping() bool {
+	for _, process := range s.processes {
+		if process.draining() != nil || process.CurrentState() == StateStopping {
+			return true
+		}
+	}
+	return false
+}
+
+// nextEviction returns the reason p does not fit and the processes to unload for it.
+// The reason is empty when p fits.
+func (s *memoryScheduler) nextEviction(p *Process) ([]*Process, string) {
+	group := s.groups[p]
+	persistent := group != nil && group.persistent
+
+	// loaded groups and models other than p, persistent ones are not counted
+	loadedGroups := make(map[*ProcessGroup]bool)
+	loadedModels := 0
+	used := make(map[string]int)
+	for _, process := range s.processes {
+		if process == p || !isLoaded(process) {
+			continue
+		}
+		for device, memory := range s.memoryCost(process) {
+			used[device] += memory
+		}
+		if s.groups[process].persistent {
+			continue
+		}
+		loadedModels++
+		if s.groups[process] != group {
+			loadedGroups[s.groups[process]] = true
+		}
+	}
+
+	if s.maxGroups > 0 && !persistent && len(loadedGroups) >= s.maxGroups {
+		return s.leastRecentlyUsedGroup(group), fmt.Sprintf("maxLoadedGroups is %d", s.maxGroups)
+	}
+
+	if s.maxModels > 0 && !persistent && loadedModels >= s.maxModels {
+		return s.leastRecentlyUsed(p, nil), fmt.Sprintf("maxLoadedModels is %d", s.maxModels)
+	}
+
+	need := s.memoryCost(p)
+	var over []string
+	for _, device := range s.devices {
+		if need[device] > 0 && used[device]+need[device] > s.budget[device] {
+			over = append(over, device)
+		}
+	}
+	if len(over) > 0 {
+		return s.leastRecentlyUsed(p, over), "not enough memory on " + strings.Join(over, ", ")
+	}
+
+	return nil, ""
+}
+
+// isLoaded is true when p uses its room, a stopping process does until it stopped
+func isLoaded(p *Process) bool {
+	state := p.CurrentState()
+	return state == StateStarting || state == StateReady || state == StateStopping
+}
+
+// leastRecentlyUsed returns the ready process that has not handled a request for the
+// longest time. When devices is set it must use one of them. Processes in persistent
+// groups are never returned.
+func (s *memoryScheduler) leastRecentlyUsed(p *Process, devices []string) []*Process {
+	var victim *Process
+	for _, process := range s.processes {
+		if process == p || s.groups[process].persistent || process.CurrentState() != StateReady {
+			continue
+		}
+
+		if devices != nil {
+			usesDevice := false
+			cost := s.memoryCost(process)
+			for _, device := range devices {
+				if cost[device] > 0 {
+					usesDevice = true
+					break
+				}
+			}
+			if !usesDevice {
+				continue
+			}
+		}
+
+		if victim == nil || process.getLastRequestHandled().Before(victim.getLastRequestHandled()) {
+			victim = process
+		}
+	}
+
+	if victim == nil {
+		return nil
+	}
+	return []*Process{victim}
+}
+
+// leastRecentlyUsedGroup returns the ready processes of the group, other than exclude,
+// whose last request was handled the longest time ago
+func (s *memoryScheduler) leastRecentlyUsedGroup(exclude *ProcessGroup) []*Process {
+	var victims []*Process
+	var victimGroup *ProcessGroup
+	var victimLastUsed time.Time
+
+	lastUsed := make(map[*ProcessGroup]time.Time)
+	ready := make(map[*ProcessGroup][]*Process)
+	for _, process := range s.processes {
+		group := s.groups[process]
+		if group == exclude || group.persistent || process.CurrentState() != StateReady {
+			continue
+		}
+		ready[group] = append(ready[group], process)
+		if t := process.getLastRequestHandled(); t.After(lastUsed[group]) {
+			lastUsed[group] = t
+		}
+	}
+
+	for group, processes := range ready {
+		if victimGroup == nil || lastUsed[group].Before(victimLastUsed) {
+			victimGroup, victimLastUsed, victims = group, lastUsed[group], processes
+		}
+	}
+	return victims
+}
+
+// memoryCost returns the MB per device p uses. It is the model's memory setting or an
+// estimate from its GGUF file. Models without either use the whole budget.
+func (s *memoryScheduler) memoryCost(p *Process) map[string]int {
+	if len(s.budget) == 0 {
+		return nil
+	}
+	s.costsMutex.Lock()
+	cost, ok := s.costs[p]
+	s.costsMutex.Unlock()
+	if ok {
+		return cost
+	}
+
+	cost = p.config.Memory
+	if len(cost) == 0 {
+		total, err := estimateModelMemory(p.config)
+		if err != nil {
+			s.logger.Warnf("<%s> Unable to estimate the memory it needs, it will use the whole memoryBudget: %v", p.ID, err)
+			cost = s.budget
+		} else {
+			cost = make(map[string]int, len(s.budget))
+			for device := range s.budget {
+				cost[device] = total / len(s.budget)
+			}
+			s.logger.Infof("<%s> Estimated memory: %d MB", p.ID, total)
+		}
+	}
+
+	s.costsMutex.Lock()
+	s.costs[p] = cost
+	s.costsMutex.Unlock()
+	return cost
+}
+
+// estimateModelMemory estimates the MB llama-server needs to run the model from the
+// GGUF file and context size in its cmd
+func estimateModelMemory(modelConfig config.ModelConfig) (int, error) {
+	parser := &LlamaServerParser{}
+	args := parser.Parse(modelConfig.Cmd, "")
+	if args.FullModelPath == "" || !strings.HasSuffix(args.FullModelPath, ".gguf") {
+		return 0, fmt.Errorf("no GGUF file in cmd")
+	}
+
+	gf, err := gguf_parser.ParseGGUFFile(args.FullModelPath, gguf_parser.SkipLargeMetadata())
+	if err != nil {
+		return 0, err
+	}
+
+	var opts []gguf_parser.GGUFRunEstimateOption
+	if args.ContextLength > 0 {
+		opts = append(opts, gguf_parser.WithLLaMACppContextSize(int32(args.ContextLength)))
+	}
+	summary := gf.EstimateLLaMACppRun(opts...).SummarizeItem(true, 0, 0)
+
+	var total uint64
+	for _, vram := range summary.VRAMs {
+		total += uint64(vram.NonUMA)
+	}
+	if total == 0 {
+		total = uint64(summary.RAM.NonUMA)
+	}
+	return int(total / (1024 * 1024)), nil
+}
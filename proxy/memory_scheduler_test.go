@@ -0,0 +1,272 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mostlygeek/llama-swap/event"
+	"github.com/mostlygeek/llama-swap/proxy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyManager_MemoryBudget(t *testing.T) {
+	withMemory := func(name string, memory map[string]int) config.ModelConfig {
+		modelConfig := getTestSimpleResponderConfig(name)
+		modelConfig.Memory = memory
+		return modelConfig
+	}
+
+	cfg := config.AddDefaultGroupToConfig(config.Config{
+		HealthCheckTimeout: 15,
+		MemoryBudget:       map[string]int{"gpu0": 10, "gpu1": 10},
+		Models: map[string]config.ModelConfig{
+			"model1": withMemory("model1", map[string]int{"gpu0": 6}),
+			"model2": withMemory("model2", map[string]int{"gpu0": 4}),
+			"model3": withMemory("model3", map[string]int{"gpu0": 6}),
+			"model4": withMemory("model4", map[string]int{"gpu1": 10}),
+			"model5": withMemory("model5", map[string]int{"gpu1": 1}),
+		},
+		Groups: map[string]config.GroupConfig{
+			"always": {Swap: true, Exclusive: true, Persistent: true, Members: []string{"model4"}},
+		},
+		LogLevel: "error",
+	})
+
+	proxy := New(cfg)
+	defer proxy.StopProcesses(StopWaitForInflightRequest)
+
+	request := func(model string) *TestResponseRecorder {
+		reqBody := fmt.Sprintf(`{"model":"%s"}`, model)
+		req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(reqBody))
+		w := CreateTestResponseRecorder()
+		proxy.ServeHTTP(w, req)
+		return w
+	}
+	state := func(modelID string) ProcessState {
+		return proxy.findGroupByModelName(modelID).processes[modelID].CurrentState()
+	}
+
+	// the default group swaps models, with a budget both fit on gpu0
+	assert.Equal(t, http.StatusOK, request("model1").Code)
+	assert.Equal(t, http.StatusOK, request("model2").Code)
+	assert.Equal(t, StateReady, state("model1"))
+	assert.Equal(t, StateReady, state("model2"))
+
+	// the least recently used model makes room
+	assert.Equal(t, http.StatusOK, request("model3").Code)
+	assert.Equal(t, StateStopped, state("model1"))
+	assert.Equal(t, StateReady, state("model2"))
+	assert.Equal(t, StateReady, state("model3"))
+
+	assert.Equal(t, http.StatusOK, request("model2").Code)
+	assert.Equal(t, http.StatusOK, request("model1").Code)
+	assert.Equal(t, StateStopped, state("model3"))
+	assert.Equal(t, StateReady, state("model2"))
+
+	// models on other devices are not unloaded, persistent groups are not swapped out
+	assert.Equal(t, http.StatusOK, request("model4").Code)
+	assert.Equal(t, StateReady, state("model1"))
+	assert.Equal(t, StateReady, state("model2"))
+
+	// model4 in the persistent group is never unloaded to make room
+	w := request("model5")
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Contains(t, w.Body.String(), "unable to load model5, not enough memory on gpu1 and no model can be unloaded")
+	assert.Equal(t, StateReady, state("model4"))
+}
+
+func TestProxyManager_MemoryBudgetUnloadDoesNotBlock(t *testing.T) {
+	withMemory := func(name string, memory map[string]int) config.ModelConfig {
+		modelConfig := getTestSimpleResponderConfig(name)
+		modelConfig.Memory = memory
+		return modelConfig
+	}
+
+	proxy := New(config.AddDefaultGroupToConfig(config.Config{
+		HealthCheckTimeout: 15,
+		MemoryBudget:       map[string]int{"gpu0": 10, "gpu1": 10},
+		Models: map[string]config.ModelConfig{
+			"model1": withMemory("model1", map[string]int{"gpu0": 10}),
+			"model2": withMemory("model2", map[string]int{"gpu0": 10}),
+			"model3": withMemory("model3", map[string]int{"gpu1": 10}),
+		},
+		LogLevel: "error",
+	}))
+	defer proxy.StopProcesses(StopWaitForInflightRequest)
+
+	request := func(model string, query string) int {
+		reqBody := fmt.Sprintf(`{"model":"%s"}`, model)
+		req := httptest.NewRequest("POST", "/v1/chat/completions"+query, bytes.NewBufferString(reqBody))
+		w := CreateTestResponseRecorder()
+		proxy.ServeHTTP(w, req)
+		return w.Code
+	}
+	process := func(modelID string) *Process {
+		return proxy.findGroupByModelName(modelID).processes[modelID]
+	}
+
+	assert.Equal(t, http.StatusOK, request("model1", ""))
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		request("model1", "?wait=2s")
+	}()
+	assert.Eventually(t, func() bool {
+		return process("model1").inFlightRequestsCount.Load() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// model1 finishes its slow request before it is unloaded for model2
+	go func() {
+		defer wg.Done()
+		assert.Equal(t, http.StatusOK, request("model2", ""))
+	}()
+	assert.Eventually(t, func() bool {
+		return process("model1").draining() != nil
+	}, time.Second, 10*time.Millisecond)
+
+	// a model that fits is loaded in the meantime
+	assert.Equal(t, http.StatusOK, request("model3", ""))
+	assert.NotNil(t, process("model1").draining())
+
+	wg.Wait()
+	assert.Equal(t, StateStopped, process("model1").CurrentState())
+	assert.Equal(t, StateReady, process("model2").CurrentState())
+	assert.Equal(t, StateReady, process("model3").CurrentState())
+}
+
+func TestProxyManager_MaxLoaded(t *testing.T) {
+	newProxy := func(t *testing.T, maxModels, maxGroups int) (func(model string) int, func(modelID string) ProcessState) {
+		proxy := New(config.Config{
+			HealthCheckTimeout: 15,
+			MaxLoadedModels:    maxModels,
+			MaxLoadedGroups:    maxGroups,
+			Models: map[string]config.ModelConfig{
+				"model1": getTestSimpleResponderConfig("model1"),
+				"model2": getTestSimpleResponderConfig("model2"),
+				"model3": getTestSimpleResponderConfig("model3"),
+				"model4": getTestSimpleResponderConfig("model4"),
+			},
+			Groups: map[string]config.GroupConfig{
+				"G1": {Swap: true, Exclusive: true, Members: []string{"model1", "model2"}},
+				"G2": {Swap: true, Exclusive: true, Members: []string{"model3"}},
+				"G3": {Swap: true, Exclusive: true, Members: []string{"model4"}},
+			},
+			LogLevel: "error",
+		})
+		t.Cleanup(func() { proxy.StopProcesses(StopWaitForInflightRequest) })
+
+		request := func(model string) int {
+			reqBody := fmt.Sprintf(`{"model":"%s"}`, model)
+			req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(reqBody))
+			w := CreateTestResponseRecorder()
+			proxy.ServeHTTP(w, req)
+			return w.Code
+		}
+		state := func(modelID string) ProcessState {
+			return proxy.findGroupByModelName(modelID).processes[modelID].CurrentState()
+		}
+		return request, state
+	}
+
+	var mu sync.Mutex
+	var evicted []ModelEvictedEvent
+	defer event.On(func(e ModelEvictedEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		evicted = append(evicted, e)
+	})()
+
+	t.Run("maxLoadedModels", func(t *testing.T) {
+		request, state := newProxy(t, 2, 0)
+
+		// groups do not swap or stop each other
+		assert.Equal(t, http.StatusOK, request("model1"))
+		assert.Equal(t, http.StatusOK, request("model2"))
+		assert.Equal(t, StateReady, state("model1"))
+		assert.Equal(t, StateReady, state("model2"))
+
+		assert.Equal(t, http.StatusOK, request("model1"))
+		assert.Equal(t, http.StatusOK, request("model3"))
+		assert.Equal(t, StateReady, state("model1"))
+		assert.Equal(t, StateStopped, state("model2"))
+		assert.Equal(t, StateReady, state("model3"))
+
+		assert.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return slices.Contains(evicted, ModelEvictedEvent{ProcessName: "model2", LoadedModel: "model3", Reason: "maxLoadedModels is 2"})
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("maxLoadedGroups", func(t *testing.T) {
+		request, state := newProxy(t, 0, 2)
+
+		// models swap within a group, groups stay loaded
+		assert.Equal(t, http.StatusOK, request("model1"))
+		assert.Equal(t, http.StatusOK, request("model3"))
+		assert.Equal(t, http.StatusOK, request("model2"))
+		assert.Equal(t, StateStopped, state("model1"))
+		assert.Equal(t, StateReady, state("model2"))
+		assert.Equal(t, StateReady, state("model3"))
+
+		// G2 was used the longest time ago
+		assert.Equal(t, http.StatusOK, request("model4"))
+		assert.Equal(t, StateReady, state("model2"))
+		assert.Equal(t, StateStopped, state("model3"))
+		assert.Equal(t, StateReady, state("model4"))
+
+		assert.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return slices.Contains(evicted, ModelEvictedEvent{ProcessName: "model3", LoadedModel: "model4", Reason: "maxLoadedGroups is 2"})
+		}, time.Second, 10*time.Millisecond)
+	})
+}
+
+func TestMemoryScheduler_MemoryCost(t *testing.T) {
+	budget := map[string]int{"gpu0": 8, "gpu1": 16}
+	s := newMemoryScheduler(config.Config{MemoryBudget: budget}, nil, debugLogger)
+
+	declared := NewProcess("declared", 5, config.ModelConfig{Memory: map[string]int{"gpu1": 4}}, debugLogger, debugLogger)
+	assert.Equal(t, map[string]int{"gpu1": 4}, s.memoryCost(declared))
+
+	// without a GGUF file to estimate from the model uses everything
+	unknown := NewProcess("unknown", 5, getTestSimpleResponderConfig("unknown"), debugLogger, debugLogger)
+	assert.Equal(t, budget, s.memoryCost(unknown))
+
+	_, err := estimateModelMemory(config.ModelConfig{Cmd: "llama-server --model /does/not/exist.gguf"})
+	assert.Error(t, err)
+}
+
+func TestMemoryScheduler_EstimatesBeforeLocking(t *testing.T) {
+	budget := map[string]int{"gpu0": 8}
+	s := newMemoryScheduler(config.Config{MemoryBudget: budget}, nil, debugLogger)
+	p := NewProcess("model1", 5, getTestSimpleResponderConfig("model1"), debugLogger, debugLogger)
+	s.processes = append(s.processes, p)
+
+	// the estimate of a model is made while another one is being scheduled
+	s.Lock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if unlock, err := s.makeRoom(p); assert.NoError(t, err) {
+			unlock()
+		}
+	}()
+	assert.Eventually(t, func() bool {
+		s.costsMutex.Lock()
+		defer s.costsMutex.Unlock()
+		_, estimated := s.costs[p]
+		return estimated
+	}, time.Second, 10*time.Millisecond)
+	s.Unlock()
+	<-done
+}
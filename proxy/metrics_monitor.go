@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"compress/flate"
 	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -28,6 +29,8 @@ type TokenMetrics struct {
 	PromptPerSecond float64   `json:"prompt_per_second"`
 	TokensPerSecond float64   `json:"tokens_per_second"`
 	DurationMs      int       `json:"duration_ms"`
+	QueueDepth      int       `json:"queue_depth"`
+	QueueWaitMs     int       `json:"queue_wait_ms"`
 	HasCapture      bool      `json:"has_capture"`
 }
 
@@ -166,6 +169,11 @@ func (mp *metricsMonitor) getMetricsJSON() ([]byte, error) {
 	return json.Marshal(mp.metrics)
 }
 
+func setQueueMetrics(tm *TokenMetrics, queued *queueStats) {
+	tm.QueueDepth = queued.depth
+	tm.QueueWaitMs = int(queued.wait.Milliseconds())
+}
+
 // wrapHandler wraps the proxy handler to extract token metrics
 // if wrapHandler returns an error it is safe to assume that no
 // data was sent to the client
@@ -199,6 +207,10 @@ func (mp *metricsMonitor) wrapHandler(
 
 	recorder := newBodyCopier(writer)
 
+	// filled in while the request waits for a free slot
+	queued := &queueStats{}
+	request = request.WithContext(context.WithValue(request.Context(), proxyCtxKey("queueStats"), queued))
+
 	// Filter Accept-Encoding to only include encodings we can decompress for metrics
 	if ae := request.Header.Get("Accept-Encoding"); ae != "" {
 		request.Header.Set("Accept-Encoding", filterAcceptEncoding(ae))
@@ -222,6 +234,7 @@ func (mp *metricsMonitor) wrapHandler(
 		Model:      modelID,
 		DurationMs: int(time.Since(recorder.StartTime()).Milliseconds()),
 	}
+	setQueueMetrics(&tm, queued)
 
 	body := recorder.body.Bytes()
 	if len(body) == 0 {
@@ -271,6 +284,7 @@ func (mp *metricsMonitor) wrapHandler(
 			mp.logger.Warnf("metrics: invalid JSON in response body path=%s, recording minimal metrics", request.URL.Path)
 		}
 	}
+	setQueueMetrics(&tm, queued)
 
 	// Build capture if enabled and determine if it will be stored
 	var capture *ReqRespCapture
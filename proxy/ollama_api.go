@@ -870,7 +870,7 @@ func (pm *ProxyManager) ollamaChatHandler() gin.HandlerFunc {
 			return
 		}
 
-		pg, err := pm.swapProcessGroup(ollamaReq.Model)
+		pg, err := pm.swapProcessGroup(ollamaReq.Model, "")
 		realModelName := ollamaReq.Model
 		if err != nil {
 			pm.sendOllamaError(c, http.StatusInternalServerError, fmt.Sprintf("Error selecting model process: %v", err))
@@ -1012,7 +1012,7 @@ func (pm *ProxyManager) ollamaGenerateHandler() gin.HandlerFunc {
 			return
 		}
 
-		pg, err := pm.swapProcessGroup(ollamaReq.Model)
+		pg, err := pm.swapProcessGroup(ollamaReq.Model, "")
 		realModelName := ollamaReq.Model
 		if err != nil {
 			pm.sendOllamaError(c, http.StatusInternalServerError, fmt.Sprintf("Error selecting model process: %v", err))
@@ -1131,7 +1131,7 @@ func (pm *ProxyManager) ollamaEmbedHandler() gin.HandlerFunc {
 			return
 		}
 
-		pg, err := pm.swapProcessGroup(req.Model)
+		pg, err := pm.swapProcessGroup(req.Model, "")
 		realModelName := req.Model
 		if err != nil {
 			pm.sendOllamaError(c, http.StatusInternalServerError, fmt.Sprintf("Error selecting model process: %v", err))
@@ -1260,7 +1260,7 @@ func (pm *ProxyManager) ollamaLegacyEmbeddingsHandler() gin.HandlerFunc {
 			return
 		}
 
-		pg, err := pm.swapProcessGroup(req.Model)
+		pg, err := pm.swapProcessGroup(req.Model, "")
 		realModelName := req.Model
 		if err != nil {
 			pm.sendOllamaError(c, http.StatusInternalServerError, fmt.Sprintf("Error selecting model process: %v", err))
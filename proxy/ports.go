@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+const maxPort = 65535
+
+// portAllocator hands out free ports to processes that use dynamic ports. Ports
+// are reserved until the process releases them so two processes starting at the
+// same time never get the same port.
+type portAllocator struct {
+	sync.Mutex
+	reserved map[int]*Process
+
+	// used for testing to override the check for ports in use
+	inUse func(port int) bool
+}
+
+// processes from all ProxyManagers share the allocator as old and new processes
+// overlap during a config reload
+var dynamicPorts = newPortAllocator()
+
+func newPortAllocator() *portAllocator {
+	return &portAllocator{
+		reserved: make(map[int]*Process),
+		inUse:    portInUse,
+	}
+}
+
+// allocate reserves the first free port starting at preferred. Any port previously
+// reserved by p is released first.
+func (a *portAllocator) allocate(p *Process, preferred int) (int, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.releaseLocked(p)
+
+	if preferred < 1 {
+		preferred = 1
+	}
+	for port := preferred; port <= maxPort; port++ {
+		if _, reserved := a.reserved[port]; reserved {
+			continue
+		}
+		if a.inUse(port) {
+			continue
+		}
+		a.reserved[port] = p
+		return port, nil
+	}
+
+	return 0, fmt.Errorf("no free port available from %d to %d", preferred, maxPort)
+}
+
+// reserve reserves port for p even though it is in use, for an upstream that already
+// listens on it. Any port previously reserved by p is released first.
+func (a *portAllocator) reserve(p *Process, port int) error {
+	a.Lock()
+	defer a.Unlock()
+
+	a.releaseLocked(p)
+	if owner, reserved := a.reserved[port]; reserved {
+		return fmt.Errorf("port %d is reserved by %s", port, owner.ID)
+	}
+	a.reserved[port] = p
+	return nil
+}
+
+// release frees the port reserved by p
+func (a *portAllocator) release(p *Process) {
+	a.Lock()
+	defer a.Unlock()
+	a.releaseLocked(p)
+}
+
+func (a *portAllocator) releaseLocked(p *Process) {
+	for port, owner := range a.reserved {
+		if owner == p {
+			delete(a.reserved, port)
+		}
+	}
+}
+
+// portInUse checks if something is already listening on port
+func portInUse(port int) bool {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return true
+	}
+	listener.Close()
+	return false
+}
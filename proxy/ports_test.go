@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPortAllocator_SkipsUsedPorts(t *testing.T) {
+	allocator := newPortAllocator()
+	allocator.inUse = func(port int) bool {
+		return port == 9001
+	}
+
+	p1 := &Process{ID: "p1"}
+	p2 := &Process{ID: "p2"}
+
+	port, err := allocator.allocate(p1, 9000)
+	assert.NoError(t, err)
+	assert.Equal(t, 9000, port)
+
+	// 9000 is reserved by p1 and 9001 is used by another program
+	port, err = allocator.allocate(p2, 9000)
+	assert.NoError(t, err)
+	assert.Equal(t, 9002, port)
+
+	// allocating again releases the previous reservation
+	port, err = allocator.allocate(p2, 9000)
+	assert.NoError(t, err)
+	assert.Equal(t, 9002, port)
+	assert.Len(t, allocator.reserved, 2)
+
+	allocator.release(p1)
+	port, err = allocator.allocate(p2, 9000)
+	assert.NoError(t, err)
+	assert.Equal(t, 9000, port)
+	assert.Len(t, allocator.reserved, 1)
+}
+
+func TestPortAllocator_NoFreePorts(t *testing.T) {
+	allocator := newPortAllocator()
+	allocator.inUse = func(port int) bool {
+		return true
+	}
+
+	_, err := allocator.allocate(&Process{ID: "p1"}, 65530)
+	assert.ErrorContains(t, err, "no free port available from 65530 to 65535")
+}
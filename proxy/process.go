@@ -6,11 +6,13 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
-	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
 	"os/exec"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -33,6 +35,9 @@ const (
 	StateShutdown ProcessState = ProcessState("shutdown")
 )
 
+// how long the upstream has to exit after it was asked to stop before it is killed
+const defaultGracefulStopTimeout = 10 * time.Second
+
 type StopStrategy int
 
 const (
@@ -41,10 +46,18 @@ const (
 )
 
 type Process struct {
-	ID           string
-	config       config.ModelConfig
-	cmd          *exec.Cmd
-	reverseProxy *httputil.ReverseProxy
+	ID     string
+	config config.ModelConfig
+	cmd    *exec.Cmd
+
+	// which of the model's replicas this is, starting from 0
+	replica int
+
+	// where the upstream is listening, changes on start() when the port is dynamic
+	upstreamMutex sync.RWMutex
+	upstreamPort  int
+	upstreamProxy string
+	reverseProxy  *httputil.ReverseProxy
 
 	// PR #155 called to cancel the upstream process
 	cmdMutex       sync.RWMutex
@@ -53,32 +66,91 @@ type Process struct {
 	// closed when command exits
 	cmdWaitChan chan struct{}
 
+	// when the command was started, see ExitRecord
+	cmdStartTime time.Time
+
+	// how the command last exited, see process_exit.go
+	lastExitMutex sync.RWMutex
+	lastExit      *ExitRecord
+
 	processLogger *LogMonitor
 	proxyLogger   *LogMonitor
 
 	healthCheckTimeout      int
 	healthCheckLoopInterval time.Duration
 
+	// time between liveness checks while ready, 0 when disabled
+	livenessInterval time.Duration
+
 	lastRequestHandledMutex sync.RWMutex
 	lastRequestHandled      time.Time
 
 	stateMutex sync.RWMutex
 	state      ProcessState
 
+	// why the process is being stopped, see stopWithReason()
+	stateReason string
+
 	inFlightRequests      sync.WaitGroup
 	inFlightRequestsCount atomic.Int32
 
+	// cancels the in-flight requests when the drainTimeout is reached, see process_drain.go
+	inFlightMutex   sync.Mutex
+	inFlightCancels map[*http.Request]context.CancelCauseFunc
+	drainTimeout    time.Duration
+
+	// closed when Stop() has finished draining, nil when not draining
+	drainMutex sync.Mutex
+	drainDone  chan struct{}
+
 	// used to block on multiple start() calls
 	waitStarting sync.WaitGroup
 
 	// for managing concurrency limits
 	concurrencyLimitSemaphore chan struct{}
 
+	// requests waiting for a concurrency limit slot
+	requestQueue *requestQueue
+
+	// makes room for the process before it starts, nil when models are not scheduled
+	scheduler atomic.Pointer[memoryScheduler]
+
+	// loads the process again after a ttl unload or crash, nil without keepWarm
+	keepWarm atomic.Pointer[keepWarm]
+
+	// scales the replicas of the model, nil without maxReplicas
+	autoscaler atomic.Pointer[autoscaler]
+
 	// used for testing to override the default value
 	gracefulStopTimeout time.Duration
 
+	// limits applied to the running command, see process_limits_linux.go
+	limits *processLimits
+
 	// track the number of failed starts
 	failedStartCount int
+
+	// set when llama-swap stops the command so its exit is not a crash
+	stopRequested atomic.Bool
+
+	// automatic restarts after a crash, see process_restart.go
+	restartMutex  sync.Mutex
+	restartCancel context.CancelFunc
+	restartTimes  []time.Time
+
+	// where the state of the upstream is kept so a restarted llama-swap can adopt it,
+	// empty when upstreams are not adopted, see process_state.go
+	stateDir         string
+	detachOnShutdown bool
+
+	// the upstream left running by a previous llama-swap, nil when cmd was started
+	adopted *os.Process
+
+	// set when the upstream was left running on shutdown
+	detached atomic.Bool
+
+	// copies what the upstream writes to its log file into processLogger
+	logTail *logTail
 }
 
 func NewProcess(ID string, healthCheckTimeout int, config config.ModelConfig, processLogger *LogMonitor, proxyLogger *LogMonitor) *Process {
@@ -87,21 +159,19 @@ func NewProcess(ID string, healthCheckTimeout int, config config.ModelConfig, pr
 		concurrentLimit = config.ConcurrencyLimit
 	}
 
-	// Setup the reverse proxy.
-	proxyURL, err := url.Parse(config.Proxy)
-	if err != nil {
-		proxyLogger.Errorf("<%s> invalid proxy URL %q: %v", ID, config.Proxy, err)
+	queueTimeout := defaultQueueTimeout
+	if config.QueueTimeout > 0 {
+		queueTimeout = time.Duration(config.QueueTimeout) * time.Second
 	}
+	concurrencyLimitSemaphore := make(chan struct{}, concurrentLimit)
 
+	// Setup the reverse proxy. With a dynamic port it is created when the process starts.
 	var reverseProxy *httputil.ReverseProxy
-	if proxyURL != nil {
-		reverseProxy = httputil.NewSingleHostReverseProxy(proxyURL)
-		reverseProxy.ModifyResponse = func(resp *http.Response) error {
-			// prevent nginx from buffering streaming responses (e.g., SSE)
-			if strings.Contains(strings.ToLower(resp.Header.Get("Content-Type")), "text/event-stream") {
-				resp.Header.Set("X-Accel-Buffering", "no")
-			}
-			return nil
+	if !config.DynamicPort {
+		var err error
+		reverseProxy, err = newUpstreamReverseProxy(config.Proxy)
+		if err != nil {
+			proxyLogger.Errorf("<%s> invalid proxy URL %q: %v", ID, config.Proxy, err)
 		}
 	}
 
@@ -109,24 +179,149 @@ func NewProcess(ID string, healthCheckTimeout int, config config.ModelConfig, pr
 		ID:                      ID,
 		config:                  config,
 		cmd:                     nil,
+		upstreamPort:            config.Port,
+		upstreamProxy:           config.Proxy,
 		reverseProxy:            reverseProxy,
 		cancelUpstream:          nil,
 		processLogger:           processLogger,
 		proxyLogger:             proxyLogger,
 		healthCheckTimeout:      healthCheckTimeout,
-		healthCheckLoopInterval: 5 * time.Second, /* default, can not be set by user - used for testing */
+		healthCheckLoopInterval: time.Duration(config.HealthCheckSettings().Interval) * time.Second,
+		livenessInterval:        time.Duration(config.HealthCheckSettings().Liveness.Interval) * time.Second,
 		state:                   StateStopped,
 
 		// concurrency limit
-		concurrencyLimitSemaphore: make(chan struct{}, concurrentLimit),
+		concurrencyLimitSemaphore: concurrencyLimitSemaphore,
+		inFlightCancels:           make(map[*http.Request]context.CancelCauseFunc),
+		drainTimeout:              time.Duration(config.DrainTimeout) * time.Second,
+		requestQueue:              newRequestQueue(concurrencyLimitSemaphore, config.MaxQueueSize, queueTimeout),
 
 		// To be removed when migration over exec.CommandContext is complete
 		// stop timeout
-		gracefulStopTimeout: 10 * time.Second,
+		gracefulStopTimeout: defaultGracefulStopTimeout,
 		cmdWaitChan:         make(chan struct{}),
 	}
 }
 
+// newUpstreamReverseProxy creates the reverse proxy to an upstream server
+func newUpstreamReverseProxy(proxy string) (*httputil.ReverseProxy, error) {
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	reverseProxy := httputil.NewSingleHostReverseProxy(proxyURL)
+	reverseProxy.ErrorHandler = proxyErrorHandler
+	reverseProxy.ModifyResponse = func(resp *http.Response) error {
+		// prevent nginx from buffering streaming responses (e.g., SSE)
+		if strings.Contains(strings.ToLower(resp.Header.Get("Content-Type")), "text/event-stream") {
+			resp.Header.Set("X-Accel-Buffering", "no")
+		}
+		return nil
+	}
+	return reverseProxy, nil
+}
+
+// Port returns the port the upstream is listening on, 0 if it does not use ${PORT}.
+// With a dynamic port it is the port picked the last time the process started.
+func (p *Process) Port() int {
+	p.upstreamMutex.RLock()
+	defer p.upstreamMutex.RUnlock()
+	return p.upstreamPort
+}
+
+// load is the number of in-flight and queued requests
+func (p *Process) load() int {
+	return int(p.inFlightRequestsCount.Load()) + p.requestQueue.depth()
+}
+
+// instanceName is the ID of the process, with the replica number for replicas after
+// the first one
+func (p *Process) instanceName() string {
+	if p.replica == 0 {
+		return p.ID
+	}
+	return fmt.Sprintf("%s-%d", p.ID, p.replica)
+}
+
+var instanceNameInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+
+// safeInstanceName is the instance name with only characters that can be used in
+// container and file names
+func (p *Process) safeInstanceName() string {
+	return instanceNameInvalidChars.ReplaceAllString(p.instanceName(), "_")
+}
+
+// command returns the upstream command with a dynamic port substituted
+func (p *Process) command() string {
+	if !p.config.DynamicPort {
+		return p.config.Cmd
+	}
+	return strings.ReplaceAll(p.config.Cmd, "${PORT}", strconv.Itoa(p.Port()))
+}
+
+// upstream returns the proxy URL and reverse proxy of the upstream server
+func (p *Process) upstream() (string, *httputil.ReverseProxy) {
+	p.upstreamMutex.RLock()
+	defer p.upstreamMutex.RUnlock()
+	return p.upstreamProxy, p.reverseProxy
+}
+
+// allocatePort picks a free port for a process with a dynamic port and points
+// the reverse proxy at it. It returns the command with ${PORT} substituted.
+func (p *Process) allocatePort() ([]string, error) {
+	port, err := dynamicPorts.allocate(p, p.config.Port)
+	if err != nil {
+		return nil, err
+	}
+
+	args, err := p.useDynamicPort(port)
+	if err != nil {
+		dynamicPorts.release(p)
+		return nil, err
+	}
+
+	if port != p.config.Port {
+		p.proxyLogger.Infof("<%s> port %d is in use, using port %d", p.ID, p.config.Port, port)
+	}
+	return args, nil
+}
+
+// useDynamicPort points the reverse proxy at port and returns the command with ${PORT}
+// substituted
+func (p *Process) useDynamicPort(port int) ([]string, error) {
+	proxy := strings.ReplaceAll(p.config.Proxy, "${PORT}", strconv.Itoa(port))
+	reverseProxy, err := newUpstreamReverseProxy(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL %q: %v", proxy, err)
+	}
+
+	args, err := p.config.SanitizedCommandWithPort(port)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get sanitized command: %v", err)
+	}
+
+	p.upstreamMutex.Lock()
+	p.upstreamPort = port
+	p.upstreamProxy = proxy
+	p.reverseProxy = reverseProxy
+	p.upstreamMutex.Unlock()
+	return args, nil
+}
+
+// upstreamProcess returns the running upstream, the started command or an adopted one
+func (p *Process) upstreamProcess() *os.Process {
+	p.cmdMutex.RLock()
+	defer p.cmdMutex.RUnlock()
+	if p.adopted != nil {
+		return p.adopted
+	}
+	if p.cmd != nil {
+		return p.cmd.Process
+	}
+	return nil
+}
+
 // LogMonitor returns the log monitor associated with the process.
 func (p *Process) LogMonitor() *LogMonitor {
 	return p.processLogger
@@ -174,10 +369,11 @@ func (p *Process) swapState(expectedState, newState ProcessState) (ProcessState,
 	// This ensures any thread that sees StateStarting will also see the WaitGroup counter incremented
 	if newState == StateStarting {
 		p.waitStarting.Add(1)
+		p.stateReason = ""
 	}
 
 	p.proxyLogger.Debugf("<%s> swapState() State transitioned from %s to %s", p.ID, expectedState, newState)
-	event.Emit(ProcessStateChangeEvent{ProcessName: p.ID, NewState: newState, OldState: expectedState})
+	event.Emit(ProcessStateChangeEvent{ProcessName: p.ID, NewState: newState, OldState: expectedState, Reason: p.stateReason})
 	return p.state, nil
 }
 
@@ -227,7 +423,17 @@ func (p *Process) start() error {
 		return fmt.Errorf("unable to get sanitized command: %v", err)
 	}
 
-	if curState, err := p.swapState(StateStopped, StateStarting); err != nil {
+	// the scheduler is unlocked once the process counts as starting
+	unlockScheduler := func() {}
+	if scheduler := p.scheduler.Load(); scheduler != nil {
+		if unlockScheduler, err = scheduler.makeRoom(p); err != nil {
+			return err
+		}
+	}
+
+	curState, err := p.swapState(StateStopped, StateStarting)
+	unlockScheduler()
+	if err != nil {
 		if err == ErrExpectedStateMismatch {
 			// already starting, just wait for it to complete and expect
 			// it to be be in the Ready start after. If not, return an error
@@ -248,41 +454,124 @@ func (p *Process) start() error {
 
 	// waitStarting.Add(1) is now called atomically in swapState() when transitioning to StateStarting
 	defer p.waitStarting.Done()
+
+	if p.config.DynamicPort {
+		if args, err = p.allocatePort(); err != nil {
+			if curState, swapErr := p.swapState(StateStarting, StateStopped); swapErr != nil {
+				p.forceState(StateStopped)
+				return fmt.Errorf("failed to allocate a port: %v, current state: %v, state swap error: %v", err, curState, swapErr)
+			}
+			return fmt.Errorf("failed to allocate a port: %v", err)
+		}
+	}
+
+	// a failing beforeStart hook vetoes the start
+	if err := p.runHooks("beforeStart", p.config.Hooks.BeforeStart, 0); err != nil {
+		if p.config.DynamicPort {
+			dynamicPorts.release(p)
+		}
+		if curState, swapErr := p.swapState(StateStarting, StateStopped); swapErr != nil {
+			p.forceState(StateStopped)
+			return fmt.Errorf("%v, current state: %v, state swap error: %v", err, curState, swapErr)
+		}
+		return err
+	}
+
+	if p.config.Container.Enabled() {
+		p.removeContainer()
+		args = p.containerCommand(args)
+	}
+
 	cmdContext, ctxCancelUpstream := context.WithCancel(context.Background())
 
 	p.cmd = exec.CommandContext(cmdContext, args[0], args[1:]...)
 	p.cmd.Stdout = p.processLogger
 	p.cmd.Stderr = p.processLogger
 	p.cmd.Env = append(p.cmd.Environ(), p.config.Env...)
+	p.cmd.Dir = p.config.WorkingDir
 	p.cmd.Cancel = p.cmdStopUpstreamProcess
 	p.cmd.WaitDelay = p.gracefulStopTimeout
 	setProcAttributes(p.cmd)
 
+	limits, err := prepareLimits(p.cmd, p.instanceName(), p.config.Limits)
+	if err != nil {
+		ctxCancelUpstream()
+		if p.config.DynamicPort {
+			dynamicPorts.release(p)
+		}
+		if curState, swapErr := p.swapState(StateStarting, StateStopped); swapErr != nil {
+			p.forceState(StateStopped)
+			return fmt.Errorf("failed to apply limits: %v, current state: %v, state swap error: %v", err, curState, swapErr)
+		}
+		return fmt.Errorf("failed to apply limits: %v", err)
+	}
+	p.limits = limits
+
+	// an upstream that is adopted after a restart must outlive llama-swap, its output
+	// can not go through a pipe
+	var logFile *os.File
+	if p.adoptable() {
+		setDetached(p.cmd)
+		if logFile, err = p.openLogFile(); err != nil {
+			p.proxyLogger.Warnf("<%s> %v", p.ID, err)
+		} else {
+			p.cmd.Stdout = logFile
+			p.cmd.Stderr = logFile
+		}
+	}
+
 	p.cmdMutex.Lock()
 	p.cancelUpstream = ctxCancelUpstream
 	p.cmdWaitChan = make(chan struct{})
+	p.adopted = nil
 	p.cmdMutex.Unlock()
+	p.stopRequested.Store(false)
 
 	p.failedStartCount++ // this will be reset to zero when the process has successfully started
 
-	p.proxyLogger.Debugf("<%s> Executing start command: %s, env: %s", p.ID, strings.Join(args, " "), strings.Join(p.config.Env, ", "))
+	p.proxyLogger.Debugf("<%s> Executing start command: %s, env: %s", p.ID, p.config.Redact(strings.Join(args, " ")), p.config.Redact(strings.Join(p.config.Env, ", ")))
 	err = p.cmd.Start()
+	if logFile != nil {
+		logFile.Close()
+	}
 
 	// Set process state to failed
 	if err != nil {
+		if err := limits.exited(); err != nil {
+			p.proxyLogger.Warnf("<%s> %v", p.ID, err)
+		}
+		if p.config.DynamicPort {
+			dynamicPorts.release(p)
+		}
 		if curState, swapErr := p.swapState(StateStarting, StateStopped); swapErr != nil {
 			p.forceState(StateStopped) // force it into a stopped state
 			return fmt.Errorf(
 				"failed to start command '%s' and state swap failed. command error: %v, current state: %v, state swap error: %v",
-				strings.Join(args, " "), err, curState, swapErr,
+				p.config.Redact(strings.Join(args, " ")), err, curState, swapErr,
 			)
 		}
-		return fmt.Errorf("start() failed for command '%s': %v", strings.Join(args, " "), err)
+		return fmt.Errorf("start() failed for command '%s': %v", p.config.Redact(strings.Join(args, " ")), err)
+	}
+
+	p.cmdMutex.Lock()
+	p.cmdStartTime = time.Now()
+	if logFile != nil {
+		p.logTail = tailLogFile(logFile.Name(), false, p.processLogger)
+	}
+	p.cmdMutex.Unlock()
+
+	if p.adoptable() {
+		p.writeState(args, p.cmd.Process.Pid)
 	}
 
 	// Capture the exit error for later signalling
 	go p.waitForCmd()
 
+	if err := limits.started(p.cmd.Process.Pid); err != nil {
+		p.stopCommand()
+		return err
+	}
+
 	// One of three things can happen at this stage:
 	// 1. The command exits unexpectedly
 	// 2. The health check fails
@@ -293,21 +582,24 @@ func (p *Process) start() error {
 
 	checkStartTime := time.Now()
 	maxDuration := time.Second * time.Duration(p.healthCheckTimeout)
-	checkEndpoint := strings.TrimSpace(p.config.CheckEndpoint)
 
 	// a "none" means don't check for health ... I could have picked a better word :facepalm:
-	if checkEndpoint != "none" {
-		proxyTo := p.config.Proxy
-		healthURL, err := url.JoinPath(proxyTo, checkEndpoint)
-		if err != nil {
-			return fmt.Errorf("failed to create health check URL proxy=%s and checkEndpoint=%s", proxyTo, checkEndpoint)
-		}
-
+	healthChecker, err := p.newHealthChecker()
+	if err != nil {
+		p.stopCommand()
+		return err
+	}
+	if healthChecker != nil {
 		// Ready Check loop
 		for {
 			currentState := p.CurrentState()
 			if currentState != StateStarting {
 				if currentState == StateStopped {
+					if exit := p.LastExit(); exit != nil && exit.Signal != "" {
+						return fmt.Errorf("upstream command was killed prematurely by signal %s", exit.Signal)
+					} else if exit != nil && exit.ExitCode != 0 {
+						return fmt.Errorf("upstream command exited prematurely with exit code %d", exit.ExitCode)
+					}
 					return fmt.Errorf("upstream command exited prematurely but successfully")
 				}
 				return errors.New("health check interrupted due to shutdown")
@@ -318,15 +610,15 @@ func (p *Process) start() error {
 				return fmt.Errorf("health check timed out after %vs", maxDuration.Seconds())
 			}
 
-			if err := p.checkHealthEndpoint(healthURL); err == nil {
-				p.proxyLogger.Infof("<%s> Health check passed on %s", p.ID, healthURL)
+			if err := healthChecker.check(); err == nil {
+				p.proxyLogger.Infof("<%s> Health check passed on %s", p.ID, healthChecker.target)
 				break
 			} else {
 				if strings.Contains(err.Error(), "connection refused") {
 					ttl := time.Until(checkStartTime.Add(maxDuration))
-					p.proxyLogger.Debugf("<%s> Connection refused on %s, giving up in %.0fs (normal during startup)", p.ID, healthURL, ttl.Seconds())
+					p.proxyLogger.Debugf("<%s> Connection refused on %s, giving up in %.0fs (normal during startup)", p.ID, healthChecker.target, ttl.Seconds())
 				} else {
-					p.proxyLogger.Debugf("<%s> Health check error on %s, %v (normal during startup)", p.ID, healthURL, err)
+					p.proxyLogger.Debugf("<%s> Health check error on %s, %v (normal during startup)", p.ID, healthChecker.target, err)
 				}
 			}
 			<-time.After(p.healthCheckLoopInterval)
@@ -336,51 +628,73 @@ func (p *Process) start() error {
 	if p.config.UnloadAfter > 0 {
 		// start a goroutine to check every second if
 		// the process should be stopped
-		go func() {
-			maxDuration := time.Duration(p.config.UnloadAfter) * time.Second
-
-			for range time.Tick(time.Second) {
-				if p.CurrentState() != StateReady {
-					return
-				}
-
-				// skip the TTL check if there are inflight requests
-				if p.inFlightRequestsCount.Load() != 0 {
-					continue
-				}
-
-				if time.Since(p.getLastRequestHandled()) > maxDuration {
-					p.proxyLogger.Infof("<%s> Unloading model, TTL of %ds reached", p.ID, p.config.UnloadAfter)
-					p.Stop()
-					return
-				}
-			}
-		}()
+		go p.unloadAfterTTL()
 	}
 
 	if curState, err := p.swapState(StateStarting, StateReady); err != nil {
 		return fmt.Errorf("failed to set Process state to ready: current state: %v, error: %v", curState, err)
 	} else {
 		p.failedStartCount = 0
+		if healthChecker != nil && p.livenessInterval > 0 {
+			go p.livenessLoop(healthChecker)
+		}
+		p.runHooksInBackground("afterReady", p.config.Hooks.AfterReady, p.cmd.Process.Pid)
 		return nil
 	}
 }
 
+// unloadAfterTTL stops the process when it has not handled a request for its ttl
+func (p *Process) unloadAfterTTL() {
+	maxDuration := time.Duration(p.config.UnloadAfter) * time.Second
+
+	for range time.Tick(time.Second) {
+		if p.CurrentState() != StateReady {
+			return
+		}
+
+		// skip the TTL check if there are inflight requests
+		if p.inFlightRequestsCount.Load() != 0 {
+			continue
+		}
+
+		if time.Since(p.getLastRequestHandled()) > maxDuration {
+			if autoscaler := p.autoscaler.Load(); autoscaler != nil {
+				if !autoscaler.stopAfterTTL(p) {
+					continue
+				}
+			} else {
+				p.proxyLogger.Infof("<%s> Unloading model, TTL of %ds reached", p.ID, p.config.UnloadAfter)
+				p.Stop()
+			}
+			if keepWarm := p.keepWarm.Load(); keepWarm != nil {
+				keepWarm.unloaded(p, false)
+			}
+			return
+		}
+	}
+}
+
 // Stop will wait for inflight requests to complete before stopping the process.
 func (p *Process) Stop() {
+	p.cancelRestart()
 	if !isValidTransition(p.CurrentState(), StateStopping) {
 		return
 	}
 
+	// requests that arrive until the process has stopped are queued or rejected
+	endDrain := p.startDrain()
+	defer endDrain()
+
 	// wait for any inflight requests before proceeding
 	p.proxyLogger.Debugf("<%s> Stop(): Waiting for inflight requests to complete", p.ID)
-	p.inFlightRequests.Wait()
+	p.waitForInFlightRequests()
 	p.StopImmediately()
 }
 
 // StopImmediately will transition the process to the stopping state and stop the process with a SIGTERM.
 // If the process does not stop within the specified timeout, it will be forcefully stopped with a SIGKILL.
 func (p *Process) StopImmediately() {
+	p.cancelRestart()
 	if !isValidTransition(p.CurrentState(), StateStopping) {
 		return
 	}
@@ -394,15 +708,36 @@ func (p *Process) StopImmediately() {
 	p.stopCommand()
 }
 
+// stopWithReason stops the process immediately and adds reason to its state change events
+func (p *Process) stopWithReason(reason string) {
+	p.stateMutex.Lock()
+	p.stateReason = reason
+	p.stateMutex.Unlock()
+
+	p.StopImmediately()
+}
+
 // Shutdown is called when llama-swap is shutting down. It will give a little bit
 // of time for any inflight requests to complete before shutting down. If the Process
 // is in the state of starting, it will cancel it and shut it down. Once a process is in
 // the StateShutdown state, it can not be started again.
 func (p *Process) Shutdown() {
+	p.cancelRestart()
 	if !isValidTransition(p.CurrentState(), StateStopping) {
 		return
 	}
 
+	// the next llama-swap adopts the upstream, see adopt()
+	if p.detachOnShutdown && p.adoptable() && p.CurrentState() == StateReady {
+		p.detached.Store(true)
+		p.cmdMutex.RLock()
+		p.logTail.close()
+		p.cmdMutex.RUnlock()
+		p.proxyLogger.Infof("<%s> Leaving upstream pid %d running", p.ID, p.upstreamProcess().Pid)
+		p.forceState(StateShutdown)
+		return
+	}
+
 	p.stopCommand()
 	// just force it to this state since there is no recovery from shutdown
 	p.forceState(StateShutdown)
@@ -429,47 +764,15 @@ func (p *Process) stopCommand() {
 		return
 	}
 
+	p.stopRequested.Store(true)
 	cancelUpstream()
 	<-cmdWaitChan
 }
 
-func (p *Process) checkHealthEndpoint(healthURL string) error {
-
-	client := &http.Client{
-		// wait a short time for a tcp connection to be established
-		Transport: &http.Transport{
-			DialContext: (&net.Dialer{
-				Timeout: 500 * time.Millisecond,
-			}).DialContext,
-		},
-
-		// give a long time to respond to the health check endpoint
-		// after the connection is established. See issue: 276
-		Timeout: 5000 * time.Millisecond,
-	}
-
-	req, err := http.NewRequest("GET", healthURL, nil)
-	if err != nil {
-		return err
-	}
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	// got a response but it was not an OK
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("status code: %d", resp.StatusCode)
-	}
-
-	return nil
-}
-
 func (p *Process) ProxyRequest(w http.ResponseWriter, r *http.Request) {
 
-	if p.reverseProxy == nil {
+	// with a dynamic port the reverse proxy is created when the process starts
+	if _, reverseProxy := p.upstream(); reverseProxy == nil && !p.config.DynamicPort {
 		http.Error(w, fmt.Sprintf("No reverse proxy available for %s", p.ID), http.StatusInternalServerError)
 		return
 	}
@@ -477,6 +780,11 @@ func (p *Process) ProxyRequest(w http.ResponseWriter, r *http.Request) {
 	requestBeginTime := time.Now()
 	var startDuration time.Duration
 
+	// hold requests until a draining process has stopped, it is started again after
+	if !p.waitForDrain(w, r) {
+		return
+	}
+
 	// prevent new requests from being made while stopping or irrecoverable
 	currentState := p.CurrentState()
 	if currentState == StateShutdown || currentState == StateStopping {
@@ -484,17 +792,35 @@ func (p *Process) ProxyRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	select {
-	case p.concurrencyLimitSemaphore <- struct{}{}:
-		defer func() { <-p.concurrencyLimitSemaphore }()
-	default:
+	// wait for a slot when the concurrency limit is reached
+	priority, _ := r.Context().Value(proxyCtxKey("priority")).(int)
+	queueDepth, err := p.requestQueue.acquire(r.Context(), priority)
+	if stats, ok := r.Context().Value(proxyCtxKey("queueStats")).(*queueStats); ok {
+		stats.depth = queueDepth
+		stats.wait = time.Since(requestBeginTime)
+	}
+	switch {
+	case errors.Is(err, errQueueFull):
+		w.Header().Set("Retry-After", strconv.Itoa(p.requestQueue.retryAfter()))
 		http.Error(w, "Too many requests", http.StatusTooManyRequests)
 		return
+	case errors.Is(err, errQueueTimeout):
+		p.proxyLogger.Warnf("<%s> Request timed out after waiting behind %d requests", p.ID, queueDepth)
+		w.Header().Set("Retry-After", strconv.Itoa(p.requestQueue.retryAfter()))
+		http.Error(w, "Timed out waiting for a free slot", http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		// the client went away
+		return
 	}
+	slotTime := time.Now()
+	defer func() { p.requestQueue.release(time.Since(slotTime)) }()
 
 	p.inFlightRequests.Add(1)
 	p.inFlightRequestsCount.Add(1)
+	r, untrack := p.trackInFlight(r)
 	defer func() {
+		untrack()
 		p.setLastRequestHandled(time.Now())
 		p.inFlightRequestsCount.Add(-1)
 		p.inFlightRequests.Done()
@@ -523,6 +849,9 @@ func (p *Process) ProxyRequest(w http.ResponseWriter, r *http.Request) {
 		beginStartTime := time.Now()
 		if err := p.start(); err != nil {
 			errstr := fmt.Sprintf("unable to start process: %s", err)
+			if exit := p.exitedSince(beginStartTime); exit != nil {
+				errstr += "\n\n" + exit.String()
+			}
 			cancelLoadCtx()
 			if srw != nil {
 				srw.sendData(fmt.Sprintf("Unable to swap model err: %s\n", errstr))
@@ -541,28 +870,40 @@ func (p *Process) ProxyRequest(w http.ResponseWriter, r *http.Request) {
 	// should trigger srw to stop sending loading events ...
 	cancelLoadCtx()
 
+	var out http.ResponseWriter = w
+	if srw != nil {
+		out = srw
+	}
+
 	// recover from http.ErrAbortHandler panics that can occur when the client
 	// disconnects before the response is sent
 	defer func() {
-		if r := recover(); r != nil {
-			if r == http.ErrAbortHandler {
+		if recovered := recover(); recovered != nil {
+			if recovered == http.ErrAbortHandler {
 				p.proxyLogger.Infof("<%s> recovered from client disconnection during streaming", p.ID)
 			} else {
-				p.proxyLogger.Infof("<%s> recovered from panic: %v", p.ID, r)
+				p.proxyLogger.Infof("<%s> recovered from panic: %v", p.ID, recovered)
 			}
 		}
+
+		// streams cancelled by the drainTimeout end with an error chunk
+		p.sendDrainError(out, r)
 	}()
 
+	_, reverseProxy := p.upstream()
+	if reverseProxy == nil {
+		http.Error(w, fmt.Sprintf("No reverse proxy available for %s", p.ID), http.StatusInternalServerError)
+		return
+	}
+
 	if srw != nil {
 		// Wait for the goroutine to finish writing its final messages
 		const completionTimeout = 1 * time.Second
 		if !srw.waitForCompletion(completionTimeout) {
 			p.proxyLogger.Warnf("<%s> status updates goroutine did not complete within %v, proceeding with proxy request", p.ID, completionTimeout)
 		}
-		p.reverseProxy.ServeHTTP(srw, r)
-	} else {
-		p.reverseProxy.ServeHTTP(w, r)
 	}
+	reverseProxy.ServeHTTP(out, r)
 
 	totalTime := time.Since(requestBeginTime)
 	p.proxyLogger.Debugf("<%s> request %s - start: %v, total: %v",
@@ -572,12 +913,43 @@ func (p *Process) ProxyRequest(w http.ResponseWriter, r *http.Request) {
 // waitForCmd waits for the command to exit and handles exit conditions depending on current state
 func (p *Process) waitForCmd() {
 	exitErr := p.cmd.Wait()
+
+	// the upstream was left running for the next llama-swap, see Shutdown()
+	if p.detached.Load() {
+		return
+	}
+
 	p.proxyLogger.Debugf("<%s> cmd.Wait() returned error: %v", p.ID, exitErr)
+	p.upstreamExited(exitErr)
+}
+
+// upstreamExited handles the exit of the upstream, a started command or an adopted one
+func (p *Process) upstreamExited(exitErr error) {
+	// the pid for the hooks is read while the process is not stopped yet, once it is
+	// a new start() replaces p.cmd
+	pid := 0
+	if upstream := p.upstreamProcess(); upstream != nil {
+		pid = upstream.Pid
+	}
+
+	p.cmdMutex.RLock()
+	p.logTail.close()
+	p.cmdMutex.RUnlock()
+	if p.adoptable() {
+		p.removeState()
+	}
+
+	if err := p.limits.exited(); err != nil {
+		p.proxyLogger.Warnf("<%s> %v", p.ID, err)
+	}
 
+	exitCode := 0
 	if exitErr != nil {
+		exitCode = -1
 		if errno, ok := exitErr.(syscall.Errno); ok {
 			p.proxyLogger.Errorf("<%s> errno >> %v", p.ID, errno)
 		} else if exitError, ok := exitErr.(*exec.ExitError); ok {
+			exitCode = exitError.ExitCode()
 			if strings.Contains(exitError.String(), "signal: terminated") {
 				p.proxyLogger.Debugf("<%s> Process stopped OK", p.ID)
 			} else if strings.Contains(exitError.String(), "signal: interrupt") {
@@ -593,6 +965,9 @@ func (p *Process) waitForCmd() {
 	}
 
 	currentState := p.CurrentState()
+	p.recordExit(exitErr, exitCode, currentState)
+
+	crashed := false
 	switch currentState {
 	case StateStopping:
 		if curState, err := p.swapState(StateStopping, StateStopped); err != nil {
@@ -601,12 +976,24 @@ func (p *Process) waitForCmd() {
 		}
 	default:
 		p.proxyLogger.Infof("<%s> process exited but not StateStopping, current state: %s", p.ID, currentState)
+		crashed = !p.stopRequested.Load() && (currentState == StateReady || currentState == StateStarting)
 		p.forceState(StateStopped) // force it to be in this state
 	}
 
+	if p.config.DynamicPort {
+		dynamicPorts.release(p)
+	}
+
 	p.cmdMutex.Lock()
 	close(p.cmdWaitChan)
 	p.cmdMutex.Unlock()
+
+	if crashed {
+		p.runHooksInBackground("onCrash", p.config.Hooks.OnCrash, pid)
+		p.handleCrash(currentState, exitCode)
+	} else {
+		p.runHooksInBackground("afterStop", p.config.Hooks.AfterStop, pid)
+	}
 }
 
 // cmdStopUpstreamProcess attemps to stop the upstream process gracefully
@@ -614,33 +1001,43 @@ func (p *Process) cmdStopUpstreamProcess() error {
 	p.processLogger.Debugf("<%s> cmdStopUpstreamProcess() initiating graceful stop of upstream process", p.ID)
 
 	// this should never happen ...
-	if p.cmd == nil || p.cmd.Process == nil {
+	upstream := p.upstreamProcess()
+	if upstream == nil {
 		p.proxyLogger.Debugf("<%s> cmd or cmd.Process is nil (normal during config reload)", p.ID)
 		return fmt.Errorf("<%s> process is nil or cmd is nil, skipping graceful stop", p.ID)
 	}
 
 	if p.config.CmdStop != "" {
-		// replace ${PID} with the pid of the process
-		stopArgs, err := config.SanitizeCommand(strings.ReplaceAll(p.config.CmdStop, "${PID}", fmt.Sprintf("%d", p.cmd.Process.Pid)))
+		// replace ${PID} with the pid of the process and ${PORT} with a dynamic port
+		cmdStop := strings.ReplaceAll(p.config.CmdStop, "${PID}", fmt.Sprintf("%d", upstream.Pid))
+		if p.config.DynamicPort {
+			cmdStop = strings.ReplaceAll(cmdStop, "${PORT}", strconv.Itoa(p.Port()))
+		}
+		stopArgs, err := config.SanitizeCommand(cmdStop)
 		if err != nil {
 			p.proxyLogger.Errorf("<%s> Failed to sanitize stop command: %v", p.ID, err)
 			return err
 		}
 
-		p.proxyLogger.Debugf("<%s> Executing stop command: %s", p.ID, strings.Join(stopArgs, " "))
+		p.proxyLogger.Debugf("<%s> Executing stop command: %s", p.ID, p.config.Redact(strings.Join(stopArgs, " ")))
 
 		stopCmd := exec.Command(stopArgs[0], stopArgs[1:]...)
 		stopCmd.Stdout = p.processLogger
 		stopCmd.Stderr = p.processLogger
 		setProcAttributes(stopCmd)
-		stopCmd.Env = p.cmd.Env
+		stopCmd.Env = append(stopCmd.Environ(), p.config.Env...)
 
 		if err := stopCmd.Run(); err != nil {
 			p.proxyLogger.Errorf("<%s> Failed to exec stop command: %v", p.ID, err)
 			return err
 		}
+	} else if p.config.Container.Enabled() {
+		if err := p.stopContainer(); err != nil {
+			p.proxyLogger.Errorf("<%s> Failed to stop container: %v", p.ID, err)
+			return err
+		}
 	} else {
-		if err := p.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		if err := upstream.Signal(syscall.SIGTERM); err != nil {
 			p.proxyLogger.Errorf("<%s> Failed to send SIGTERM to process: %v", p.ID, err)
 			return err
 		}
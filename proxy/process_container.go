@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the label set on every container llama-swap runs, its value is the model ID
+const containerLabel = "llama-swap.model"
+
+// how long container CLI commands other than run can take
+const containerCommandTimeout = 30 * time.Second
+
+// containerName is the name of the process's container
+func (p *Process) containerName() string {
+	return "llama-swap-" + p.safeInstanceName()
+}
+
+// containerCommand returns the command that runs the container in the foreground so
+// its output goes to the process's LogMonitor. args is the command of the container.
+func (p *Process) containerCommand(args []string) []string {
+	container := p.config.Container
+	port := strconv.Itoa(p.Port())
+	replace := func(s string) string { return strings.ReplaceAll(s, "${PORT}", port) }
+
+	run := []string{container.RuntimeCommand(), "run", "--rm",
+		"--name", p.containerName(),
+		"--label", containerLabel + "=" + p.ID,
+	}
+	if container.Port > 0 {
+		run = append(run, "--publish", fmt.Sprintf("127.0.0.1:%s:%d", port, container.Port))
+	}
+	if container.Network != "" {
+		run = append(run, "--network", replace(container.Network))
+	}
+	for _, mount := range container.Mounts {
+		run = append(run, "--volume", replace(mount))
+	}
+	for _, env := range container.Env {
+		run = append(run, "--env", replace(env))
+	}
+	if container.GPUs != "" {
+		run = append(run, "--gpus", replace(container.GPUs))
+	}
+	for _, device := range container.Devices {
+		run = append(run, "--device", replace(device))
+	}
+	for _, arg := range container.Args {
+		run = append(run, replace(arg))
+	}
+	run = append(run, replace(container.Image))
+	return append(run, args...)
+}
+
+// runContainerCLI runs the container runtime with args and returns its output
+func (p *Process) runContainerCLI(args ...string) (string, error) {
+	return runContainerCLI(p.config.Container.RuntimeCommand(), p.config.Env, args...)
+}
+
+func runContainerCLI(runtime string, env []string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), containerCommandTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, runtime, args...)
+	cmd.Env = append(cmd.Environ(), env...)
+	setProcAttributes(cmd)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return string(out), fmt.Errorf("%s %s failed: %v: %s", runtime, args[0], err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+// removeContainer removes a container left behind with the name of the process's
+// container, otherwise it can not be started
+func (p *Process) removeContainer() {
+	if _, err := p.runContainerCLI("rm", "--force", p.containerName()); err != nil {
+		p.proxyLogger.Debugf("<%s> %v", p.ID, err)
+	}
+}
+
+// stopContainer stops the container, the runtime kills it after the graceful stop timeout
+func (p *Process) stopContainer() error {
+	timeout := strconv.Itoa(int(p.gracefulStopTimeout.Seconds()))
+	p.proxyLogger.Debugf("<%s> Stopping container %s", p.ID, p.containerName())
+	_, err := p.runContainerCLI("stop", "--time", timeout, p.containerName())
+	return err
+}
+
+// removeOrphanedContainers removes the containers of the configured models that are
+// still there, ie: after llama-swap was killed. Containers with names this
+// configuration does not use belong to other llama-swap instances and are kept.
+func (pm *ProxyManager) removeOrphanedContainers() {
+	// the container names and the env to run the CLI with, by runtime
+	names := make(map[string]map[string]bool)
+	env := make(map[string][]string)
+	for _, group := range pm.processGroups {
+		for _, process := range group.allProcesses() {
+			if !process.config.Container.Enabled() {
+				continue
+			}
+			runtime := process.config.Container.RuntimeCommand()
+			if names[runtime] == nil {
+				names[runtime] = make(map[string]bool)
+				env[runtime] = process.config.Env
+			}
+			names[runtime][process.containerName()] = true
+		}
+	}
+
+	for runtime, ours := range names {
+		out, err := runContainerCLI(runtime, env[runtime], "ps", "--all", "--filter", "label="+containerLabel, "--format", "{{.Names}}")
+		if err != nil {
+			pm.proxyLogger.Warnf("Unable to list orphaned containers: %v", err)
+			continue
+		}
+
+		var orphaned []string
+		for _, name := range strings.Fields(out) {
+			if ours[name] {
+				orphaned = append(orphaned, name)
+			}
+		}
+		if len(orphaned) == 0 {
+			continue
+		}
+		if _, err := runContainerCLI(runtime, env[runtime], append([]string{"rm", "--force"}, orphaned...)...); err != nil {
+			pm.proxyLogger.Warnf("Unable to remove orphaned containers: %v", err)
+			continue
+		}
+		pm.proxyLogger.Infof("Removed %d orphaned %s containers", len(orphaned), runtime)
+	}
+}
@@ -0,0 +1,128 @@
+//go:build !windows
+
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mostlygeek/llama-swap/proxy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeContainerRuntime writes a container CLI that runs the simple-responder instead
+// of the image and records how it was called
+func fakeContainerRuntime(t *testing.T) (runtime string, calls func() []string) {
+	dir := t.TempDir()
+	responder, err := filepath.Abs(simpleResponderPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	script := fmt.Sprintf(`#!/bin/sh
+echo "$*" >> %[1]s/calls
+case "$1" in
+run)
+  while [ "$1" != "test/image:latest" ]; do
+    [ "$1" = "--name" ] && name="$2"
+    shift
+  done
+  shift
+  echo $$ > %[1]s/$name.pid
+  echo "container $name started"
+  exec %[2]s "$@"
+  ;;
+stop)
+  kill $(cat %[1]s/$4.pid)
+  ;;
+ps)
+  echo llama-swap-model1
+  echo llama-swap-other-instance
+  ;;
+esac
+`, dir, responder)
+
+	runtime = filepath.Join(dir, "fake-docker")
+	if err := os.WriteFile(runtime, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return runtime, func() []string {
+		data, _ := os.ReadFile(filepath.Join(dir, "calls"))
+		return strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+}
+
+func TestProcess_Container(t *testing.T) {
+	runtime, calls := fakeContainerRuntime(t)
+	port := getTestPort()
+
+	modelConfig := config.ModelConfig{
+		Cmd:   fmt.Sprintf("--port %d --silent --respond container", port),
+		Proxy: fmt.Sprintf("http://127.0.0.1:%d", port),
+		Container: config.ContainerConfig{
+			Image:   "test/image:latest",
+			Runtime: runtime,
+			Network: "host",
+			Mounts:  []string{"/models:/models:ro"},
+			Env:     []string{"MODEL=qwen"},
+			GPUs:    "all",
+		},
+	}
+	logs := NewLogMonitorWriter(io.Discard)
+	process := NewProcess("org/container", 5, modelConfig, logs, debugLogger)
+	defer process.Stop()
+
+	w := httptest.NewRecorder()
+	process.ProxyRequest(w, httptest.NewRequest("GET", "/test", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "container", w.Body.String())
+
+	// the container's output is streamed into the process's logs
+	assert.Contains(t, string(logs.GetHistory()), "container llama-swap-org_container started")
+
+	process.Stop()
+	assert.Equal(t, StateStopped, process.CurrentState())
+	assert.Equal(t, []string{
+		"rm --force llama-swap-org_container",
+		fmt.Sprintf("run --rm --name llama-swap-org_container --label llama-swap.model=org/container --network host --volume /models:/models:ro --env MODEL=qwen --gpus all test/image:latest --port %d --silent --respond container", port),
+		"stop --time 10 llama-swap-org_container",
+	}, calls())
+
+	// the container port is published on the model's port
+	modelConfig.Cmd = ""
+	modelConfig.Port = port
+	modelConfig.Container = config.ContainerConfig{Image: "vllm/vllm-openai", Port: 8000, Devices: []string{"/dev/dri"}}
+	process = NewProcess("vllm", 5, modelConfig, debugLogger, debugLogger)
+	args, err := process.config.SanitizedCommand()
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{
+			"docker", "run", "--rm", "--name", "llama-swap-vllm", "--label", "llama-swap.model=vllm",
+			"--publish", fmt.Sprintf("127.0.0.1:%d:8000", port), "--device", "/dev/dri", "vllm/vllm-openai",
+		}, process.containerCommand(args))
+	}
+}
+
+func TestProxyManager_RemovesOrphanedContainers(t *testing.T) {
+	runtime, calls := fakeContainerRuntime(t)
+
+	modelConfig := getTestSimpleResponderConfig("model1")
+	modelConfig.Container = config.ContainerConfig{Image: "test/image:latest", Runtime: runtime}
+	proxy := New(config.AddDefaultGroupToConfig(config.Config{
+		HealthCheckTimeout: 15,
+		Models:             map[string]config.ModelConfig{"model1": modelConfig},
+		LogLevel:           "error",
+	}))
+	defer proxy.StopProcesses(StopWaitForInflightRequest)
+
+	// the container of another llama-swap is kept
+	assert.Equal(t, []string{
+		"ps --all --filter label=llama-swap.model --format {{.Names}}",
+		"rm --force llama-swap-model1",
+	}, calls())
+}
@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mostlygeek/llama-swap/proxy/config"
+)
+
+// errDrainTimeout cancels the in-flight requests of a process that did not finish
+// within its drainTimeout
+var errDrainTimeout = errors.New("the model is being unloaded")
+
+// startDrain marks the process as draining until the returned function is called.
+// Requests that arrive while draining are queued or rejected, see waitForDrain().
+func (p *Process) startDrain() func() {
+	p.drainMutex.Lock()
+	defer p.drainMutex.Unlock()
+
+	// another Stop() is already draining
+	if p.drainDone != nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	p.drainDone = done
+	return func() {
+		p.drainMutex.Lock()
+		p.drainDone = nil
+		p.drainMutex.Unlock()
+		close(done)
+	}
+}
+
+// draining returns a channel that is closed when the drain is over, nil when the
+// process is not draining
+func (p *Process) draining() chan struct{} {
+	p.drainMutex.Lock()
+	defer p.drainMutex.Unlock()
+	return p.drainDone
+}
+
+// rejectWhileDraining writes a 503 when the process is draining and its drainPolicy
+// is reject. It returns true when the request was rejected.
+func (p *Process) rejectWhileDraining(w http.ResponseWriter) bool {
+	if p.config.DrainPolicy != config.DrainPolicyReject || p.draining() == nil {
+		return false
+	}
+	http.Error(w, fmt.Sprintf("%s is being unloaded", p.ID), http.StatusServiceUnavailable)
+	return true
+}
+
+// waitForDrain queues a request that arrived while the process is draining until the
+// process has stopped. It returns false when the request was rejected or the client
+// went away.
+func (p *Process) waitForDrain(w http.ResponseWriter, r *http.Request) bool {
+	if p.rejectWhileDraining(w) {
+		return false
+	}
+
+	done := p.draining()
+	if done == nil {
+		return true
+	}
+
+	p.proxyLogger.Debugf("<%s> Request queued until the process has stopped", p.ID)
+	select {
+	case <-done:
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// waitForInFlightRequests waits for the in-flight requests to finish. Once the
+// drainTimeout has passed the remaining requests are cancelled.
+func (p *Process) waitForInFlightRequests() {
+	if p.drainTimeout <= 0 {
+		p.inFlightRequests.Wait()
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		p.inFlightRequests.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(p.drainTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return
+	case <-timer.C:
+	}
+
+	p.proxyLogger.Warnf("<%s> Cancelling %d in-flight requests, drainTimeout of %v reached", p.ID, p.inFlightRequestsCount.Load(), p.drainTimeout)
+	p.inFlightMutex.Lock()
+	for _, cancel := range p.inFlightCancels {
+		cancel(errDrainTimeout)
+	}
+	p.inFlightMutex.Unlock()
+	<-done
+}
+
+// trackInFlight returns a request that is cancelled when the drainTimeout is reached
+// and a function to call once the request is done
+func (p *Process) trackInFlight(r *http.Request) (*http.Request, func()) {
+	ctx, cancel := context.WithCancelCause(r.Context())
+	r = r.WithContext(ctx)
+
+	p.inFlightMutex.Lock()
+	p.inFlightCancels[r] = cancel
+	p.inFlightMutex.Unlock()
+
+	return r, func() {
+		p.inFlightMutex.Lock()
+		delete(p.inFlightCancels, r)
+		p.inFlightMutex.Unlock()
+		cancel(nil)
+	}
+}
+
+// sendDrainError ends a streaming response that was cancelled by the drainTimeout
+// with an SSE error chunk. Responses that were not streaming already got a 503 from
+// the reverse proxy's ErrorHandler.
+func (p *Process) sendDrainError(w http.ResponseWriter, r *http.Request) {
+	if !errors.Is(context.Cause(r.Context()), errDrainTimeout) {
+		return
+	}
+	if !strings.Contains(strings.ToLower(w.Header().Get("Content-Type")), "text/event-stream") {
+		return
+	}
+
+	type errorBody struct {
+		Message string `json:"message"`
+		Type    string `json:"type"`
+		Code    int    `json:"code"`
+	}
+	data, err := json.Marshal(map[string]errorBody{"error": {
+		Message: fmt.Sprintf("request cancelled, %s is being unloaded", p.ID),
+		Type:    "server_error",
+		Code:    http.StatusServiceUnavailable,
+	}})
+	if err != nil {
+		return
+	}
+
+	if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+		return
+	}
+	_ = http.NewResponseController(w).Flush()
+}
+
+// proxyErrorHandler replaces the reverse proxy's default ErrorHandler so requests
+// cancelled by the drainTimeout get a 503 instead of a 502
+func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(context.Cause(r.Context()), errDrainTimeout) {
+		http.Error(w, "request cancelled, the model is being unloaded", http.StatusServiceUnavailable)
+		return
+	}
+
+	// same as httputil.ReverseProxy's default
+	log.Printf("http: proxy error: %v", err)
+	w.WriteHeader(http.StatusBadGateway)
+}
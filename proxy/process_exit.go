@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// how much of the process's output is kept in an ExitRecord
+const exitLogBytes = 1024
+
+// ExitRecord describes the last time the upstream command of a process exited
+type ExitRecord struct {
+	ExitCode int `json:"exitCode"`
+
+	// signal that killed the command, empty when it exited by itself
+	Signal string `json:"signal,omitempty"`
+
+	// state of the process when the command exited
+	State ProcessState `json:"state"`
+
+	Time time.Time `json:"time"`
+
+	// how long the command ran
+	DurationMs int64 `json:"durationMs"`
+
+	// the last KB of the command's output
+	Logs string `json:"logs"`
+}
+
+// recordExit saves how the command exited, see LastExit()
+func (p *Process) recordExit(exitErr error, exitCode int, state ProcessState) {
+	record := &ExitRecord{
+		ExitCode: exitCode,
+		State:    state,
+		Time:     time.Now(),
+		Logs:     string(p.processLogger.TailBytes(exitLogBytes)),
+	}
+
+	var exitError *exec.ExitError
+	if errors.As(exitErr, &exitError) {
+		if status, ok := exitError.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			record.Signal = status.Signal().String()
+		}
+	}
+
+	p.cmdMutex.RLock()
+	if !p.cmdStartTime.IsZero() {
+		record.DurationMs = record.Time.Sub(p.cmdStartTime).Milliseconds()
+	}
+	p.cmdMutex.RUnlock()
+
+	p.lastExitMutex.Lock()
+	p.lastExit = record
+	p.lastExitMutex.Unlock()
+}
+
+// LastExit returns how the command last exited, nil when it has not exited yet
+func (p *Process) LastExit() *ExitRecord {
+	p.lastExitMutex.RLock()
+	defer p.lastExitMutex.RUnlock()
+	return p.lastExit
+}
+
+// exitedSince returns the ExitRecord when the command exited after t
+func (p *Process) exitedSince(t time.Time) *ExitRecord {
+	if record := p.LastExit(); record != nil && !record.Time.Before(t) {
+		return record
+	}
+	return nil
+}
+
+// String describes the exit for error messages
+func (e *ExitRecord) String() string {
+	var sb strings.Builder
+	if e.Signal != "" {
+		fmt.Fprintf(&sb, "killed by signal: %s\n", e.Signal)
+	} else {
+		fmt.Fprintf(&sb, "exit code: %d\n", e.ExitCode)
+	}
+	fmt.Fprintf(&sb, "exited at: %s, after running for %v\n", e.Time.Format(time.RFC3339), time.Duration(e.DurationMs)*time.Millisecond)
+	if e.Logs != "" {
+		fmt.Fprintf(&sb, "last output:\n%s\n", e.Logs)
+	}
+	return sb.String()
+}
@@ -0,0 +1,214 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mostlygeek/llama-swap/proxy/config"
+)
+
+// the most of a health check response read to match healthCheck.expect
+const maxHealthCheckBody = 1 << 20
+
+// healthChecker checks an upstream once
+type healthChecker struct {
+	// what is checked, for logging
+	target string
+	check  func() error
+}
+
+// newHealthChecker creates the check configured for the process. It returns nil
+// when the process is not checked.
+func (p *Process) newHealthChecker() (*healthChecker, error) {
+	hc := p.config.HealthCheckSettings()
+	timeout := time.Duration(hc.Timeout) * time.Second
+	proxyTo, _ := p.upstream()
+
+	switch hc.Type {
+	case config.HealthCheckNone:
+		return nil, nil
+
+	case config.HealthCheckTCP:
+		address, err := upstreamAddress(proxyTo)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the health check address from proxy=%s: %v", proxyTo, err)
+		}
+		return &healthChecker{
+			target: "tcp://" + address,
+			check: func() error {
+				conn, err := net.DialTimeout("tcp", address, timeout)
+				if err != nil {
+					return err
+				}
+				return conn.Close()
+			},
+		}, nil
+
+	case config.HealthCheckCommand:
+		command := hc.Command
+		if p.config.DynamicPort {
+			command = strings.ReplaceAll(command, "${PORT}", strconv.Itoa(p.Port()))
+		}
+		args, err := config.SanitizeCommand(command)
+		if err != nil {
+			return nil, fmt.Errorf("failed to sanitize health check command: %v", err)
+		}
+		return &healthChecker{
+			target: p.config.Redact(strings.Join(args, " ")),
+			check:  func() error { return p.runCommand(args, timeout) },
+		}, nil
+
+	default:
+		healthURL, err := url.JoinPath(proxyTo, hc.Path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create health check URL proxy=%s and checkEndpoint=%s", proxyTo, hc.Path)
+		}
+
+		var expect func([]byte) bool
+		if hc.Expect != "" {
+			if expect, err = config.ParseHealthExpect(hc.Expect); err != nil {
+				return nil, err
+			}
+		}
+		return &healthChecker{
+			target: healthURL,
+			check: func() error {
+				return checkHealthEndpoint(healthURL, timeout, hc.Expect, expect)
+			},
+		}, nil
+	}
+}
+
+// checkHealthEndpoint requires an HTTP 200 from healthURL and, when expect is set,
+// a response body it matches
+func checkHealthEndpoint(healthURL string, timeout time.Duration, expectStr string, expect func([]byte) bool) error {
+	client := &http.Client{
+		// wait a short time for a tcp connection to be established
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout: 500 * time.Millisecond,
+			}).DialContext,
+		},
+
+		// give a long time to respond to the health check endpoint
+		// after the connection is established. See issue: 276
+		Timeout: timeout,
+	}
+
+	req, err := http.NewRequest("GET", healthURL, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// got a response but it was not an OK
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status code: %d", resp.StatusCode)
+	}
+
+	if expect != nil {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthCheckBody))
+		if err != nil {
+			return err
+		}
+		if !expect(body) {
+			return fmt.Errorf("response does not match %s", expectStr)
+		}
+	}
+
+	return nil
+}
+
+// runCommand requires the command to exit with 0 within timeout, used by health checks
+// and hooks
+func (p *Process) runCommand(args []string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = p.processLogger
+	cmd.Stderr = p.processLogger
+	cmd.Env = append(cmd.Environ(), p.config.Env...)
+	setProcAttributes(cmd)
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("timed out after %v", timeout)
+		}
+		return err
+	}
+	return nil
+}
+
+// upstreamAddress returns the host:port of an upstream URL
+func upstreamAddress(proxyTo string) (string, error) {
+	proxyURL, err := url.Parse(proxyTo)
+	if err != nil {
+		return "", err
+	}
+	if proxyURL.Host == "" {
+		return "", fmt.Errorf("no host")
+	}
+	if proxyURL.Port() != "" {
+		return proxyURL.Host, nil
+	}
+	if proxyURL.Scheme == "https" {
+		return net.JoinHostPort(proxyURL.Hostname(), "443"), nil
+	}
+	return net.JoinHostPort(proxyURL.Hostname(), "80"), nil
+}
+
+// livenessLoop runs the health check while the process is ready. The process is
+// stopped when the check fails healthCheck.liveness.failures times in a row.
+func (p *Process) livenessLoop(healthChecker *healthChecker) {
+	liveness := p.config.HealthCheckSettings().Liveness
+
+	// the loop belongs to this run of the command
+	p.cmdMutex.RLock()
+	cmdWaitChan := p.cmdWaitChan
+	p.cmdMutex.RUnlock()
+
+	failures := 0
+	ticker := time.NewTicker(p.livenessInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cmdWaitChan:
+			return
+		case <-ticker.C:
+		}
+
+		if p.CurrentState() != StateReady {
+			return
+		}
+
+		err := healthChecker.check()
+		if err == nil {
+			failures = 0
+			continue
+		}
+
+		failures++
+		p.proxyLogger.Warnf("<%s> Liveness check failed on %s (%d/%d): %v", p.ID, healthChecker.target, failures, liveness.Failures, err)
+		if failures >= liveness.Failures {
+			reason := fmt.Sprintf("liveness check failed %d times: %v", failures, err)
+			p.proxyLogger.Errorf("<%s> Stopping process, %s", p.ID, reason)
+			p.stopWithReason(reason)
+			return
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mostlygeek/llama-swap/proxy/config"
+)
+
+// how long a hook can take when it has no timeout
+const defaultHookTimeout = 30 * time.Second
+
+// hookEvent is the JSON body sent to webhooks
+type hookEvent struct {
+	Event string `json:"event"`
+	Model string `json:"model"`
+	Port  int    `json:"port,omitempty"`
+	PID   int    `json:"pid,omitempty"`
+
+	// how the command exited, for afterStop and onCrash
+	Exit *ExitRecord `json:"exit,omitempty"`
+}
+
+// runHooks runs the hooks of an event one after the other and returns the error of
+// the first one that fails. pid is 0 when the command is not running.
+func (p *Process) runHooks(name string, hooks []config.Hook, pid int) error {
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	replacer := strings.NewReplacer(
+		"${MODEL_ID}", p.ID,
+		"${PORT}", strconv.Itoa(p.Port()),
+		"${PID}", strconv.Itoa(pid),
+	)
+	event := hookEvent{Event: name, Model: p.ID, Port: p.Port(), PID: pid}
+	if name == "afterStop" || name == "onCrash" {
+		event.Exit = p.LastExit()
+	}
+
+	for i, hook := range hooks {
+		timeout := defaultHookTimeout
+		if hook.Timeout > 0 {
+			timeout = time.Duration(hook.Timeout) * time.Second
+		}
+
+		var err error
+		if hook.Command != "" {
+			var args []string
+			if args, err = config.SanitizeCommand(replacer.Replace(hook.Command)); err == nil {
+				p.proxyLogger.Debugf("<%s> Running %s hook: %s", p.ID, name, p.config.Redact(strings.Join(args, " ")))
+				err = p.runCommand(args, timeout)
+			}
+		} else {
+			url := replacer.Replace(hook.URL)
+			p.proxyLogger.Debugf("<%s> Calling %s webhook: %s", p.ID, name, p.config.Redact(url))
+			err = callWebhook(url, event, timeout)
+		}
+		if err != nil {
+			return fmt.Errorf("%s hook %d failed: %v", name, i, err)
+		}
+	}
+	return nil
+}
+
+// runHooksInBackground runs the hooks of an event without waiting for them, failures
+// are logged
+func (p *Process) runHooksInBackground(name string, hooks []config.Hook, pid int) {
+	if len(hooks) == 0 {
+		return
+	}
+	go func() {
+		if err := p.runHooks(name, hooks, pid); err != nil {
+			p.proxyLogger.Errorf("<%s> %v", p.ID, err)
+		}
+	}()
+}
+
+// callWebhook POSTs the event to url and requires a 2xx response within timeout
+func callWebhook(url string, event hookEvent, timeout time.Duration) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("timed out after %v", timeout)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
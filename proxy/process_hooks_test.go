@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mostlygeek/llama-swap/proxy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcess_BeforeStartVeto(t *testing.T) {
+	modelConfig := getTestSimpleResponderConfig("veto")
+	modelConfig.Hooks.BeforeStart = []config.Hook{
+		{Command: fmt.Sprintf("%s --no-such-flag", filepath.ToSlash(simpleResponderPath))},
+	}
+	process := NewProcess("veto", 5, modelConfig, debugLogger, debugLogger)
+	defer process.Stop()
+
+	w := httptest.NewRecorder()
+	process.ProxyRequest(w, httptest.NewRequest("GET", "/test", nil))
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Contains(t, w.Body.String(), "beforeStart hook 0 failed")
+	assert.Equal(t, StateStopped, process.CurrentState())
+
+	// the upstream command never ran
+	assert.Nil(t, process.LastExit())
+}
+
+func TestProcess_Webhooks(t *testing.T) {
+	var mu sync.Mutex
+	var events []hookEvent
+	veto := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e hookEvent
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e)
+		if e.Event == "beforeStart" && veto {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	waitForEvents := func(names ...string) []hookEvent {
+		t.Helper()
+		var received []hookEvent
+		assert.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			received = append([]hookEvent{}, events...)
+			return len(received) >= len(names)
+		}, 5*time.Second, 10*time.Millisecond)
+		for i, name := range names {
+			if assert.Greater(t, len(received), i) {
+				assert.Equal(t, name, received[i].Event)
+			}
+		}
+		return received
+	}
+
+	webhook := []config.Hook{{URL: server.URL + "/${MODEL_ID}?port=${PORT}"}}
+	modelConfig := getTestSimpleResponderConfig("hooks")
+	modelConfig.Hooks = config.LifecycleHooks{
+		BeforeStart: webhook,
+		AfterReady:  webhook,
+		AfterStop:   webhook,
+		OnCrash:     webhook,
+	}
+	process := NewProcess("hooks", 5, modelConfig, debugLogger, debugLogger)
+	defer process.Stop()
+
+	// a webhook without a 2xx response vetoes the start
+	w := httptest.NewRecorder()
+	process.ProxyRequest(w, httptest.NewRequest("GET", "/test", nil))
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Contains(t, w.Body.String(), "webhook responded with status 503")
+	waitForEvents("beforeStart")
+
+	mu.Lock()
+	veto, events = false, nil
+	mu.Unlock()
+	w = httptest.NewRecorder()
+	process.ProxyRequest(w, httptest.NewRequest("GET", "/test", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	received := waitForEvents("beforeStart", "afterReady")
+	pid := process.cmd.Process.Pid
+	assert.Equal(t, hookEvent{Event: "beforeStart", Model: "hooks", Port: process.Port()}, received[0])
+	assert.Equal(t, hookEvent{Event: "afterReady", Model: "hooks", Port: process.Port(), PID: pid}, received[1])
+
+	// stopped by llama-swap
+	process.Stop()
+	received = waitForEvents("beforeStart", "afterReady", "afterStop")
+	assert.Equal(t, pid, received[2].PID)
+	assert.NotNil(t, received[2].Exit)
+
+	// exited on its own
+	mu.Lock()
+	events = nil
+	mu.Unlock()
+	process.ProxyRequest(httptest.NewRecorder(), httptest.NewRequest("GET", "/test", nil))
+	waitForEvents("beforeStart", "afterReady")
+	assert.NoError(t, process.cmd.Process.Kill())
+	received = waitForEvents("beforeStart", "afterReady", "onCrash")
+	if assert.NotNil(t, received[2].Exit) {
+		assert.Equal(t, StateReady, received[2].Exit.State)
+	}
+}
@@ -0,0 +1,210 @@
+//go:build linux
+
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/mostlygeek/llama-swap/proxy/config"
+)
+
+const defaultCgroupParent = "/sys/fs/cgroup/llama-swap"
+
+// cgroup period of cpu.max in microseconds
+const cgroupCPUPeriod = 100000
+
+var cgroupNameRegex = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+
+// LimitsShimArg is the first argument when llama-swap runs itself as the shim that sets
+// the rlimits of an upstream before it executes the upstream's cmd, see RunLimitsShim
+const LimitsShimArg = "__limits"
+
+// rlimits in the order the shim sets them, the address space is limited last so the
+// shim is not limited by it
+var rlimitResources = []struct {
+	name     string
+	resource int
+}{
+	{"openFiles", syscall.RLIMIT_NOFILE},
+	{"memory", syscall.RLIMIT_AS},
+}
+
+// processLimits applies a model's limits to its upstream process
+type processLimits struct {
+	limits config.LimitsConfig
+
+	// the process's cgroup, empty without one
+	cgroup   string
+	cgroupFD *os.File
+}
+
+// prepareLimits creates the cgroup of the process so cmd starts in it. With rlimits cmd
+// runs through the llama-swap executable, which sets them before it executes the
+// upstream so the upstream and every process it forks start with them.
+func prepareLimits(cmd *exec.Cmd, id string, limits config.LimitsConfig) (*processLimits, error) {
+	l := &processLimits{limits: limits}
+	if err := wrapWithLimitsShim(cmd, limits); err != nil {
+		return nil, err
+	}
+	if limits.Cgroup.CPUs == 0 && limits.Cgroup.MemoryMax == 0 {
+		return l, nil
+	}
+
+	parent := limits.Cgroup.Parent
+	if parent == "" {
+		parent = defaultCgroupParent
+	}
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create cgroup %s: %w", parent, err)
+	}
+	if _, err := os.Stat(filepath.Join(parent, "cgroup.controllers")); err != nil {
+		return nil, fmt.Errorf("%s is not in a cgroup v2 hierarchy", parent)
+	}
+
+	// the controllers have to be enabled for the children of the parent
+	if err := os.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte("+cpu +memory"), 0); err != nil {
+		return nil, fmt.Errorf("unable to enable the cpu and memory controllers in %s: %w", parent, err)
+	}
+
+	dir := filepath.Join(parent, cgroupNameRegex.ReplaceAllString(id, "_"))
+	if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+		return nil, fmt.Errorf("unable to create cgroup %s: %w", dir, err)
+	}
+
+	cpuMax := "max " + strconv.Itoa(cgroupCPUPeriod)
+	if limits.Cgroup.CPUs > 0 {
+		cpuMax = fmt.Sprintf("%d %d", int(limits.Cgroup.CPUs*cgroupCPUPeriod), cgroupCPUPeriod)
+	}
+	memoryMax := "max"
+	if limits.Cgroup.MemoryMax > 0 {
+		memoryMax = strconv.Itoa(limits.Cgroup.MemoryMax * 1024 * 1024)
+	}
+	for file, value := range map[string]string{"cpu.max": cpuMax, "memory.max": memoryMax} {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(value), 0); err != nil {
+			return nil, fmt.Errorf("unable to set %s of cgroup %s: %w", file, dir, err)
+		}
+	}
+
+	fd, err := os.Open(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open cgroup %s: %w", dir, err)
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(fd.Fd())
+
+	l.cgroup = dir
+	l.cgroupFD = fd
+	return l, nil
+}
+
+// started closes the cgroup once the process has started in it
+func (l *processLimits) started(pid int) error {
+	if l.cgroupFD != nil {
+		l.cgroupFD.Close()
+		l.cgroupFD = nil
+	}
+	return nil
+}
+
+// exited removes the cgroup of the process after it has exited
+func (l *processLimits) exited() error {
+	if l.cgroupFD != nil {
+		l.cgroupFD.Close()
+		l.cgroupFD = nil
+	}
+	if l.cgroup == "" {
+		return nil
+	}
+	if err := os.Remove(l.cgroup); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to remove cgroup %s: %w", l.cgroup, err)
+	}
+	return nil
+}
+
+// wrapWithLimitsShim changes cmd to run the llama-swap executable as a shim that sets the
+// rlimits and then executes the original command, see RunLimitsShim
+func wrapWithLimitsShim(cmd *exec.Cmd, limits config.LimitsConfig) error {
+	values := map[string]uint64{
+		"openFiles": uint64(limits.OpenFiles),
+		"memory":    uint64(limits.Memory) * 1024 * 1024,
+	}
+	var shimArgs []string
+	for _, r := range rlimitResources {
+		if values[r.name] > 0 {
+			shimArgs = append(shimArgs, fmt.Sprintf("%s=%d", r.name, values[r.name]))
+		}
+	}
+
+	// cmd.Start reports a command that was not found
+	if len(shimArgs) == 0 || cmd.Err != nil {
+		return nil
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("unable to find the llama-swap executable to set the limits: %w", err)
+	}
+	shimArgs = append([]string{executable, LimitsShimArg}, shimArgs...)
+	cmd.Args = append(append(shimArgs, "--", cmd.Path), cmd.Args...)
+	cmd.Path = executable
+	return nil
+}
+
+// RunLimitsShim sets the rlimits in args and replaces the process with the command
+// after them. args are "name=value" rlimits followed by "--", the path of the command
+// and its arguments. It only returns when the limits or the command fail.
+func RunLimitsShim(args []string, stderr io.Writer) int {
+	for i, arg := range args {
+		if arg != "--" {
+			continue
+		}
+		if len(args) < i+3 {
+			break
+		}
+		if err := setRlimits(args[:i]); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		err := syscall.Exec(args[i+1], args[i+2:], os.Environ())
+		fmt.Fprintf(stderr, "unable to execute %s: %v\n", args[i+1], err)
+		return 1
+	}
+	fmt.Fprintf(stderr, "Usage: llama-swap %s [name=value ...] -- path arg0 [args ...]\n", LimitsShimArg)
+	return 2
+}
+
+func setRlimits(limits []string) error {
+	values := make(map[string]uint64, len(limits))
+	for _, limit := range limits {
+		name, value, _ := strings.Cut(limit, "=")
+		v, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid limit %s: %w", limit, err)
+		}
+		values[name] = v
+	}
+
+	for _, r := range rlimitResources {
+		value, found := values[r.name]
+		if !found {
+			continue
+		}
+		// syscall.Setrlimit, the runtime restores the open files limit it raised at
+		// startup on exec unless it was set through syscall
+		if err := syscall.Setrlimit(r.resource, &syscall.Rlimit{Cur: value, Max: value}); err != nil {
+			return fmt.Errorf("unable to set limits.%s: %w", r.name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+//go:build linux
+
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcess_WorkingDirAndLimits(t *testing.T) {
+	dir := t.TempDir()
+
+	// relative paths in cmd are relative to the working directory
+	responder, err := filepath.Abs(simpleResponderPath)
+	if !assert.NoError(t, err) {
+		return
+	}
+	config := getTestSimpleResponderConfig("limits")
+	config.Cmd = strings.Replace(config.Cmd, filepath.ToSlash(simpleResponderPath), responder, 1)
+	config.WorkingDir = dir
+	config.Limits.OpenFiles = 512
+	config.Limits.Memory = 64 * 1024
+
+	process := NewProcess("limits", 5, config, debugLogger, debugLogger)
+	defer process.Stop()
+	if !assert.NoError(t, process.start()) {
+		return
+	}
+
+	pid := process.cmd.Process.Pid
+	cwd, err := os.Readlink(fmt.Sprintf("/proc/%d/cwd", pid))
+	if assert.NoError(t, err) {
+		assert.Equal(t, dir, cwd)
+	}
+
+	limits, err := os.ReadFile(fmt.Sprintf("/proc/%d/limits", pid))
+	if assert.NoError(t, err) {
+		for _, line := range strings.Split(string(limits), "\n") {
+			fields := strings.Fields(line)
+			switch {
+			case strings.HasPrefix(line, "Max open files"):
+				assert.Equal(t, []string{"512", "512"}, fields[3:5])
+			case strings.HasPrefix(line, "Max address space"):
+				assert.Equal(t, []string{"68719476736", "68719476736"}, fields[3:5])
+			}
+		}
+	}
+}
+
+func TestProcess_Cgroup(t *testing.T) {
+	parent := filepath.Join("/sys/fs/cgroup", fmt.Sprintf("llama-swap-test-%d", os.Getpid()))
+	if err := os.Mkdir(parent, 0755); err != nil {
+		t.Skipf("unable to create a cgroup: %v", err)
+	}
+	defer os.Remove(parent)
+	if _, err := os.Stat(filepath.Join(parent, "cgroup.controllers")); err != nil {
+		t.Skip("cgroup v2 is not mounted at /sys/fs/cgroup")
+	}
+
+	config := getTestSimpleResponderConfig("cgroup")
+	config.Limits.Cgroup.Parent = parent
+	config.Limits.Cgroup.CPUs = 1.5
+	config.Limits.Cgroup.MemoryMax = 512
+
+	process := NewProcess("cgroup/model", 5, config, debugLogger, debugLogger)
+	if !assert.NoError(t, process.start()) {
+		return
+	}
+
+	cgroup := filepath.Join(parent, "cgroup_model")
+	procs, err := os.ReadFile(filepath.Join(cgroup, "cgroup.procs"))
+	if assert.NoError(t, err) {
+		assert.Contains(t, strings.Fields(string(procs)), fmt.Sprint(process.cmd.Process.Pid))
+	}
+	cpuMax, _ := os.ReadFile(filepath.Join(cgroup, "cpu.max"))
+	assert.Equal(t, "150000 100000", strings.TrimSpace(string(cpuMax)))
+	memoryMax, _ := os.ReadFile(filepath.Join(cgroup, "memory.max"))
+	assert.Equal(t, "536870912", strings.TrimSpace(string(memoryMax)))
+
+	// the cgroup is removed once the process has exited
+	process.Stop()
+	assert.NoDirExists(t, cgroup)
+}
+
+func TestProcess_LimitsBeforeExec(t *testing.T) {
+	dir := t.TempDir()
+	responder, err := filepath.Abs(simpleResponderPath)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// the upstream reads its limit before it does anything else
+	script := filepath.Join(dir, "upstream")
+	content := fmt.Sprintf("#!/bin/sh\nulimit -n > %s/openfiles\nexec %s \"$@\"\n", dir, responder)
+	if err := os.WriteFile(script, []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	config := getTestSimpleResponderConfig("limits")
+	config.Cmd = strings.Replace(config.Cmd, filepath.ToSlash(simpleResponderPath), script, 1)
+	config.Limits.OpenFiles = 256
+
+	process := NewProcess("limits", 5, config, debugLogger, debugLogger)
+	defer process.Stop()
+	if !assert.NoError(t, process.start()) {
+		return
+	}
+
+	openFiles, err := os.ReadFile(filepath.Join(dir, "openfiles"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "256", strings.TrimSpace(string(openFiles)))
+	}
+
+	// the shim is replaced by the upstream
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", process.cmd.Process.Pid))
+	if assert.NoError(t, err) {
+		assert.Equal(t, responder, strings.Split(string(cmdline), "\x00")[0])
+	}
+}
+
+func TestRunLimitsShim(t *testing.T) {
+	var stderr strings.Builder
+	assert.Equal(t, 2, RunLimitsShim([]string{"openFiles=256"}, &stderr))
+	assert.Contains(t, stderr.String(), "Usage: llama-swap __limits")
+
+	stderr.Reset()
+	assert.Equal(t, 1, RunLimitsShim([]string{"openFiles=many", "--", "/bin/true", "true"}, &stderr))
+	assert.Contains(t, stderr.String(), "invalid limit openFiles=many")
+}
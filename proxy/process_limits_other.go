@@ -0,0 +1,35 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+
+	"github.com/mostlygeek/llama-swap/proxy/config"
+)
+
+// LimitsShimArg is the first argument of the shim that sets the rlimits of an upstream
+const LimitsShimArg = "__limits"
+
+// processLimits is a no-op, limits are only applied on Linux
+type processLimits struct{}
+
+// RunLimitsShim is only used on Linux
+func RunLimitsShim(args []string, stderr io.Writer) int {
+	fmt.Fprintln(stderr, "limits are only supported on Linux")
+	return 1
+}
+
+func prepareLimits(cmd *exec.Cmd, id string, limits config.LimitsConfig) (*processLimits, error) {
+	return &processLimits{}, nil
+}
+
+func (l *processLimits) started(pid int) error {
+	return nil
+}
+
+func (l *processLimits) exited() error {
+	return nil
+}
@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultQueueTimeout = 60 * time.Second
+
+var (
+	errQueueFull    = errors.New("queue is full")
+	errQueueTimeout = errors.New("timed out waiting in the queue")
+)
+
+// queueStats is filled in by Process.ProxyRequest for the request's TokenMetrics
+type queueStats struct {
+	// requests that were waiting when the request arrived
+	depth int
+	wait  time.Duration
+}
+
+// queuedRequest is a request waiting for a slot
+type queuedRequest struct {
+	priority int
+
+	// closed when the request is handed a slot
+	ready   chan struct{}
+	granted bool
+}
+
+// requestQueue hands out a process's concurrencyLimit slots. When all slots are taken
+// requests wait for one by priority, then in the order they arrived.
+type requestQueue struct {
+	mu sync.Mutex
+
+	// a slot is taken while a value is in the channel
+	slots   chan struct{}
+	maxSize int
+	timeout time.Duration
+	waiting []*queuedRequest
+
+	// moving average of how long a slot is held, for Retry-After
+	avgHold time.Duration
+}
+
+func newRequestQueue(slots chan struct{}, maxSize int, timeout time.Duration) *requestQueue {
+	return &requestQueue{
+		slots:   slots,
+		maxSize: maxSize,
+		timeout: timeout,
+	}
+}
+
+// acquire takes a slot, waiting in the queue when none is free. It returns the number
+// of requests that were already waiting.
+func (q *requestQueue) acquire(ctx context.Context, priority int) (int, error) {
+	q.mu.Lock()
+
+	// requests that are already waiting go first
+	depth := len(q.waiting)
+	if depth == 0 {
+		select {
+		case q.slots <- struct{}{}:
+			q.mu.Unlock()
+			return 0, nil
+		default:
+		}
+	}
+
+	if depth >= q.maxSize {
+		q.mu.Unlock()
+		return depth, errQueueFull
+	}
+
+	// behind every request with the same or a higher priority
+	req := &queuedRequest{priority: priority, ready: make(chan struct{})}
+	i := sort.Search(depth, func(i int) bool { return q.waiting[i].priority < priority })
+	q.waiting = append(q.waiting, nil)
+	copy(q.waiting[i+1:], q.waiting[i:])
+	q.waiting[i] = req
+	q.mu.Unlock()
+
+	timer := time.NewTimer(q.timeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-req.ready:
+		return depth, nil
+	case <-timer.C:
+		err = errQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// the slot was handed over while giving up, pass it on
+	if req.granted {
+		q.releaseLocked()
+		return depth, err
+	}
+	for i, waiting := range q.waiting {
+		if waiting == req {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			break
+		}
+	}
+	return depth, err
+}
+
+// release gives up a slot that was held for held. The next waiting request gets it.
+func (q *requestQueue) release(held time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.avgHold == 0 {
+		q.avgHold = held
+	} else {
+		q.avgHold = (q.avgHold*4 + held) / 5
+	}
+	q.releaseLocked()
+}
+
+func (q *requestQueue) releaseLocked() {
+	if len(q.waiting) > 0 {
+		next := q.waiting[0]
+		q.waiting = q.waiting[1:]
+		next.granted = true
+		close(next.ready)
+		return
+	}
+	<-q.slots
+}
+
+// depth is the number of requests waiting for a slot
+func (q *requestQueue) depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.waiting)
+}
+
+// retryAfter estimates the seconds until a new request would get a slot
+func (q *requestQueue) retryAfter() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	wait := q.avgHold * time.Duration(len(q.waiting)+1) / time.Duration(cap(q.slots))
+	return max(1, int(math.Ceil(wait.Seconds())))
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// waitForQueue waits until n requests are waiting in q
+func waitForQueue(t *testing.T, q *requestQueue, n int) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		return len(q.waiting) == n
+	}, time.Second, time.Millisecond)
+}
+
+func TestRequestQueue_Priority(t *testing.T) {
+	q := newRequestQueue(make(chan struct{}, 1), 10, time.Second)
+
+	depth, err := q.acquire(context.Background(), 0)
+	require.NoError(t, err)
+	assert.Equal(t, 0, depth)
+
+	var mu sync.Mutex
+	var order []string
+	var wg sync.WaitGroup
+	enqueue := func(name string, priority int, waiting int) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := q.acquire(context.Background(), priority); !assert.NoError(t, err) {
+				return
+			}
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			q.release(time.Millisecond)
+		}()
+		waitForQueue(t, q, waiting)
+	}
+
+	enqueue("low1", 0, 1)
+	enqueue("low2", 0, 2)
+	enqueue("high", 5, 3)
+
+	q.release(time.Millisecond)
+	wg.Wait()
+
+	assert.Equal(t, []string{"high", "low1", "low2"}, order)
+	assert.Len(t, q.slots, 0)
+}
+
+func TestRequestQueue_FullAndTimeout(t *testing.T) {
+	q := newRequestQueue(make(chan struct{}, 1), 1, 50*time.Millisecond)
+
+	_, err := q.acquire(context.Background(), 0)
+	require.NoError(t, err)
+
+	result := make(chan error)
+	go func() {
+		_, err := q.acquire(context.Background(), 0)
+		result <- err
+	}()
+	waitForQueue(t, q, 1)
+
+	depth, err := q.acquire(context.Background(), 0)
+	assert.ErrorIs(t, err, errQueueFull)
+	assert.Equal(t, 1, depth)
+
+	assert.ErrorIs(t, <-result, errQueueTimeout)
+	waitForQueue(t, q, 0)
+
+	// the slot is still held by the first request
+	assert.Len(t, q.slots, 1)
+	q.release(time.Second)
+	assert.Len(t, q.slots, 0)
+	assert.Equal(t, 1, q.retryAfter())
+}
+
+func TestRequestQueue_NoQueue(t *testing.T) {
+	q := newRequestQueue(make(chan struct{}, 1), 0, time.Second)
+
+	_, err := q.acquire(context.Background(), 0)
+	require.NoError(t, err)
+
+	_, err = q.acquire(context.Background(), 10)
+	assert.ErrorIs(t, err, errQueueFull)
+}
+
+func TestRequestQueue_ContextCanceled(t *testing.T) {
+	q := newRequestQueue(make(chan struct{}, 1), 1, time.Second)
+
+	_, err := q.acquire(context.Background(), 0)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	go func() {
+		_, err := q.acquire(ctx, 0)
+		result <- err
+	}()
+	waitForQueue(t, q, 1)
+
+	cancel()
+	assert.ErrorIs(t, <-result, context.Canceled)
+	waitForQueue(t, q, 0)
+}
@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"context"
+	"time"
+
+	"github.com/mostlygeek/llama-swap/event"
+	"github.com/mostlygeek/llama-swap/proxy/config"
+)
+
+const (
+	// how many lines of the process's output are in a ProcessCrashEvent
+	crashLogLines = 50
+
+	defaultMaxRestarts       = 5
+	defaultRestartWindow     = 10 * time.Minute
+	defaultRestartBackoff    = time.Second
+	defaultMaxRestartBackoff = time.Minute
+)
+
+// handleCrash is called when the upstream command exited without being stopped. It
+// emits a ProcessCrashEvent and restarts the process when its restartPolicy allows it.
+func (p *Process) handleCrash(state ProcessState, exitCode int) {
+	logs := string(p.processLogger.Tail(crashLogLines))
+	p.proxyLogger.Warnf("<%s> Process crashed while %s, exit code: %d", p.ID, state, exitCode)
+
+	// crashes while starting are returned to the request that started the process
+	restart, delay := false, time.Duration(0)
+	if state == StateReady && shouldRestart(p.config.RestartPolicy, exitCode) {
+		restart, delay = p.scheduleRestart()
+	}
+
+	event.Emit(ProcessCrashEvent{
+		ProcessName:  p.ID,
+		ExitCode:     exitCode,
+		State:        state,
+		Logs:         logs,
+		Restart:      restart,
+		RestartDelay: delay,
+	})
+
+	if keepWarm := p.keepWarm.Load(); keepWarm != nil && state == StateReady && !restart {
+		keepWarm.unloaded(p, true)
+	}
+}
+
+func shouldRestart(policy string, exitCode int) bool {
+	switch policy {
+	case config.RestartPolicyAlways:
+		return true
+	case config.RestartPolicyOnFailure:
+		return exitCode != 0
+	default:
+		return false
+	}
+}
+
+// scheduleRestart starts restarting the process after a backoff. It gives up when the
+// process was restarted maxRestarts times within the window.
+func (p *Process) scheduleRestart() (bool, time.Duration) {
+	maxRestarts, window := p.restartLimits()
+
+	p.restartMutex.Lock()
+	defer p.restartMutex.Unlock()
+
+	// forget about restarts outside of the window
+	now := time.Now()
+	recent := p.restartTimes[:0]
+	for _, t := range p.restartTimes {
+		if now.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	}
+	p.restartTimes = recent
+
+	if len(recent) >= maxRestarts {
+		p.proxyLogger.Errorf("<%s> Not restarting, it was restarted %d times in the last %v", p.ID, len(recent), window)
+		return false, 0
+	}
+
+	delay := p.restartBackoff(len(recent))
+	p.restartTimes = append(p.restartTimes, now)
+
+	if p.restartCancel != nil {
+		p.restartCancel()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p.restartCancel = cancel
+
+	go p.restart(ctx, delay)
+	return true, delay
+}
+
+// restart starts the process after delay. Failed starts are retried with a longer
+// backoff until failedStartCount reaches maxRestarts.
+func (p *Process) restart(ctx context.Context, delay time.Duration) {
+	maxRestarts, _ := p.restartLimits()
+
+	for {
+		p.proxyLogger.Infof("<%s> Restarting in %v", p.ID, delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		// a request started it or it was shut down in the meantime
+		if p.CurrentState() != StateStopped {
+			return
+		}
+
+		err := p.start()
+		if err == nil {
+			p.proxyLogger.Infof("<%s> Restarted after crash", p.ID)
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		p.proxyLogger.Errorf("<%s> Failed to restart: %v", p.ID, err)
+		if p.failedStartCount >= maxRestarts {
+			p.proxyLogger.Errorf("<%s> Not restarting, it failed to start %d times", p.ID, p.failedStartCount)
+			return
+		}
+
+		p.restartMutex.Lock()
+		delay = p.restartBackoff(len(p.restartTimes) - 1 + p.failedStartCount)
+		p.restartMutex.Unlock()
+	}
+}
+
+// cancelRestart stops a scheduled restart, it is called when the process is stopped
+func (p *Process) cancelRestart() {
+	p.restartMutex.Lock()
+	defer p.restartMutex.Unlock()
+
+	if p.restartCancel != nil {
+		p.restartCancel()
+		p.restartCancel = nil
+	}
+}
+
+func (p *Process) restartLimits() (maxRestarts int, window time.Duration) {
+	maxRestarts, window = defaultMaxRestarts, defaultRestartWindow
+	if p.config.Restart.MaxRestarts > 0 {
+		maxRestarts = p.config.Restart.MaxRestarts
+	}
+	if p.config.Restart.Window > 0 {
+		window = time.Duration(p.config.Restart.Window) * time.Second
+	}
+	return maxRestarts, window
+}
+
+// restartBackoff doubles the initial backoff for every previous attempt
+func (p *Process) restartBackoff(attempts int) time.Duration {
+	delay, maxDelay := defaultRestartBackoff, defaultMaxRestartBackoff
+	if p.config.Restart.Backoff > 0 {
+		delay = time.Duration(p.config.Restart.Backoff) * time.Second
+	}
+	if p.config.Restart.MaxBackoff > 0 {
+		maxDelay = time.Duration(p.config.Restart.MaxBackoff) * time.Second
+	}
+
+	for ; attempts > 0 && delay < maxDelay; attempts-- {
+		delay *= 2
+	}
+	return min(delay, maxDelay)
+}
@@ -0,0 +1,365 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// how often an adopted upstream is checked to see if it is still running, it is not a
+// child of llama-swap so its exit can not be waited for
+const adoptedPollInterval = 250 * time.Millisecond
+
+// the exit of an adopted upstream that was not stopped by llama-swap, its exit code is
+// not known
+var errAdoptedExited = errors.New("adopted upstream exited")
+
+// upstreamState is written to the stateDir while the upstream of a process runs so
+// the next llama-swap can adopt it instead of starting it again
+type upstreamState struct {
+	PID         int    `json:"pid"`
+	Port        int    `json:"port"`
+	CommandHash string `json:"commandHash"`
+}
+
+// adoptable is true when the process keeps the state of its upstream. Containers are
+// not adopted, they are removed and started again, see removeOrphanedContainers().
+func (p *Process) adoptable() bool {
+	return p.stateDir != "" && !p.config.Container.Enabled()
+}
+
+// stateFile is where the state of the upstream is kept
+func (p *Process) stateFile() string {
+	return filepath.Join(p.stateDir, p.safeInstanceName()+".json")
+}
+
+// logFile is where the upstream writes its output
+func (p *Process) logFile() string {
+	return filepath.Join(p.stateDir, p.safeInstanceName()+".log")
+}
+
+// openLogFile truncates and opens the logFile for the upstream
+func (p *Process) openLogFile() (*os.File, error) {
+	file, err := os.OpenFile(p.logFile(), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open the upstream log file: %v", err)
+	}
+	return file, nil
+}
+
+// commandHash identifies how the upstream was started, it is only adopted when it would
+// be started the same way again
+func (p *Process) commandHash(args []string) string {
+	hash := sha256.New()
+	for _, s := range slices.Concat(args, []string{p.config.WorkingDir}, p.config.Env) {
+		io.WriteString(hash, s)
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// listenPort is the port of the upstream's proxy URL, cmd may not use ${PORT}
+func (p *Process) listenPort() int {
+	proxyTo, _ := p.upstream()
+	address, err := upstreamAddress(proxyTo)
+	if err != nil {
+		return 0
+	}
+	_, port, _ := net.SplitHostPort(address)
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+// writeState saves the state of the upstream started with args
+func (p *Process) writeState(args []string, pid int) {
+	data, err := json.Marshal(upstreamState{PID: pid, Port: p.listenPort(), CommandHash: p.commandHash(args)})
+	if err == nil {
+		err = os.WriteFile(p.stateFile(), data, 0644)
+	}
+	if err != nil {
+		p.proxyLogger.Warnf("<%s> Unable to write the upstream state: %v", p.ID, err)
+	}
+}
+
+// removeState removes the state of the upstream once it exited
+func (p *Process) removeState() {
+	if err := os.Remove(p.stateFile()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		p.proxyLogger.Warnf("<%s> Unable to remove the upstream state: %v", p.ID, err)
+	}
+}
+
+func readUpstreamState(path string) (upstreamState, error) {
+	var state upstreamState
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("invalid state file %s: %v", path, err)
+	}
+	return state, nil
+}
+
+// leftRunning returns the state of the upstream a previous llama-swap left running
+func (p *Process) leftRunning() (upstreamState, bool) {
+	if !p.adoptable() {
+		return upstreamState{}, false
+	}
+
+	state, err := readUpstreamState(p.stateFile())
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			p.proxyLogger.Warnf("<%s> %v", p.ID, err)
+			p.removeState()
+		}
+		return upstreamState{}, false
+	}
+	if !processAlive(state.PID) {
+		p.proxyLogger.Debugf("<%s> Upstream pid %d is no longer running", p.ID, state.PID)
+		p.removeState()
+		return upstreamState{}, false
+	}
+	return state, true
+}
+
+// stopLeftRunning stops the upstream a previous llama-swap left running
+func (p *Process) stopLeftRunning(state upstreamState, reason string) {
+	stopLeftRunning(p.ID, state, reason, p.gracefulStopTimeout, p.proxyLogger)
+	p.removeState()
+}
+
+// adopt makes the process ready with the upstream a previous llama-swap left running.
+// It is adopted when it was started with the same command and passes its health
+// check, otherwise it is stopped.
+func (p *Process) adopt() bool {
+	state, ok := p.leftRunning()
+	if !ok {
+		return false
+	}
+
+	args, err := p.config.SanitizedCommandWithPort(state.Port)
+	if err != nil || state.CommandHash != p.commandHash(args) {
+		p.stopLeftRunning(state, "its command changed")
+		return false
+	}
+
+	if p.config.DynamicPort {
+		if err := dynamicPorts.reserve(p, state.Port); err != nil {
+			p.stopLeftRunning(state, err.Error())
+			return false
+		}
+		if _, err := p.useDynamicPort(state.Port); err != nil {
+			dynamicPorts.release(p)
+			p.stopLeftRunning(state, err.Error())
+			return false
+		}
+	}
+
+	healthChecker, err := p.newHealthChecker()
+	if err == nil && healthChecker != nil {
+		err = healthChecker.check()
+	}
+	upstream, findErr := os.FindProcess(state.PID)
+	if err == nil {
+		err = findErr
+	}
+	if err != nil {
+		if p.config.DynamicPort {
+			dynamicPorts.release(p)
+		}
+		p.stopLeftRunning(state, fmt.Sprintf("its health check failed: %v", err))
+		return false
+	}
+
+	if _, err := p.swapState(StateStopped, StateStarting); err != nil {
+		return false
+	}
+	defer p.waitStarting.Done()
+
+	ctx, cancelUpstream := context.WithCancel(context.Background())
+	p.cmdMutex.Lock()
+	p.cmd = nil
+	p.adopted = upstream
+	p.cancelUpstream = cancelUpstream
+	p.cmdWaitChan = make(chan struct{})
+	p.cmdStartTime = time.Now()
+	p.logTail = tailLogFile(p.logFile(), true, p.processLogger)
+	p.cmdMutex.Unlock()
+	p.limits = &processLimits{}
+	p.stopRequested.Store(false)
+	p.setLastRequestHandled(time.Now())
+
+	go p.waitForAdopted(ctx, upstream)
+	p.proxyLogger.Infof("<%s> Adopted upstream pid %d on port %d", p.ID, state.PID, state.Port)
+
+	if p.config.UnloadAfter > 0 {
+		go p.unloadAfterTTL()
+	}
+	if _, err := p.swapState(StateStarting, StateReady); err != nil {
+		return false
+	}
+	if healthChecker != nil && p.livenessInterval > 0 {
+		go p.livenessLoop(healthChecker)
+	}
+	return true
+}
+
+// waitForAdopted waits for the adopted upstream to exit and stops it when ctx is done
+func (p *Process) waitForAdopted(ctx context.Context, upstream *os.Process) {
+	ticker := time.NewTicker(adoptedPollInterval)
+	defer ticker.Stop()
+
+	stop := ctx.Done()
+	for processAlive(upstream.Pid) {
+		select {
+		case <-stop:
+			stop = nil
+			if err := p.cmdStopUpstreamProcess(); err != nil || !waitForExit(upstream.Pid, p.gracefulStopTimeout) {
+				p.proxyLogger.Debugf("<%s> Killing adopted upstream pid %d", p.ID, upstream.Pid)
+				upstream.Kill()
+			}
+		case <-ticker.C:
+		}
+	}
+
+	// the upstream was left running for the next llama-swap, see Shutdown()
+	if p.detached.Load() {
+		return
+	}
+
+	var exitErr error
+	if !p.stopRequested.Load() {
+		exitErr = errAdoptedExited
+	}
+	p.upstreamExited(exitErr)
+}
+
+// stopLeftRunning stops an upstream a previous llama-swap left running. Its pid may
+// have been reused so it is only stopped while something listens on its port.
+func stopLeftRunning(name string, state upstreamState, reason string, timeout time.Duration, logger *LogMonitor) {
+	if !processAlive(state.PID) {
+		return
+	}
+	if state.Port == 0 || !portInUse(state.Port) {
+		logger.Warnf("<%s> Not stopping pid %d left running by a previous llama-swap, nothing listens on port %d", name, state.PID, state.Port)
+		return
+	}
+
+	logger.Infof("<%s> Stopping upstream pid %d left running by a previous llama-swap, %s", name, state.PID, reason)
+	upstream, err := os.FindProcess(state.PID)
+	if err != nil {
+		logger.Warnf("<%s> Unable to stop pid %d: %v", name, state.PID, err)
+		return
+	}
+	if err := upstream.Signal(syscall.SIGTERM); err != nil || !waitForExit(state.PID, timeout) {
+		upstream.Kill()
+	}
+}
+
+// waitForExit is true when pid exited within timeout
+func waitForExit(pid int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for processAlive(pid) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
+
+// adoptUpstreams adopts the upstreams a previous llama-swap left running and stops the
+// ones of models that are no longer configured
+func (pm *ProxyManager) adoptUpstreams() {
+	stateDir := pm.config.StateDir
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		pm.proxyLogger.Errorf("Unable to create stateDir: %v", err)
+		return
+	}
+
+	stateFiles := make(map[string]bool)
+	var wg sync.WaitGroup
+	for _, group := range pm.processGroups {
+		for _, process := range group.allProcesses() {
+			stateFiles[process.stateFile()] = true
+		}
+		wg.Add(1)
+		go func(group *ProcessGroup) {
+			defer wg.Done()
+			group.adoptUpstreams()
+		}(group)
+	}
+	wg.Wait()
+
+	files, _ := filepath.Glob(filepath.Join(stateDir, "*.json"))
+	for _, file := range files {
+		if stateFiles[file] {
+			continue
+		}
+		name := filepath.Base(file)
+		if state, err := readUpstreamState(file); err == nil {
+			stopLeftRunning(name, state, "its model is no longer configured", defaultGracefulStopTimeout, pm.proxyLogger)
+		}
+		os.Remove(file)
+	}
+}
+
+// logTail copies what an upstream writes to its log file in the stateDir to a writer
+type logTail struct {
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// tailLogFile copies the file at path to w, from its end when fromEnd is set
+func tailLogFile(path string, fromEnd bool, w io.Writer) *logTail {
+	t := &logTail{stop: make(chan struct{}), done: make(chan struct{})}
+	file, err := os.Open(path)
+	if err != nil {
+		close(t.done)
+		return t
+	}
+	if fromEnd {
+		file.Seek(0, io.SeekEnd)
+	}
+
+	go func() {
+		defer close(t.done)
+		defer file.Close()
+
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			io.Copy(w, file)
+			select {
+			case <-t.stop:
+				io.Copy(w, file)
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return t
+}
+
+// close copies what is left in the file and stops copying
+func (t *logTail) close() {
+	if t == nil {
+		return
+	}
+	t.stopOnce.Do(func() { close(t.stop) })
+	<-t.done
+}
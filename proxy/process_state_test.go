@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mostlygeek/llama-swap/proxy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func getTestAdoptConfig(stateDir string, respond string, port int) config.Config {
+	return config.AddDefaultGroupToConfig(config.Config{
+		HealthCheckTimeout: 15,
+		StateDir:           stateDir,
+		DetachOnShutdown:   true,
+		Models: map[string]config.ModelConfig{
+			"model1": {
+				Cmd:   fmt.Sprintf("%s --port %d --respond %s", filepath.ToSlash(simpleResponderPath), port, respond),
+				Proxy: fmt.Sprintf("http://127.0.0.1:%d", port),
+			},
+		},
+		LogLevel: "error",
+	})
+}
+
+// killOnCleanup kills an upstream left running when the test fails
+func killOnCleanup(t *testing.T, pid int) {
+	t.Cleanup(func() {
+		if process, err := os.FindProcess(pid); err == nil && processAlive(pid) {
+			process.Kill()
+		}
+	})
+}
+
+func TestProxyManager_AdoptsUpstreams(t *testing.T) {
+	stateDir := t.TempDir()
+	port := getTestPort()
+	cfg := getTestAdoptConfig(stateDir, "model1", port)
+
+	first := New(cfg)
+	w := CreateTestResponseRecorder()
+	first.ServeHTTP(w, httptest.NewRequest("GET", "/upstream/model1/test", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	process := first.findGroupByModelName("model1").processes["model1"]
+	pid := process.upstreamProcess().Pid
+
+	killOnCleanup(t, pid)
+
+	// the upstream's output goes through its log file
+	assert.Eventually(t, func() bool {
+		return strings.Contains(string(process.Logger().GetHistory()), "simple-responder listening")
+	}, time.Second, 10*time.Millisecond)
+
+	var state upstreamState
+	data, err := os.ReadFile(filepath.Join(stateDir, "model1.json"))
+	if assert.NoError(t, err) && assert.NoError(t, json.Unmarshal(data, &state)) {
+		assert.Equal(t, pid, state.PID)
+		assert.Equal(t, port, state.Port)
+	}
+
+	// the upstream is left running on shutdown and adopted by the next llama-swap
+	first.Shutdown()
+	assert.True(t, processAlive(pid))
+
+	second := New(cfg)
+	adopted := second.findGroupByModelName("model1").processes["model1"]
+	assert.Equal(t, StateReady, adopted.CurrentState())
+	assert.Equal(t, pid, adopted.upstreamProcess().Pid)
+
+	w = CreateTestResponseRecorder()
+	second.ServeHTTP(w, httptest.NewRequest("GET", "/upstream/model1/test", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "model1", w.Body.String())
+
+	// an adopted upstream is stopped like a started one
+	second.StopProcesses(StopWaitForInflightRequest)
+	assert.Equal(t, StateStopped, adopted.CurrentState())
+	assert.True(t, waitForExit(pid, time.Second))
+	assert.NoFileExists(t, filepath.Join(stateDir, "model1.json"))
+}
+
+func TestProxyManager_StopsStaleUpstreams(t *testing.T) {
+	stateDir := t.TempDir()
+	port := getTestPort()
+
+	first := New(getTestAdoptConfig(stateDir, "before", port))
+	w := CreateTestResponseRecorder()
+	first.ServeHTTP(w, httptest.NewRequest("GET", "/upstream/model1/test", nil))
+	assert.Equal(t, "before", w.Body.String())
+	pid := first.findGroupByModelName("model1").processes["model1"].upstreamProcess().Pid
+	killOnCleanup(t, pid)
+	first.Shutdown()
+
+	// a model that is no longer configured is stopped
+	if !assert.NoError(t, os.WriteFile(filepath.Join(stateDir, "removed.json"), []byte(`{"pid": 999999999, "port": 1}`), 0644)) {
+		return
+	}
+
+	// the command changed so the upstream is stopped instead of adopted
+	second := New(getTestAdoptConfig(stateDir, "after", port))
+	defer second.StopProcesses(StopWaitForInflightRequest)
+	assert.True(t, waitForExit(pid, time.Second))
+	assert.NoFileExists(t, filepath.Join(stateDir, "removed.json"))
+
+	process := second.findGroupByModelName("model1").processes["model1"]
+	assert.Equal(t, StateStopped, process.CurrentState())
+	w = CreateTestResponseRecorder()
+	second.ServeHTTP(w, httptest.NewRequest("GET", "/upstream/model1/test", nil))
+	assert.Equal(t, "after", w.Body.String())
+}
@@ -1,15 +1,22 @@
 package proxy
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"runtime"
+	"slices"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/mostlygeek/llama-swap/event"
 	"github.com/mostlygeek/llama-swap/proxy/config"
 	"github.com/stretchr/testify/assert"
 )
@@ -62,6 +69,59 @@ func TestProcess_AutomaticallyStartsUpstream(t *testing.T) {
 	}
 }
 
+func TestProcess_DynamicPort(t *testing.T) {
+	expectedMessage := "dynamic-port"
+	preferredPort := getTestPort()
+
+	// something else is already using the preferred port
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", preferredPort))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer listener.Close()
+
+	config := getTestSimpleResponderConfigPort(expectedMessage, 0)
+	config.Cmd = strings.Replace(config.Cmd, "--port 0", "--port ${PORT}", 1)
+	config.Proxy = "http://127.0.0.1:${PORT}"
+	config.Port = preferredPort
+	config.DynamicPort = true
+
+	process := NewProcess("dynamic-port", 5, config, debugLogger, debugLogger)
+	defer process.Stop()
+
+	req := httptest.NewRequest("GET", "/test", nil)
+	w := httptest.NewRecorder()
+	process.ProxyRequest(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), expectedMessage)
+
+	port := process.Port()
+	assert.Greater(t, port, preferredPort)
+	assert.Contains(t, process.command(), fmt.Sprintf("--port %d", port))
+	proxyURL, _ := process.upstream()
+	assert.Equal(t, fmt.Sprintf("http://127.0.0.1:%d", port), proxyURL)
+}
+
+func TestProcess_DynamicPortReleasedOnStartFailure(t *testing.T) {
+	process := NewProcess("missing-binary", 5, config.ModelConfig{
+		Cmd:         "nonexistent-command --port ${PORT}",
+		Proxy:       "http://127.0.0.1:${PORT}",
+		Port:        getTestPort(),
+		DynamicPort: true,
+	}, debugLogger, debugLogger)
+
+	w := httptest.NewRecorder()
+	process.ProxyRequest(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+
+	// the port is not held by the stopped process until it starts again
+	dynamicPorts.Lock()
+	defer dynamicPorts.Unlock()
+	for port, owner := range dynamicPorts.reserved {
+		assert.NotSame(t, process, owner, "port %d is still reserved", port)
+	}
+}
+
 // TestProcess_WaitOnMultipleStarts tests that multiple concurrent requests
 // are all handled successfully, even though they all may ask for the process to .start()
 func TestProcess_WaitOnMultipleStarts(t *testing.T) {
@@ -111,6 +171,32 @@ func TestProcess_BrokenModelConfig(t *testing.T) {
 	assert.Contains(t, w.Body.String(), "start() failed for command 'nonexistent-command':")
 }
 
+// the command in the error of a failed start is returned to the client
+func TestProcess_StartErrorRedactsSecrets(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "hf_token")
+	if !assert.NoError(t, os.WriteFile(secretFile, []byte("hf_secret123"), 0600)) {
+		return
+	}
+	conf, err := config.LoadConfigFromReader(strings.NewReader(`
+models:
+  broken:
+    cmd: nonexistent-command --port ${PORT} --hf-token ${file:` + filepath.ToSlash(secretFile) + `}
+`))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	logs := NewLogMonitorWriter(io.Discard)
+	process := NewProcess("broken", 1, conf.Models["broken"], logs, logs)
+
+	w := httptest.NewRecorder()
+	process.ProxyRequest(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Contains(t, w.Body.String(), "start() failed for command 'nonexistent-command")
+	assert.NotContains(t, w.Body.String(), "hf_secret123")
+	assert.NotContains(t, string(logs.GetHistory()), "hf_secret123")
+}
+
 func TestProcess_UnloadAfterTTL(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping long auto unload TTL test")
@@ -371,6 +457,147 @@ func TestProcess_ConcurrencyLimit(t *testing.T) {
 	assert.Equal(t, http.StatusTooManyRequests, w.Code)
 }
 
+func TestProcess_RequestQueue(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping long request queue test")
+	}
+
+	config := getTestSimpleResponderConfig("request_queue_test")
+	config.ConcurrencyLimit = 1
+	config.MaxQueueSize = 1
+
+	process := NewProcess("queue_test", 2, config, debugLogger, debugLogger)
+	defer process.Stop()
+	assert.NoError(t, process.start())
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		w := httptest.NewRecorder()
+		process.ProxyRequest(w, httptest.NewRequest("GET", "/slow-respond?echo=first&delay=200ms", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+	}()
+	assert.Eventually(t, func() bool { return len(process.concurrencyLimitSemaphore) == 1 }, time.Second, time.Millisecond)
+
+	// waits for the first request instead of getting a 429
+	stats := &queueStats{}
+	go func() {
+		defer wg.Done()
+		req := httptest.NewRequest("GET", "/test", nil)
+		req = req.WithContext(context.WithValue(req.Context(), proxyCtxKey("queueStats"), stats))
+		w := httptest.NewRecorder()
+		process.ProxyRequest(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "request_queue_test")
+	}()
+	waitForQueue(t, process.requestQueue, 1)
+
+	// the queue is full
+	w := httptest.NewRecorder()
+	process.ProxyRequest(w, httptest.NewRequest("GET", "/test", nil))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+
+	wg.Wait()
+	assert.Equal(t, 0, stats.depth)
+	assert.Greater(t, stats.wait, 100*time.Millisecond)
+}
+
+func TestProcess_DrainTimeout(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping long drain timeout test")
+	}
+
+	config := getTestSimpleResponderConfig("drain_timeout_test")
+	process := NewProcess("drain_timeout", 2, config, debugLogger, debugLogger)
+	process.drainTimeout = 200 * time.Millisecond
+	defer process.StopImmediately()
+	assert.NoError(t, process.start())
+
+	// the upstream waits before it sends headers
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req := httptest.NewRequest("POST", "/v1/chat/completions?stream=true&wait=5s", strings.NewReader("{}"))
+		process.ProxyRequest(w, req)
+	}()
+	assert.Eventually(t, func() bool { return process.inFlightRequestsCount.Load() == 1 }, time.Second, time.Millisecond)
+
+	start := time.Now()
+	process.Stop()
+	assert.Less(t, time.Since(start), 3*time.Second)
+	assert.Equal(t, StateStopped, process.CurrentState())
+
+	<-done
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "the model is being unloaded")
+}
+
+func TestProcess_DrainPolicy(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping long drain policy test")
+	}
+
+	tests := []struct {
+		policy       string
+		expectedCode int
+	}{
+		{policy: "queue", expectedCode: http.StatusOK},
+		{policy: "reject", expectedCode: http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			config := getTestSimpleResponderConfig("drain_policy_test")
+			config.DrainPolicy = tt.policy
+			process := NewProcess("drain_policy", 2, config, debugLogger, debugLogger)
+			defer process.StopImmediately()
+			assert.NoError(t, process.start())
+
+			go func() {
+				w := httptest.NewRecorder()
+				process.ProxyRequest(w, httptest.NewRequest("GET", "/slow-respond?echo=12345&delay=100ms", nil))
+			}()
+			assert.Eventually(t, func() bool { return process.inFlightRequestsCount.Load() == 1 }, time.Second, time.Millisecond)
+
+			stopped := make(chan struct{})
+			go func() {
+				defer close(stopped)
+				process.Stop()
+			}()
+			assert.Eventually(t, func() bool { return process.draining() != nil }, time.Second, time.Millisecond)
+
+			// queued requests start the process again once it has stopped
+			w := httptest.NewRecorder()
+			process.ProxyRequest(w, httptest.NewRequest("GET", "/test", nil))
+			assert.Equal(t, tt.expectedCode, w.Code)
+			<-stopped
+		})
+	}
+}
+
+func TestProcess_SendDrainError(t *testing.T) {
+	process := NewProcess("drain_error", 2, getTestSimpleResponderConfig("drain_error"), debugLogger, debugLogger)
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(errDrainTimeout)
+	req := httptest.NewRequest("POST", "/v1/chat/completions", nil).WithContext(ctx)
+
+	// only streams get an error chunk
+	w := httptest.NewRecorder()
+	w.Header().Set("Content-Type", "application/json")
+	process.sendDrainError(w, req)
+	assert.Empty(t, w.Body.String())
+
+	w = httptest.NewRecorder()
+	w.Header().Set("Content-Type", "text/event-stream")
+	process.sendDrainError(w, req)
+	assert.Equal(t, `data: {"error":{"message":"request cancelled, drain_error is being unloaded","type":"server_error","code":503}}`+"\n\n", w.Body.String())
+	assert.True(t, w.Flushed)
+}
+
 func TestProcess_StopImmediately(t *testing.T) {
 	expectedMessage := "test_stop_immediate"
 	config := getTestSimpleResponderConfig(expectedMessage)
@@ -569,3 +796,143 @@ func (w *panicOnWriteResponseWriter) Write(b []byte) (int, error) {
 	}
 	return w.ResponseRecorder.Write(b)
 }
+
+func TestProcess_RestartPolicy(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping restart policy test")
+	}
+
+	var mu sync.Mutex
+	crashes := make(map[string][]ProcessCrashEvent)
+	defer event.On(func(e ProcessCrashEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		crashes[e.ProcessName] = append(crashes[e.ProcessName], e)
+	})()
+	getCrashes := func(id string) []ProcessCrashEvent {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(crashes[id])
+	}
+
+	newCrashingProcess := func(id, policy string) *Process {
+		config := getTestSimpleResponderConfig(id)
+		config.RestartPolicy = policy
+		config.Restart.MaxRestarts = 1
+		process := NewProcess(id, 5, config, NewLogMonitorWriter(io.Discard), debugLogger)
+		process.healthCheckLoopInterval = 100 * time.Millisecond
+		if !assert.NoError(t, process.start()) {
+			t.FailNow()
+		}
+		fmt.Fprintf(process.processLogger, "line 1\nline 2\nout of memory\n")
+		return process
+	}
+	crash := func(process *Process) {
+		process.cmdMutex.RLock()
+		defer process.cmdMutex.RUnlock()
+		assert.NoError(t, process.cmd.Process.Kill())
+	}
+
+	t.Run("never", func(t *testing.T) {
+		process := newCrashingProcess("restart-never", config.RestartPolicyNever)
+		defer process.Stop()
+
+		crash(process)
+		assert.Eventually(t, func() bool { return len(getCrashes(process.ID)) == 1 }, 5*time.Second, 50*time.Millisecond)
+
+		e := getCrashes(process.ID)[0]
+		assert.Equal(t, StateReady, e.State)
+		if runtime.GOOS != "windows" {
+			assert.Equal(t, -1, e.ExitCode) // killed by a signal
+		}
+		assert.Equal(t, "line 1\nline 2\nout of memory", e.Logs)
+		assert.False(t, e.Restart)
+
+		<-time.After(1500 * time.Millisecond)
+		assert.Equal(t, StateStopped, process.CurrentState())
+	})
+
+	t.Run("on-failure", func(t *testing.T) {
+		process := newCrashingProcess("restart-on-failure", config.RestartPolicyOnFailure)
+		defer process.Stop()
+
+		crash(process)
+		assert.Eventually(t, func() bool { return len(getCrashes(process.ID)) == 1 }, 5*time.Second, 50*time.Millisecond)
+		e := getCrashes(process.ID)[0]
+		assert.True(t, e.Restart)
+		assert.Equal(t, time.Second, e.RestartDelay)
+
+		assert.Eventually(t, func() bool { return process.CurrentState() == StateReady }, 5*time.Second, 50*time.Millisecond)
+
+		// maxRestarts within the window has been reached
+		crash(process)
+		assert.Eventually(t, func() bool { return len(getCrashes(process.ID)) == 2 }, 5*time.Second, 50*time.Millisecond)
+		assert.False(t, getCrashes(process.ID)[1].Restart)
+	})
+
+	t.Run("stop cancels the restart", func(t *testing.T) {
+		process := newCrashingProcess("restart-always", config.RestartPolicyAlways)
+		defer process.Stop()
+
+		crash(process)
+		assert.Eventually(t, func() bool { return len(getCrashes(process.ID)) == 1 }, 5*time.Second, 50*time.Millisecond)
+		assert.True(t, getCrashes(process.ID)[0].Restart)
+
+		process.Stop()
+		<-time.After(1500 * time.Millisecond)
+		assert.Equal(t, StateStopped, process.CurrentState())
+	})
+}
+
+func TestProcess_RestartBackoff(t *testing.T) {
+	process := NewProcess("backoff", 5, config.ModelConfig{
+		Restart: config.RestartConfig{Backoff: 2, MaxBackoff: 10},
+	}, debugLogger, debugLogger)
+
+	assert.Equal(t, 2*time.Second, process.restartBackoff(0))
+	assert.Equal(t, 4*time.Second, process.restartBackoff(1))
+	assert.Equal(t, 8*time.Second, process.restartBackoff(2))
+	assert.Equal(t, 10*time.Second, process.restartBackoff(3))
+	assert.Equal(t, 10*time.Second, process.restartBackoff(100))
+}
+
+func TestProcess_HealthChecks(t *testing.T) {
+	type healthCheckTest struct {
+		name        string
+		healthCheck config.HealthCheck
+		ready       bool
+	}
+	tests := []healthCheckTest{
+		{"http expect matches", config.HealthCheck{Expect: `status == "ok"`}, true},
+		{"http expect does not match", config.HealthCheck{Expect: `status == "loading"`}, false},
+		{"http path", config.HealthCheck{Path: "/test"}, true},
+		{"tcp", config.HealthCheck{Type: config.HealthCheckTCP}, true},
+		{"none", config.HealthCheck{Type: config.HealthCheckNone}, true},
+	}
+	if runtime.GOOS != "windows" {
+		tests = append(tests,
+			healthCheckTest{"command succeeds", config.HealthCheck{Type: config.HealthCheckCommand, Command: "true"}, true},
+			healthCheckTest{"command fails", config.HealthCheck{Type: config.HealthCheckCommand, Command: "false"}, false},
+		)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := getTestSimpleResponderConfig("health")
+			config.HealthCheck = tt.healthCheck
+
+			process := NewProcess("health-check", 1, config, debugLogger, debugLogger)
+			process.healthCheckLoopInterval = 100 * time.Millisecond
+			defer process.Stop()
+
+			err := process.start()
+			if tt.ready {
+				assert.NoError(t, err)
+				assert.Equal(t, StateReady, process.CurrentState())
+			} else {
+				assert.ErrorContains(t, err, "health check timed out")
+				assert.Equal(t, StateStopped, process.CurrentState())
+			}
+		})
+	}
+}
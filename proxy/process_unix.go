@@ -3,10 +3,30 @@
 package proxy
 
 import (
+	"errors"
 	"os/exec"
+	"syscall"
 )
 
 // setProcAttributes sets platform-specific process attributes
 func setProcAttributes(cmd *exec.Cmd) {
 	// No-op on Unix systems
 }
+
+// setDetached starts the command in a process group of its own so it is not stopped
+// with llama-swap, e.g. by ctrl+c in a terminal
+func setDetached(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// processAlive is true while a process with pid is running
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,152 @@
+//go:build !windows
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mostlygeek/llama-swap/event"
+	"github.com/mostlygeek/llama-swap/proxy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcess_LivenessStopsHungProcess(t *testing.T) {
+	var mu sync.Mutex
+	var stopped []ProcessStateChangeEvent
+	defer event.On(func(e ProcessStateChangeEvent) {
+		if e.ProcessName != "liveness" || e.NewState != StateStopped {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		stopped = append(stopped, e)
+	})()
+
+	config := getTestSimpleResponderConfig("liveness")
+	config.HealthCheck.Timeout = 1
+	config.HealthCheck.Liveness.Failures = 2
+
+	process := NewProcess("liveness", 5, config, debugLogger, debugLogger)
+	process.livenessInterval = 100 * time.Millisecond
+	process.gracefulStopTimeout = 100 * time.Millisecond
+	defer process.Stop()
+
+	if !assert.NoError(t, process.start()) {
+		return
+	}
+
+	// still answering health checks
+	<-time.After(500 * time.Millisecond)
+	assert.Equal(t, StateReady, process.CurrentState())
+
+	// hang the upstream
+	assert.NoError(t, process.cmd.Process.Signal(syscall.SIGSTOP))
+
+	assert.Eventually(t, func() bool {
+		return process.CurrentState() == StateStopped
+	}, 10*time.Second, 100*time.Millisecond)
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(stopped) == 1
+	}, time.Second, 50*time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Contains(t, stopped[0].Reason, "liveness check failed 2 times")
+}
+
+func TestProcess_LastExit(t *testing.T) {
+	tests := []struct {
+		name          string
+		cmd           string
+		expectedError string
+		exitCode      int
+		signal        string
+	}{
+		{"exit code", `sh -c "echo out of memory; exit 3"`, "upstream command exited prematurely with exit code 3", 3, ""},
+		{"signal", `sh -c "echo out of memory; kill -9 $$"`, "upstream command was killed prematurely by signal killed", -1, "killed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			modelConfig := config.ModelConfig{
+				Cmd:           tt.cmd,
+				Proxy:         "http://127.0.0.1:9913",
+				CheckEndpoint: "/health",
+			}
+			process := NewProcess("last_exit", 5, modelConfig, NewLogMonitorWriter(debugLogger), debugLogger)
+			assert.Nil(t, process.LastExit())
+
+			w := httptest.NewRecorder()
+			process.ProxyRequest(w, httptest.NewRequest("GET", "/", nil))
+			assert.Equal(t, http.StatusBadGateway, w.Code)
+			assert.Contains(t, w.Body.String(), tt.expectedError)
+			assert.Contains(t, w.Body.String(), "last output:\nout of memory")
+
+			exit := process.LastExit()
+			if assert.NotNil(t, exit) {
+				assert.Equal(t, tt.exitCode, exit.ExitCode)
+				assert.Equal(t, tt.signal, exit.Signal)
+				assert.Equal(t, StateStarting, exit.State)
+				assert.Equal(t, "out of memory", exit.Logs)
+				assert.GreaterOrEqual(t, exit.DurationMs, int64(0))
+			}
+		})
+	}
+}
+
+func TestProxyManager_LastExit(t *testing.T) {
+	cfg := config.AddDefaultGroupToConfig(config.Config{
+		HealthCheckTimeout: 15,
+		Models: map[string]config.ModelConfig{
+			"model1": getTestSimpleResponderConfig("model1"),
+		},
+		LogLevel: "error",
+	})
+
+	proxy := New(cfg)
+	defer proxy.StopProcesses(StopWaitForInflightRequest)
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"model1"}`))
+	w := CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	process := proxy.findGroupByModelName("model1").processes["model1"]
+	assert.NoError(t, process.cmd.Process.Signal(syscall.SIGKILL))
+	assert.Eventually(t, func() bool { return process.LastExit() != nil }, 5*time.Second, 10*time.Millisecond)
+
+	models := proxy.getModelStatus()
+	if assert.Len(t, models, 1) && assert.NotNil(t, models[0].LastExit) {
+		assert.Equal(t, "killed", models[0].LastExit.Signal)
+		assert.Equal(t, StateReady, models[0].LastExit.State)
+	}
+
+	// loaded again, /running shows how it exited before
+	w = CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"model1"}`)))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "/running", nil))
+	var running struct {
+		Running []struct {
+			Model    string      `json:"model"`
+			LastExit *ExitRecord `json:"lastExit"`
+		} `json:"running"`
+	}
+	if assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &running)) && assert.Len(t, running.Running, 1) {
+		assert.Equal(t, "model1", running.Running[0].Model)
+		if assert.NotNil(t, running.Running[0].LastExit) {
+			assert.Equal(t, "killed", running.Running[0].LastExit.Signal)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"fmt"
+	"maps"
 	"net/http"
 	"slices"
 	"sync"
@@ -21,9 +22,12 @@ type ProcessGroup struct {
 	proxyLogger    *LogMonitor
 	upstreamLogger *LogMonitor
 
-	// map of current processes
+	// map of current processes, the first replica of each model
 	processes       map[string]*Process
 	lastUsedProcess string
+
+	// every replica of each model, see pickReplica()
+	replicas map[string][]*Process
 }
 
 func NewProcessGroup(id string, config config.Config, proxyLogger *LogMonitor, upstreamLogger *LogMonitor) *ProcessGroup {
@@ -32,28 +36,177 @@ func NewProcessGroup(id string, config config.Config, proxyLogger *LogMonitor, u
 		panic("Unable to find configuration for group id: " + id)
 	}
 
+	// the memoryScheduler decides which models run together instead, maxLoadedGroups
+	// keeps swapping models within a group
+	scheduled := len(config.MemoryBudget) > 0 || config.MaxLoadedModels > 0
+
 	pg := &ProcessGroup{
 		id:             id,
 		config:         config,
-		swap:           groupConfig.Swap,
-		exclusive:      groupConfig.Exclusive,
+		swap:           groupConfig.Swap && !scheduled,
+		exclusive:      groupConfig.Exclusive && !schedulerEnabled(config),
 		persistent:     groupConfig.Persistent,
 		proxyLogger:    proxyLogger,
 		upstreamLogger: upstreamLogger,
 		processes:      make(map[string]*Process),
+		replicas:       make(map[string][]*Process),
 	}
 
-	// Create a Process for each member in the group
+	// Create a Process for each member in the group, and each of its replicas
 	for _, modelID := range groupConfig.Members {
 		modelConfig, modelID, _ := pg.config.FindConfig(modelID)
-		processLogger := NewLogMonitorWriter(upstreamLogger)
-		process := NewProcess(modelID, pg.config.HealthCheckTimeout, modelConfig, processLogger, pg.proxyLogger)
-		pg.processes[modelID] = process
+		for replica := range max(1, modelConfig.Replicas) {
+			replicaConfig := modelConfig
+			if modelConfig.Replicas > 1 {
+				replicaConfig = modelConfig.ForReplica(replica)
+			}
+			processLogger := NewLogMonitorWriter(upstreamLogger)
+			process := NewProcess(modelID, pg.config.HealthCheckTimeout, replicaConfig, processLogger, pg.proxyLogger)
+			process.replica = replica
+			process.stateDir = pg.config.StateDir
+			process.detachOnShutdown = pg.config.DetachOnShutdown
+			pg.replicas[modelID] = append(pg.replicas[modelID], process)
+		}
+		pg.processes[modelID] = pg.replicas[modelID][0]
+	}
+
+	return pg
+}
+
+// newProfileGroup creates the group for a profile. It shares the Processes of the
+// groups its members belong to and runs all of them together.
+func newProfileGroup(name string, members []string, groups map[string]*ProcessGroup, proxyConfig config.Config, proxyLogger *LogMonitor, upstreamLogger *LogMonitor) *ProcessGroup {
+	pg := &ProcessGroup{
+		id:             PROFILE_GROUP_PREFIX + name,
+		config:         proxyConfig,
+		swap:           false,
+		exclusive:      true,
+		persistent:     false,
+		proxyLogger:    proxyLogger,
+		upstreamLogger: upstreamLogger,
+		processes:      make(map[string]*Process),
+		replicas:       make(map[string][]*Process),
+	}
+
+	for _, modelID := range members {
+		for _, group := range groups {
+			if process, ok := group.GetMember(modelID); ok {
+				pg.processes[modelID] = process
+				pg.replicas[modelID] = group.replicas[modelID]
+				break
+			}
+		}
 	}
 
 	return pg
 }
 
+// adoptProcesses replaces the group's processes with ones kept from a previous
+// configuration, see ProxyManager.Reload()
+func (pg *ProcessGroup) adoptProcesses(kept map[string][]*Process) {
+	pg.Lock()
+	defer pg.Unlock()
+
+	for modelID := range pg.processes {
+		replicas, ok := kept[modelID]
+		if !ok {
+			continue
+		}
+		pg.processes[modelID] = replicas[0]
+		pg.replicas[modelID] = replicas
+
+		// the running process is the one to swap out on the next request
+		if pg.swap && isRunning(replicas) {
+			pg.lastUsedProcess = modelID
+		}
+	}
+}
+
+// adoptUpstreams adopts the upstreams a previous llama-swap left running, see
+// Process.adopt(). A group that swaps its models only keeps one of them running.
+func (pg *ProcessGroup) adoptUpstreams() {
+	pg.Lock()
+	defer pg.Unlock()
+
+	for _, modelID := range slices.Sorted(maps.Keys(pg.replicas)) {
+		for _, process := range pg.replicas[modelID] {
+			if pg.swap && pg.lastUsedProcess != "" && pg.lastUsedProcess != modelID {
+				if state, ok := process.leftRunning(); ok {
+					process.stopLeftRunning(state, fmt.Sprintf("%s is running in group %s", pg.lastUsedProcess, pg.id))
+				}
+				continue
+			}
+			if process.adopt() && pg.swap {
+				pg.lastUsedProcess = modelID
+			}
+		}
+	}
+}
+
+// allProcesses returns every replica of every model in the group
+func (pg *ProcessGroup) allProcesses() []*Process {
+	var processes []*Process
+	for _, replicas := range pg.replicas {
+		processes = append(processes, replicas...)
+	}
+	return processes
+}
+
+// isRunning is true when any of the replicas is not stopped or shut down
+func isRunning(replicas []*Process) bool {
+	for _, process := range replicas {
+		switch process.CurrentState() {
+		case StateStopped, StateShutdown:
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// pickReplica returns the ready replica of the model with the fewest in-flight and
+// queued requests, or the first one when none are ready. Stopped replicas are started in
+// the background so all of them serve requests.
+func (pg *ProcessGroup) pickReplica(modelID string) *Process {
+	replicas := pg.replicas[modelID]
+	if len(replicas) == 1 {
+		return replicas[0]
+	}
+
+	var picked *Process
+	for _, process := range replicas {
+		if process.CurrentState() != StateReady {
+			continue
+		}
+		if picked == nil || process.load() < picked.load() {
+			picked = process
+		}
+	}
+	if picked == nil {
+		picked = replicas[0]
+	}
+
+	// with autoscaling only minReplicas are started, see autoscaler
+	start := len(replicas)
+	if minReplicas := replicas[0].config.MinReplicas; replicas[0].config.MaxReplicas > 0 {
+		start = minReplicas
+	}
+	for _, process := range replicas[:start] {
+		if process != picked && process.CurrentState() == StateStopped {
+			startReplica(process)
+		}
+	}
+	return picked
+}
+
+// startReplica starts the process in the background
+func startReplica(process *Process) {
+	go func() {
+		req, _ := http.NewRequest("GET", "/", nil)
+		process.ProxyRequest(&DiscardWriter{}, req)
+	}()
+}
+
 // ProxyRequest proxies a request to the specified model
 func (pg *ProcessGroup) ProxyRequest(modelID string, writer http.ResponseWriter, request *http.Request) error {
 	if !pg.HasMember(modelID) {
@@ -61,17 +214,24 @@ func (pg *ProcessGroup) ProxyRequest(modelID string, writer http.ResponseWriter,
 	}
 
 	if pg.swap {
+		// requests for a model that is being swapped out would wait for the lock
+		for _, process := range pg.replicas[modelID] {
+			if process.rejectWhileDraining(writer) {
+				return nil
+			}
+		}
+
 		pg.Lock()
 		if pg.lastUsedProcess != modelID {
 
 			// is there something already running?
 			if pg.lastUsedProcess != "" {
-				pg.processes[pg.lastUsedProcess].Stop()
+				stopReplicas(pg.replicas[pg.lastUsedProcess], StopWaitForInflightRequest)
 			}
 
 			// wait for the request to the new model to be fully handled
 			// and prevent race conditions see issue #277
-			pg.processes[modelID].ProxyRequest(writer, request)
+			pg.pickReplica(modelID).ProxyRequest(writer, request)
 			pg.lastUsedProcess = modelID
 
 			// short circuit and exit
@@ -81,12 +241,13 @@ func (pg *ProcessGroup) ProxyRequest(modelID string, writer http.ResponseWriter,
 		pg.Unlock()
 	}
 
-	pg.processes[modelID].ProxyRequest(writer, request)
+	pg.pickReplica(modelID).ProxyRequest(writer, request)
 	return nil
 }
 
 func (pg *ProcessGroup) HasMember(modelName string) bool {
-	return slices.Contains(pg.config.Groups[pg.id].Members, modelName)
+	_, found := pg.processes[modelName]
+	return found
 }
 
 func (pg *ProcessGroup) GetMember(modelName string) (*Process, bool) {
@@ -99,7 +260,7 @@ func (pg *ProcessGroup) GetMember(modelName string) (*Process, bool) {
 func (pg *ProcessGroup) StopProcess(modelID string, strategy StopStrategy) error {
 	pg.Lock()
 
-	process, exists := pg.processes[modelID]
+	replicas, exists := pg.replicas[modelID]
 	if !exists {
 		pg.Unlock()
 		return fmt.Errorf("process not found for %s", modelID)
@@ -110,12 +271,7 @@ func (pg *ProcessGroup) StopProcess(modelID string, strategy StopStrategy) error
 	}
 	pg.Unlock()
 
-	switch strategy {
-	case StopImmediately:
-		process.StopImmediately()
-	default:
-		process.Stop()
-	}
+	stopReplicas(replicas, strategy)
 	return nil
 }
 
@@ -127,9 +283,13 @@ func (pg *ProcessGroup) StopProcesses(strategy StopStrategy) {
 		return
 	}
 
-	// stop Processes in parallel
+	stopReplicas(pg.allProcesses(), strategy)
+}
+
+// stopReplicas stops the processes in parallel
+func stopReplicas(processes []*Process, strategy StopStrategy) {
 	var wg sync.WaitGroup
-	for _, process := range pg.processes {
+	for _, process := range processes {
 		wg.Add(1)
 		go func(process *Process) {
 			defer wg.Done()
@@ -146,7 +306,7 @@ func (pg *ProcessGroup) StopProcesses(strategy StopStrategy) {
 
 func (pg *ProcessGroup) Shutdown() {
 	var wg sync.WaitGroup
-	for _, process := range pg.processes {
+	for _, process := range pg.allProcesses() {
 		wg.Add(1)
 		go func(process *Process) {
 			defer wg.Done()
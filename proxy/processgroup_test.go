@@ -2,10 +2,13 @@ package proxy
 
 import (
 	"bytes"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/mostlygeek/llama-swap/proxy/config"
 	"github.com/stretchr/testify/assert"
@@ -117,3 +120,64 @@ func TestProcessGroup_ProxyRequestSwapIsFalse(t *testing.T) {
 		assert.Equal(t, StateReady, process.CurrentState())
 	}
 }
+
+func TestProcessGroup_Replicas(t *testing.T) {
+	port := getTestPort()
+	getTestPort() // the second replica listens on port+1
+
+	modelConfig := config.ModelConfig{
+		Cmd:      fmt.Sprintf("%s --port ${PORT} --silent --respond replica", filepath.ToSlash(simpleResponderPath)),
+		Proxy:    "http://127.0.0.1:${PORT}",
+		Env:      []string{"CUDA_VISIBLE_DEVICES=${REPLICA}"},
+		Port:     port,
+		Replicas: 2,
+	}
+	cfg := config.AddDefaultGroupToConfig(config.Config{
+		HealthCheckTimeout: 15,
+		Models:             map[string]config.ModelConfig{"model1": modelConfig},
+	})
+
+	pg := NewProcessGroup(config.DEFAULT_GROUP_ID, cfg, testLogger, testLogger)
+	defer pg.StopProcesses(StopWaitForInflightRequest)
+	replicas := pg.replicas["model1"]
+	if !assert.Len(t, replicas, 2) {
+		return
+	}
+
+	getEnv := func() string {
+		w := httptest.NewRecorder()
+		assert.NoError(t, pg.ProxyRequest("model1", w, httptest.NewRequest("GET", "/env", nil)))
+		return w.Body.String()
+	}
+
+	// the first replica serves the request, the second one starts with it
+	assert.Contains(t, getEnv(), "CUDA_VISIBLE_DEVICES=0")
+	assert.Eventually(t, func() bool {
+		return replicas[1].CurrentState() == StateReady
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, port+1, replicas[1].Port())
+
+	// a busy replica is skipped
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		w := httptest.NewRecorder()
+		pg.ProxyRequest("model1", w, httptest.NewRequest("GET", "/slow-respond?echo=12345&delay=100ms", nil))
+	}()
+	assert.Eventually(t, func() bool {
+		return replicas[0].inFlightRequestsCount.Load()+replicas[1].inFlightRequestsCount.Load() == 1
+	}, time.Second, time.Millisecond)
+	idle := "CUDA_VISIBLE_DEVICES=1"
+	if replicas[1].inFlightRequestsCount.Load() == 1 {
+		idle = "CUDA_VISIBLE_DEVICES=0"
+	}
+	assert.Contains(t, getEnv(), idle)
+	wg.Wait()
+
+	// stopping the model stops every replica
+	assert.NoError(t, pg.StopProcess("model1", StopWaitForInflightRequest))
+	for _, process := range replicas {
+		assert.Equal(t, StateStopped, process.CurrentState())
+	}
+}
@@ -23,11 +23,17 @@ import (
 )
 
 const (
-	PROFILE_SPLIT_CHAR = ":"
+	PROFILE_SPLIT_CHAR = config.PROFILE_SPLIT_CHAR
+
+	// ID prefix of the process groups created for profiles
+	PROFILE_GROUP_PREFIX = "profile" + PROFILE_SPLIT_CHAR
 )
 
 type proxyCtxKey string
 
+// the gin context key of the API key that apiKeyAuth accepted
+const apiKeyContextKey = "llama-swap.apiKey"
+
 type ProxyManager struct {
 	sync.RWMutex
 
@@ -43,6 +49,10 @@ type ProxyManager struct {
 
 	processGroups map[string]*ProcessGroup
 
+	// profiles run all their models together, see swapProcessGroup()
+	profileGroups map[string]*ProcessGroup
+	activeProfile string
+
 	// shutdown signaling
 	shutdownCtx    context.Context
 	shutdownCancel context.CancelFunc
@@ -64,32 +74,29 @@ type ProxyManager struct {
 		Capabilities []string
 	}
 	cacheMutex sync.RWMutex
+
+	// runtime configuration changes, shared with the ProxyManagers that replace this one
+	configEditor *configEditor
 }
 
 func New(proxyConfig config.Config) *ProxyManager {
+	return newProxyManager(proxyConfig, nil, nil)
+}
+
+// newProxyManager creates a ProxyManager. When previous is set its loggers are reused
+// and the processes in kept, the replicas of each model by model ID, are used instead
+// of creating new ones.
+func newProxyManager(proxyConfig config.Config, previous *ProxyManager, kept map[string][]*Process) *ProxyManager {
 	// set up loggers
 
 	var muxLogger, upstreamLogger, proxyLogger *LogMonitor
-	switch proxyConfig.LogToStdout {
-	case config.LogToStdoutNone:
-		muxLogger = NewLogMonitorWriter(io.Discard)
-		upstreamLogger = NewLogMonitorWriter(io.Discard)
-		proxyLogger = NewLogMonitorWriter(io.Discard)
-	case config.LogToStdoutBoth:
-		muxLogger = NewLogMonitorWriter(os.Stdout)
-		upstreamLogger = NewLogMonitorWriter(muxLogger)
-		proxyLogger = NewLogMonitorWriter(muxLogger)
-	case config.LogToStdoutUpstream:
-		muxLogger = NewLogMonitorWriter(os.Stdout)
-		upstreamLogger = NewLogMonitorWriter(muxLogger)
-		proxyLogger = NewLogMonitorWriter(io.Discard)
-	default:
-		// same as config.LogToStdoutProxy
-		// helpful because some old tests create a config.Config directly and it
-		// may not have LogToStdout set explicitly
-		muxLogger = NewLogMonitorWriter(os.Stdout)
-		upstreamLogger = NewLogMonitorWriter(io.Discard)
-		proxyLogger = NewLogMonitorWriter(muxLogger)
+	if previous != nil {
+		// kept processes write to these loggers
+		muxLogger = previous.muxLogger
+		upstreamLogger = previous.upstreamLogger
+		proxyLogger = previous.proxyLogger
+	} else {
+		muxLogger, upstreamLogger, proxyLogger = newLoggers(proxyConfig)
 	}
 
 	if proxyConfig.LogRequests {
@@ -164,6 +171,7 @@ func New(proxyConfig config.Config) *ProxyManager {
 		metricsMonitor: newMetricsMonitor(proxyLogger, maxMetrics, proxyConfig.CaptureBuffer),
 
 		processGroups: make(map[string]*ProcessGroup),
+		profileGroups: make(map[string]*ProcessGroup),
 
 		shutdownCtx:    shutdownCtx,
 		shutdownCancel: shutdownCancel,
@@ -182,12 +190,59 @@ func New(proxyConfig config.Config) *ProxyManager {
 		}),
 	}
 
+	if previous != nil {
+		pm.configEditor = previous.configEditor
+		pm.buildDate, pm.commit, pm.version = previous.buildDate, previous.commit, previous.version
+	} else {
+		pm.configEditor = &configEditor{}
+	}
+	pm.configEditor.current = pm
+
+	// keep the collected metrics and captures through a config reload
+	if previous != nil &&
+		previous.config.MetricsMaxInMemory == proxyConfig.MetricsMaxInMemory &&
+		previous.config.CaptureBuffer == proxyConfig.CaptureBuffer {
+		pm.metricsMonitor = previous.metricsMonitor
+	}
+
 	// create the process groups
 	for groupID := range proxyConfig.Groups {
 		processGroup := NewProcessGroup(groupID, proxyConfig, proxyLogger, upstreamLogger)
+		processGroup.adoptProcesses(kept)
 		pm.processGroups[groupID] = processGroup
 	}
 
+	if schedulerEnabled(proxyConfig) {
+		newMemoryScheduler(proxyConfig, pm.processGroups, proxyLogger)
+	} else {
+		// kept processes may have been scheduled by the previous configuration
+		for _, group := range pm.processGroups {
+			for _, process := range group.allProcesses() {
+				process.scheduler.Store(nil)
+			}
+		}
+	}
+
+	// containers of a llama-swap that did not shut down cleanly are still running,
+	// on a reload they belong to the kept processes
+	if previous == nil {
+		pm.removeOrphanedContainers()
+	}
+
+	// upstreams still running from before llama-swap restarted, on a reload they
+	// belong to the kept processes
+	if previous == nil && proxyConfig.StateDir != "" {
+		pm.adoptUpstreams()
+	}
+
+	// profiles share the processes of the groups
+	for profileName, members := range proxyConfig.Profiles {
+		pm.profileGroups[profileName] = newProfileGroup(profileName, members, pm.processGroups, proxyConfig, proxyLogger, upstreamLogger)
+	}
+
+	newKeepWarm(pm)
+	newAutoscaler(pm)
+
 	pm.setupGinEngine()
 	pm.RegisterOllamaRoutes()
 
@@ -198,7 +253,6 @@ func New(proxyConfig config.Config) *ProxyManager {
 	if len(proxyConfig.Hooks.OnStartup.Preload) > 0 {
 		// do it in the background, don't block startup -- not sure if good idea yet
 		go func() {
-			discardWriter := &DiscardWriter{}
 			for _, preloadModelName := range proxyConfig.Hooks.OnStartup.Preload {
 				modelID, ok := proxyConfig.RealModelName(preloadModelName)
 
@@ -207,10 +261,13 @@ func New(proxyConfig config.Config) *ProxyManager {
 					continue
 				}
 
-				proxyLogger.Infof("Preloading model: %s", modelID)
-				processGroup, err := pm.swapProcessGroup(modelID)
+				// kept running through a config reload
+				if replicas, ok := kept[modelID]; ok && replicas[0].CurrentState() == StateReady {
+					continue
+				}
 
-				if err != nil {
+				proxyLogger.Infof("Preloading model: %s", modelID)
+				if err := pm.loadModel(modelID); err != nil {
 					event.Emit(ModelPreloadedEvent{
 						ModelName: modelID,
 						Success:   false,
@@ -218,8 +275,6 @@ func New(proxyConfig config.Config) *ProxyManager {
 					proxyLogger.Errorf("Failed to preload model %s: %v", modelID, err)
 					continue
 				} else {
-					req, _ := http.NewRequest("GET", "/", nil)
-					processGroup.ProxyRequest(modelID, discardWriter, req)
 					event.Emit(ModelPreloadedEvent{
 						ModelName: modelID,
 						Success:   true,
@@ -232,6 +287,33 @@ func New(proxyConfig config.Config) *ProxyManager {
 	return pm
 }
 
+// newLoggers creates the mux, upstream and proxy loggers for the logToStdout setting
+func newLoggers(proxyConfig config.Config) (muxLogger, upstreamLogger, proxyLogger *LogMonitor) {
+	switch proxyConfig.LogToStdout {
+	case config.LogToStdoutNone:
+		muxLogger = NewLogMonitorWriter(io.Discard)
+		upstreamLogger = NewLogMonitorWriter(io.Discard)
+		proxyLogger = NewLogMonitorWriter(io.Discard)
+	case config.LogToStdoutBoth:
+		muxLogger = NewLogMonitorWriter(os.Stdout)
+		upstreamLogger = NewLogMonitorWriter(muxLogger)
+		proxyLogger = NewLogMonitorWriter(muxLogger)
+	case config.LogToStdoutUpstream:
+		muxLogger = NewLogMonitorWriter(os.Stdout)
+		upstreamLogger = NewLogMonitorWriter(muxLogger)
+		proxyLogger = NewLogMonitorWriter(io.Discard)
+	default:
+		// same as config.LogToStdoutProxy
+		// helpful because some old tests create a config.Config directly and it
+		// may not have LogToStdout set explicitly
+		muxLogger = NewLogMonitorWriter(os.Stdout)
+		upstreamLogger = NewLogMonitorWriter(io.Discard)
+		proxyLogger = NewLogMonitorWriter(muxLogger)
+	}
+
+	return muxLogger, upstreamLogger, proxyLogger
+}
+
 func (pm *ProxyManager) setupGinEngine() {
 
 	pm.ginEngine.Use(func(c *gin.Context) {
@@ -489,12 +571,44 @@ func (pm *ProxyManager) Shutdown() {
 	pm.shutdownCancel()
 }
 
-func (pm *ProxyManager) swapProcessGroup(realModelName string) (*ProcessGroup, error) {
+// resolveModelName finds the model ID for a requested model name. The name can be a
+// model ID, an alias or `profile:model`, in which case the profile is also returned.
+func (pm *ProxyManager) resolveModelName(requestedModel string) (modelID string, profileName string, found bool) {
+	if modelID, found := pm.config.RealModelName(requestedModel); found {
+		return modelID, "", true
+	}
+	if profileName, modelID, found := pm.config.ProfileModel(requestedModel); found {
+		return modelID, profileName, true
+	}
+	return "", "", false
+}
+
+// swapProcessGroup makes sure the group of realModelName can run and returns it. When
+// profileName is set all the models in the profile run together as a unit: everything
+// else is stopped and they are all started.
+func (pm *ProxyManager) swapProcessGroup(realModelName string, profileName string) (*ProcessGroup, error) {
+	if profileName != "" {
+		return pm.swapProfile(profileName, realModelName)
+	}
+
 	processGroup := pm.findGroupByModelName(realModelName)
 	if processGroup == nil {
 		return nil, fmt.Errorf("could not find process group for model %s", realModelName)
 	}
 
+	pm.Lock()
+	activeProfile := pm.activeProfile
+	pm.Unlock()
+	if profileGroup, ok := pm.profileGroups[activeProfile]; ok {
+		// running models of the active profile are used as they are
+		if process, ok := profileGroup.GetMember(realModelName); ok {
+			if state := process.CurrentState(); state == StateReady || state == StateStarting {
+				return profileGroup, nil
+			}
+		}
+		pm.leaveProfile(activeProfile)
+	}
+
 	if processGroup.exclusive {
 		pm.proxyLogger.Debugf("Exclusive mode for group %s, stopping other process groups", processGroup.id)
 		for groupId, otherGroup := range pm.processGroups {
@@ -507,6 +621,95 @@ func (pm *ProxyManager) swapProcessGroup(realModelName string) (*ProcessGroup, e
 	return processGroup, nil
 }
 
+// swapProfile stops every model that is not in the profile, except ones in persistent
+// groups, and starts the models of the profile that are not running
+func (pm *ProxyManager) swapProfile(profileName string, realModelName string) (*ProcessGroup, error) {
+	profileGroup, ok := pm.profileGroups[profileName]
+	if !ok || !profileGroup.HasMember(realModelName) {
+		return nil, fmt.Errorf("model %s is not part of profile %s", realModelName, profileName)
+	}
+
+	pm.Lock()
+	previousProfile := pm.activeProfile
+	pm.activeProfile = profileName
+	pm.Unlock()
+
+	if previousProfile != profileName {
+		pm.proxyLogger.Infof("Swapping to profile %s", profileName)
+
+		var wg sync.WaitGroup
+		for _, group := range pm.processGroups {
+			if group.persistent {
+				continue
+			}
+			for modelID := range group.processes {
+				if profileGroup.HasMember(modelID) {
+					continue
+				}
+				wg.Add(1)
+				go func(group *ProcessGroup, modelID string) {
+					defer wg.Done()
+					group.StopProcess(modelID, StopWaitForInflightRequest)
+				}(group, modelID)
+			}
+		}
+		wg.Wait()
+	}
+
+	// the other models load in parallel with the requested one
+	for modelID, process := range profileGroup.processes {
+		if modelID == realModelName || process.CurrentState() != StateStopped {
+			continue
+		}
+		go func(modelID string) {
+			req, _ := http.NewRequest("GET", "/", nil)
+			if err := profileGroup.ProxyRequest(modelID, &DiscardWriter{}, req); err != nil {
+				pm.proxyLogger.Errorf("Failed to start %s for profile %s: %v", modelID, profileName, err)
+			}
+		}(modelID)
+	}
+
+	return profileGroup, nil
+}
+
+// leaveProfile stops the models of a profile, except ones in persistent groups,
+// when a model outside of it is requested
+func (pm *ProxyManager) leaveProfile(profileName string) {
+	pm.Lock()
+	if pm.activeProfile != profileName {
+		pm.Unlock()
+		return
+	}
+	pm.activeProfile = ""
+	pm.Unlock()
+
+	pm.proxyLogger.Infof("Leaving profile %s", profileName)
+	var wg sync.WaitGroup
+	for modelID := range pm.profileGroups[profileName].processes {
+		group := pm.findGroupByModelName(modelID)
+		if group == nil || group.persistent {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			group.StopProcess(modelID, StopWaitForInflightRequest)
+		}()
+	}
+	wg.Wait()
+}
+
+// loadModel swaps in the model's process group and sends it a request so it starts
+func (pm *ProxyManager) loadModel(modelID string) error {
+	processGroup, err := pm.swapProcessGroup(modelID, "")
+	if err != nil {
+		return err
+	}
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	return processGroup.ProxyRequest(modelID, &DiscardWriter{}, req)
+}
+
 func (pm *ProxyManager) listModelsHandler(c *gin.Context) {
 	data := make([]gin.H, 0, len(pm.config.Models))
 
@@ -575,6 +778,15 @@ func (pm *ProxyManager) listModelsHandler(c *gin.Context) {
 		}
 	}
 
+	// Include profile:model names
+	for profileName, members := range pm.config.Profiles {
+		for _, modelID := range members {
+			if modelConfig := pm.config.Models[modelID]; !modelConfig.Unlisted {
+				data = append(data, newRecord(profileName+PROFILE_SPLIT_CHAR+modelID, modelConfig))
+			}
+		}
+	}
+
 	if pm.peerProxy != nil {
 		for peerID, peer := range pm.peerProxy.ListPeers() {
 			// add peer models
@@ -630,7 +842,7 @@ func (pm *ProxyManager) findModelInPath(path string) (searchName string, realNam
 			searchModelName = searchModelName + "/" + part
 		}
 
-		if modelID, ok := pm.config.RealModelName(searchModelName); ok {
+		if modelID, _, ok := pm.resolveModelName(searchModelName); ok {
 			return searchModelName, modelID, "/" + strings.Join(parts[i+1:], "/"), true
 		}
 	}
@@ -665,7 +877,8 @@ func (pm *ProxyManager) proxyToUpstream(c *gin.Context) {
 		return
 	}
 
-	processGroup, err := pm.swapProcessGroup(modelID)
+	_, profileName, _ := pm.resolveModelName(searchModelName)
+	processGroup, err := pm.swapProcessGroup(modelID, profileName)
 	if err != nil {
 		pm.sendErrorResponse(c, http.StatusInternalServerError, fmt.Sprintf("error swapping process group: %s", err.Error()))
 		return
@@ -674,6 +887,7 @@ func (pm *ProxyManager) proxyToUpstream(c *gin.Context) {
 	// rewrite the path
 	originalPath := c.Request.URL.Path
 	c.Request.URL.Path = remainingPath
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), proxyCtxKey("priority"), pm.requestPriority(c)))
 
 	// attempt to record metrics if it is a POST request
 	if pm.metricsMonitor != nil && c.Request.Method == "POST" {
@@ -715,9 +929,9 @@ func (pm *ProxyManager) proxyInferenceHandler(c *gin.Context) {
 	// Look for a matching local model first
 	var nextHandler func(modelID string, w http.ResponseWriter, r *http.Request) error
 
-	modelID, found := pm.config.RealModelName(requestedModel)
+	modelID, profileName, found := pm.resolveModelName(requestedModel)
 	if found {
-		processGroup, err := pm.swapProcessGroup(modelID)
+		processGroup, err := pm.swapProcessGroup(modelID, profileName)
 		if err != nil {
 			pm.sendErrorResponse(c, http.StatusInternalServerError, fmt.Sprintf("error swapping process group: %s", err.Error()))
 			return
@@ -865,6 +1079,7 @@ func (pm *ProxyManager) proxyInferenceHandler(c *gin.Context) {
 	isStreaming := gjson.GetBytes(bodyBytes, "stream").Bool()
 	ctx := context.WithValue(c.Request.Context(), proxyCtxKey("streaming"), isStreaming)
 	ctx = context.WithValue(ctx, proxyCtxKey("model"), modelID)
+	ctx = context.WithValue(ctx, proxyCtxKey("priority"), pm.requestPriority(c))
 	c.Request = c.Request.WithContext(ctx)
 
 	if pm.metricsMonitor != nil && c.Request.Method == "POST" {
@@ -951,9 +1166,9 @@ func (pm *ProxyManager) proxyOAIPostFormHandler(c *gin.Context) {
 	var nextHandler func(modelID string, w http.ResponseWriter, r *http.Request) error
 	var useModelName string
 
-	modelID, found := pm.config.RealModelName(requestedModel)
+	modelID, profileName, found := pm.resolveModelName(requestedModel)
 	if found {
-		processGroup, err := pm.swapProcessGroup(modelID)
+		processGroup, err := pm.swapProcessGroup(modelID, profileName)
 		if err != nil {
 			pm.sendErrorResponse(c, http.StatusInternalServerError, fmt.Sprintf("error swapping process group: %s", err.Error()))
 			return
@@ -1071,8 +1286,8 @@ func (pm *ProxyManager) proxyGETModelHandler(c *gin.Context) {
 	var nextHandler func(modelID string, w http.ResponseWriter, r *http.Request) error
 	var modelID string
 
-	if realModelID, found := pm.config.RealModelName(requestedModel); found {
-		processGroup, err := pm.swapProcessGroup(realModelID)
+	if realModelID, profileName, found := pm.resolveModelName(requestedModel); found {
+		processGroup, err := pm.swapProcessGroup(realModelID, profileName)
 		if err != nil {
 			pm.sendErrorResponse(c, http.StatusInternalServerError, fmt.Sprintf("error swapping process group: %s", err.Error()))
 			return
@@ -1108,6 +1323,36 @@ func (pm *ProxyManager) sendErrorResponse(c *gin.Context, statusCode int, messag
 	}
 }
 
+// requestAPIKey returns the API key sent with a request. The first key found is used:
+// Basic, then Bearer, then x-api-key
+func requestAPIKey(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		if strings.HasPrefix(auth, "Basic ") {
+			// Basic Auth: base64(username:password), password is the API key
+			encoded := strings.TrimPrefix(auth, "Basic ")
+			if decoded, err := base64.StdEncoding.DecodeString(encoded); err == nil {
+				parts := strings.SplitN(string(decoded), ":", 2)
+				if len(parts) == 2 && parts[1] != "" {
+					return parts[1] // password is the API key
+				}
+			}
+		} else if bearerKey := strings.TrimPrefix(auth, "Bearer "); bearerKey != auth && bearerKey != "" {
+			return bearerKey
+		}
+	}
+	return r.Header.Get("x-api-key")
+}
+
+// requestPriority returns the priority of a request in a model's queue
+func (pm *ProxyManager) requestPriority(c *gin.Context) int {
+	// apiKeyAuth strips the key from the request
+	apiKey := c.GetString(apiKeyContextKey)
+	if apiKey == "" {
+		apiKey = requestAPIKey(c.Request)
+	}
+	return pm.config.RequestPriority(c.GetHeader("X-LlamaSwap-Priority"), apiKey)
+}
+
 // apiKeyAuth returns a middleware that validates API keys if configured.
 // Returns a pass-through handler if no API keys are configured.
 func (pm *ProxyManager) apiKeyAuth() gin.HandlerFunc {
@@ -1116,34 +1361,7 @@ func (pm *ProxyManager) apiKeyAuth() gin.HandlerFunc {
 	}
 
 	return func(c *gin.Context) {
-		xApiKey := c.GetHeader("x-api-key")
-
-		var bearerKey string
-		var basicKey string
-		if auth := c.GetHeader("Authorization"); auth != "" {
-			if strings.HasPrefix(auth, "Bearer ") {
-				bearerKey = strings.TrimPrefix(auth, "Bearer ")
-			} else if strings.HasPrefix(auth, "Basic ") {
-				// Basic Auth: base64(username:password), password is the API key
-				encoded := strings.TrimPrefix(auth, "Basic ")
-				if decoded, err := base64.StdEncoding.DecodeString(encoded); err == nil {
-					parts := strings.SplitN(string(decoded), ":", 2)
-					if len(parts) == 2 {
-						basicKey = parts[1] // password is the API key
-					}
-				}
-			}
-		}
-
-		// Use first key found: Basic, then Bearer, then x-api-key
-		var providedKey string
-		if basicKey != "" {
-			providedKey = basicKey
-		} else if bearerKey != "" {
-			providedKey = bearerKey
-		} else {
-			providedKey = xApiKey
-		}
+		providedKey := requestAPIKey(c.Request)
 
 		// Validate key
 		valid := false
@@ -1162,6 +1380,7 @@ func (pm *ProxyManager) apiKeyAuth() gin.HandlerFunc {
 		}
 
 		// Strip auth headers to prevent leakage to upstream
+		c.Set(apiKeyContextKey, providedKey)
 		c.Request.Header.Del("Authorization")
 		c.Request.Header.Del("x-api-key")
 
@@ -1179,16 +1398,20 @@ func (pm *ProxyManager) listRunningProcessesHandler(context *gin.Context) {
 	runningProcesses := make([]gin.H, 0) // Default to an empty response.
 
 	for _, processGroup := range pm.processGroups {
-		for _, process := range processGroup.processes {
+		for _, process := range processGroup.allProcesses() {
 			if process.CurrentState() == StateReady {
+				proxyURL, _ := process.upstream()
 				runningProcesses = append(runningProcesses, gin.H{
 					"model":       process.ID,
+					"replica":     process.replica,
 					"state":       process.state,
-					"cmd":         process.config.Cmd,
-					"proxy":       process.config.Proxy,
+					"cmd":         process.config.Redact(process.command()),
+					"proxy":       proxyURL,
+					"port":        process.Port(),
 					"ttl":         process.config.UnloadAfter,
 					"name":        process.config.Name,
 					"description": process.config.Description,
+					"lastExit":    process.LastExit(),
 				})
 			}
 		}
@@ -3,7 +3,9 @@ package proxy
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"sort"
 	"strconv"
@@ -11,6 +13,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/mostlygeek/llama-swap/event"
+	"github.com/mostlygeek/llama-swap/proxy/config"
 )
 
 type Model struct {
@@ -23,6 +26,14 @@ type Model struct {
 	ParameterSize     string   `json:"parameter_size,omitempty"`
 	QuantizationLevel string   `json:"quantization_level,omitempty"`
 	Capabilities      []string `json:"capabilities,omitempty"`
+	Port              int      `json:"port,omitempty"`
+	Profiles          []string `json:"profiles,omitempty"`
+
+	// how the model's upstream command last exited
+	LastExit *ExitRecord `json:"lastExit,omitempty"`
+
+	// ready replicas of a model with more than one
+	Replicas int `json:"replicas,omitempty"`
 }
 
 func addApiHandlers(pm *ProxyManager) {
@@ -36,6 +47,10 @@ func addApiHandlers(pm *ProxyManager) {
 		apiGroup.GET("/metrics", pm.apiGetMetrics)
 		apiGroup.GET("/llamaswap/version", pm.apiGetVersion)
 		apiGroup.GET("/captures/:id", pm.apiGetCapture)
+		apiGroup.GET("/config", pm.apiGetConfig)
+		apiGroup.POST("/config/models/*id", pm.apiCreateModel)
+		apiGroup.PUT("/config/models/*id", pm.apiUpdateModel)
+		apiGroup.DELETE("/config/models/*id", pm.apiDeleteModel)
 	}
 }
 
@@ -54,11 +69,25 @@ func (pm *ProxyManager) getModelStatus() []Model {
 	}
 	sort.Strings(modelIDs)
 
+	// profiles each model is a member of
+	profiles := make(map[string][]string)
+	for profileName, members := range pm.config.Profiles {
+		for _, modelID := range members {
+			profiles[modelID] = append(profiles[modelID], profileName)
+		}
+	}
+	for _, names := range profiles {
+		sort.Strings(names)
+	}
+
 	// Iterate over sorted keys
 	for _, modelID := range modelIDs {
 		// Get process state
 		processGroup := pm.findGroupByModelName(modelID)
 		state := "unknown"
+		port := 0
+		var lastExit *ExitRecord
+		replicas := 0
 		details, caps := pm.getModelDetails(pm.config.Models[modelID], modelID)
 
 		if processGroup != nil {
@@ -80,6 +109,19 @@ func (pm *ProxyManager) getModelStatus() []Model {
 					stateStr = "unknown"
 				}
 				state = stateStr
+
+				// only report the port while the upstream is using it
+				if stateStr == "ready" || stateStr == "starting" {
+					port = process.Port()
+				}
+				lastExit = process.LastExit()
+			}
+			if len(processGroup.replicas[modelID]) > 1 {
+				for _, replica := range processGroup.replicas[modelID] {
+					if replica.CurrentState() == StateReady {
+						replicas++
+					}
+				}
 			}
 		}
 		models = append(models, Model{
@@ -91,6 +133,10 @@ func (pm *ProxyManager) getModelStatus() []Model {
 			ParameterSize:     details.ParameterSize,
 			QuantizationLevel: details.QuantizationLevel,
 			Capabilities:      caps,
+			Port:              port,
+			Profiles:          profiles[modelID],
+			LastExit:          lastExit,
+			Replicas:          replicas,
 		})
 	}
 
@@ -115,6 +161,7 @@ const (
 	msgTypeModelStatus messageType = "modelStatus"
 	msgTypeLogData     messageType = "logData"
 	msgTypeMetrics     messageType = "metrics"
+	msgTypeScaling     messageType = "scaling"
 )
 
 type messageEnvelope struct {
@@ -184,6 +231,21 @@ func (pm *ProxyManager) apiSendEvents(c *gin.Context) {
 		sendModels()
 	})()
 
+	/**
+	 * Send scaling decisions
+	 */
+	defer event.On(func(e ModelScaledEvent) {
+		data, err := json.Marshal(e)
+		if err == nil {
+			select {
+			case sendBuffer <- messageEnvelope{Type: msgTypeScaling, Data: string(data)}:
+			case <-ctx.Done():
+				return
+			default:
+			}
+		}
+	})()
+
 	/**
 	 * Send Log data
 	 */
@@ -233,7 +295,7 @@ func (pm *ProxyManager) apiGetMetrics(c *gin.Context) {
 
 func (pm *ProxyManager) apiUnloadSingleModelHandler(c *gin.Context) {
 	requestedModel := strings.TrimPrefix(c.Param("model"), "/")
-	realModelName, found := pm.config.RealModelName(requestedModel)
+	realModelName, _, found := pm.resolveModelName(requestedModel)
 	if !found {
 		pm.sendErrorResponse(c, http.StatusNotFound, "Model not found")
 		return
@@ -277,3 +339,158 @@ func (pm *ProxyManager) apiGetCapture(c *gin.Context) {
 
 	c.JSON(http.StatusOK, capture)
 }
+
+func (pm *ProxyManager) apiGetConfig(c *gin.Context) {
+	if !configAPIAllowed(c, pm.config) {
+		return
+	}
+	c.JSON(http.StatusOK, pm.config.Resolve())
+}
+
+// configAPIAllowed writes a 403 unless apiKeys are configured. The configuration has
+// the expanded cmd of every model and models run any cmd, so it is only read and
+// changed by clients with a key.
+func configAPIAllowed(c *gin.Context, proxyConfig config.Config) bool {
+	if len(proxyConfig.RequiredAPIKeys) > 0 {
+		return true
+	}
+	c.JSON(http.StatusForbidden, gin.H{"error": "the configuration API requires apiKeys to be configured"})
+	return false
+}
+
+func (pm *ProxyManager) apiCreateModel(c *gin.Context) {
+	modelID := configModelID(c)
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read request body"})
+		return
+	}
+
+	pm.apiChangeConfig(c, http.StatusCreated, func(current *ProxyManager, source *config.Source) (*config.Source, int, error) {
+		if _, found := current.config.RealModelName(modelID); found {
+			return nil, http.StatusConflict, fmt.Errorf("model %s already exists", modelID)
+		}
+		newSource, err := source.SetModel(modelID, body)
+		return newSource, http.StatusBadRequest, err
+	})
+}
+
+func (pm *ProxyManager) apiUpdateModel(c *gin.Context) {
+	modelID := configModelID(c)
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read request body"})
+		return
+	}
+
+	pm.apiChangeConfig(c, http.StatusOK, func(current *ProxyManager, source *config.Source) (*config.Source, int, error) {
+		if status, err := modelInSource(current, source, modelID); err != nil {
+			return nil, status, err
+		}
+		newSource, err := source.SetModel(modelID, body)
+		return newSource, http.StatusBadRequest, err
+	})
+}
+
+func (pm *ProxyManager) apiDeleteModel(c *gin.Context) {
+	modelID := configModelID(c)
+	pm.apiChangeConfig(c, http.StatusOK, func(current *ProxyManager, source *config.Source) (*config.Source, int, error) {
+		if status, err := modelInSource(current, source, modelID); err != nil {
+			return nil, status, err
+		}
+		newSource, err := source.DeleteModel(modelID)
+		return newSource, http.StatusBadRequest, err
+	})
+}
+
+// configModelID is the model ID of a /api/config/models request, IDs can contain slashes
+func configModelID(c *gin.Context) string {
+	return strings.TrimPrefix(c.Param("id"), "/")
+}
+
+// modelInSource checks that modelID can be changed in the main config file
+func modelInSource(current *ProxyManager, source *config.Source, modelID string) (int, error) {
+	if _, found := current.config.Models[modelID]; !found {
+		return http.StatusNotFound, fmt.Errorf("model %s not found", modelID)
+	}
+	found, err := source.HasModel(modelID)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if !found {
+		return http.StatusConflict, fmt.Errorf("model %s is defined in an included file and can not be changed through the API", modelID)
+	}
+	return http.StatusOK, nil
+}
+
+// apiChangeConfig applies a change to the YAML source of the configuration. The
+// result is validated like a config file and, when valid, applied by reloading.
+// Only models whose configuration changed are restarted. With ?persist=true the
+// YAML is also written back to the config file.
+func (pm *ProxyManager) apiChangeConfig(c *gin.Context, successStatus int, change func(current *ProxyManager, source *config.Source) (*config.Source, int, error)) {
+	editor := pm.configEditor
+	editor.Lock()
+	defer editor.Unlock()
+
+	if editor.source == nil {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "the configuration can not be changed at runtime"})
+		return
+	}
+
+	if configModelID(c) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "a model ID is required"})
+		return
+	}
+
+	// another change may have been applied since this request started
+	current := editor.current
+
+	if !configAPIAllowed(c, current.config) {
+		return
+	}
+
+	newSource, status, err := change(current, editor.source)
+	if err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	newConfig, err := newSource.Load()
+	if err != nil {
+		var messages []string
+		var validationErrs config.ValidationErrors
+		if errors.As(err, &validationErrs) {
+			for _, e := range validationErrs {
+				messages = append(messages, e.Error())
+			}
+		} else {
+			messages = append(messages, err.Error())
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid configuration", "errors": messages})
+		return
+	}
+
+	persist := c.Query("persist") == "true"
+	if persist {
+		if err := newSource.Save(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to save configuration: %v", err)})
+			return
+		}
+	}
+
+	// saving writes the earlier changes that were not persisted too
+	editor.source = newSource
+	editor.unsaved = !persist
+	current.proxyLogger.Infof("Model %s changed through the API", configModelID(c))
+	newPM := current.reload(newConfig)
+	if editor.onReload != nil {
+		editor.onReload(newPM)
+	}
+
+	modelID := configModelID(c)
+	if model, found := newConfig.Resolve().Models[modelID]; found {
+		c.JSON(successStatus, model)
+	} else {
+		c.JSON(successStatus, gin.H{"msg": "ok"})
+	}
+}
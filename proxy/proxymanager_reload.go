@@ -0,0 +1,237 @@
+package proxy
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/mostlygeek/llama-swap/event"
+	"github.com/mostlygeek/llama-swap/proxy/config"
+)
+
+// configEditor is shared by a ProxyManager and the ones that replace it on reload.
+// It serializes reloads and holds what is needed to change the configuration at
+// runtime through the API.
+type configEditor struct {
+	sync.Mutex
+
+	// the ProxyManager using the latest configuration
+	current *ProxyManager
+
+	// YAML of the current configuration, nil when it can not be edited
+	source *config.Source
+
+	// source has changes made through the API that were not written to the config file
+	unsaved bool
+
+	// called with the new ProxyManager after a change made through the API or a
+	// reload of the config file
+	onReload func(*ProxyManager)
+}
+
+// SetConfigSource sets the YAML the current configuration was loaded from. It
+// enables the API to change models at runtime.
+func (pm *ProxyManager) SetConfigSource(source *config.Source) {
+	pm.configEditor.Lock()
+	defer pm.configEditor.Unlock()
+	pm.configEditor.source = source
+}
+
+// OnReload sets the function called with the new ProxyManager when the configuration
+// is changed through the API or by ReloadConfigFile. It should start routing requests
+// to it.
+func (pm *ProxyManager) OnReload(callback func(newPM *ProxyManager)) {
+	pm.configEditor.Lock()
+	defer pm.configEditor.Unlock()
+	pm.configEditor.onReload = callback
+}
+
+// reloadPlan is what happens to each model when moving to a new configuration
+type reloadPlan struct {
+	kept    map[string][]*Process
+	stopped []*Process
+
+	// models that were running and have to be started again
+	restart []string
+}
+
+// Reload applies a new configuration and returns the ProxyManager to use from now on.
+// Only models whose configuration changed are stopped. Unchanged models keep running,
+// and keep serving requests, while the reload happens. Changed models that were
+// running are started again with their new configuration.
+//
+// pm must not be used after calling Reload.
+func (pm *ProxyManager) Reload(newConfig config.Config) *ProxyManager {
+	pm.configEditor.Lock()
+	defer pm.configEditor.Unlock()
+	return pm.reload(newConfig)
+}
+
+// ReloadConfigFile applies the configuration loaded again from the config file, source
+// is its YAML. The ProxyManager with the latest configuration is reloaded, it replaced
+// pm when the configuration was changed through the API. Changes made through the API
+// that were not persisted to the config file are discarded.
+func (pm *ProxyManager) ReloadConfigFile(source *config.Source, newConfig config.Config) *ProxyManager {
+	editor := pm.configEditor
+	editor.Lock()
+	defer editor.Unlock()
+
+	if editor.unsaved {
+		editor.current.proxyLogger.Warn("Reload: discarding changes made through the API that were not persisted")
+	}
+
+	newPM := editor.current.reload(newConfig)
+	editor.source = source
+	editor.unsaved = false
+	if editor.onReload != nil {
+		editor.onReload(newPM)
+	}
+	return newPM
+}
+
+// reload is Reload, the caller must hold the configEditor lock
+func (pm *ProxyManager) reload(newConfig config.Config) *ProxyManager {
+	// processes write to the loggers so they can not be swapped out under them
+	if pm.config.LogToStdout != newConfig.LogToStdout {
+		pm.proxyLogger.Info("logToStdout changed, restarting all models")
+		pm.Shutdown()
+		newPM := New(newConfig)
+		newPM.configEditor = pm.configEditor
+		newPM.configEditor.current = newPM
+		newPM.SetVersion(pm.buildDate, pm.commit, pm.version)
+		return newPM
+	}
+
+	plan := pm.planReload(newConfig)
+
+	// in-flight requests to changed models are allowed to finish first
+	var wg sync.WaitGroup
+	for _, process := range plan.stopped {
+		wg.Add(1)
+		go func(process *Process) {
+			defer wg.Done()
+			process.Stop()
+			process.Shutdown()
+			// a Stopped process can not transition to shutdown by itself
+			process.forceState(StateShutdown)
+		}(process)
+	}
+	wg.Wait()
+
+	newPM := newProxyManager(newConfig, pm, plan.kept)
+
+	// kept processes outlive the old ProxyManager, only its event streams end
+	pm.shutdownCancel()
+
+	if len(plan.restart) > 0 {
+		go func() {
+			for _, modelID := range plan.restart {
+				newPM.proxyLogger.Infof("Reload: starting %s with its new configuration", modelID)
+				if err := newPM.loadModel(modelID); err != nil {
+					newPM.proxyLogger.Errorf("Reload: failed to start %s: %v", modelID, err)
+				}
+			}
+		}()
+	}
+
+	return newPM
+}
+
+// planReload compares the running configuration with newConfig and decides which
+// processes are kept. Every decision is logged and emitted as a ModelReloadEvent.
+func (pm *ProxyManager) planReload(newConfig config.Config) reloadPlan {
+	pm.RLock()
+	defer pm.RUnlock()
+
+	plan := reloadPlan{kept: make(map[string][]*Process)}
+	decide := func(modelID string, action ModelReloadAction, reason string) {
+		if reason == "" {
+			pm.proxyLogger.Infof("Reload: %s %s", modelID, action)
+		} else {
+			pm.proxyLogger.Infof("Reload: %s %s, %s", modelID, action, reason)
+		}
+		event.Emit(ModelReloadEvent{ModelID: modelID, Action: action, Reason: reason})
+	}
+
+	modelIDs := make([]string, 0, len(pm.config.Models))
+	for modelID := range pm.config.Models {
+		modelIDs = append(modelIDs, modelID)
+	}
+	sort.Strings(modelIDs)
+
+	for _, modelID := range modelIDs {
+		groupID, _ := pm.config.ModelGroup(modelID)
+		processGroup, ok := pm.processGroups[groupID]
+		if !ok {
+			continue
+		}
+		replicas, ok := processGroup.replicas[modelID]
+		if !ok {
+			continue
+		}
+
+		if _, found := newConfig.Models[modelID]; !found {
+			plan.stopped = append(plan.stopped, replicas...)
+			decide(modelID, ModelReloadRemoved, "")
+			continue
+		}
+
+		reason := pm.reloadReason(modelID, newConfig)
+		if reason == "" {
+			plan.kept[modelID] = replicas
+			decide(modelID, ModelReloadKept, "")
+			continue
+		}
+
+		plan.stopped = append(plan.stopped, replicas...)
+		if isRunning(replicas) {
+			plan.restart = append(plan.restart, modelID)
+			decide(modelID, ModelReloadRestarted, reason)
+		} else {
+			decide(modelID, ModelReloadUpdated, reason)
+		}
+	}
+
+	added := make([]string, 0)
+	for modelID := range newConfig.Models {
+		if _, found := pm.config.Models[modelID]; !found {
+			added = append(added, modelID)
+		}
+	}
+	sort.Strings(added)
+	for _, modelID := range added {
+		decide(modelID, ModelReloadAdded, "")
+	}
+
+	return plan
+}
+
+// reloadReason returns why modelID can not keep running with newConfig, or an empty
+// string when its process can be kept
+func (pm *ProxyManager) reloadReason(modelID string, newConfig config.Config) string {
+	oldModel, newModel := pm.config.Models[modelID], newConfig.Models[modelID]
+
+	// with dynamic ports the assigned port is only where the search for a free one starts
+	if oldModel.DynamicPort && newModel.DynamicPort {
+		oldModel.Port, newModel.Port = 0, 0
+	}
+	if !oldModel.Equal(newModel) {
+		return "configuration changed"
+	}
+
+	if pm.config.HealthCheckTimeout != newConfig.HealthCheckTimeout {
+		return "healthCheckTimeout changed"
+	}
+
+	oldGroupID, _ := pm.config.ModelGroup(modelID)
+	newGroupID, _ := newConfig.ModelGroup(modelID)
+	if oldGroupID != newGroupID {
+		return "group changed"
+	}
+
+	oldGroup, newGroup := pm.config.Groups[oldGroupID], newConfig.Groups[newGroupID]
+	if oldGroup.Swap != newGroup.Swap || oldGroup.Exclusive != newGroup.Exclusive || oldGroup.Persistent != newGroup.Persistent {
+		return "group settings changed"
+	}
+
+	return ""
+}
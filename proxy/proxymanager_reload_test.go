@@ -0,0 +1,225 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mostlygeek/llama-swap/event"
+	"github.com/mostlygeek/llama-swap/proxy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func loadReloadTestConfig(t *testing.T, configStr string) config.Config {
+	t.Helper()
+	configStr = strings.ReplaceAll(configStr, "${simpleresponderpath}", simpleResponderPath)
+	conf, err := config.LoadConfigFromReader(strings.NewReader(configStr))
+	if err != nil {
+		t.Fatalf("invalid configuration: %v", err)
+	}
+	return conf
+}
+
+func TestProxyManager_Reload(t *testing.T) {
+	pm := New(loadReloadTestConfig(t, `
+logLevel: error
+groups:
+  reloadGroup:
+    swap: false
+    members: [model1, model2]
+models:
+  model1:
+    cmd: ${simpleresponderpath} --port ${PORT} --silent --respond model1
+  model2:
+    cmd: ${simpleresponderpath} --port ${PORT} --silent --respond model2
+  model3:
+    cmd: ${simpleresponderpath} --port ${PORT} --silent --respond model3
+`))
+
+	for _, modelName := range []string{"model1", "model2"} {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"`+modelName+`"}`))
+		w := CreateTestResponseRecorder()
+		pm.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	oldModel1, _ := pm.processGroups["reloadGroup"].GetMember("model1")
+	oldModel2, _ := pm.processGroups["reloadGroup"].GetMember("model2")
+	oldModel3, _ := pm.findGroupByModelName("model3").GetMember("model3")
+
+	var mu sync.Mutex
+	actions := make(map[string]ModelReloadAction)
+	defer event.On(func(e ModelReloadEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		actions[e.ModelID] = e.Action
+	})()
+
+	newPM := pm.Reload(loadReloadTestConfig(t, `
+logLevel: error
+groups:
+  reloadGroup:
+    swap: false
+    members: [model1, model2]
+models:
+  model1:
+    cmd: ${simpleresponderpath} --port ${PORT} --silent --respond model1
+  model2:
+    cmd: ${simpleresponderpath} --port ${PORT} --silent --respond model2-updated
+  model4:
+    cmd: ${simpleresponderpath} --port ${PORT} --silent --respond model4
+`))
+	defer newPM.StopProcesses(StopWaitForInflightRequest)
+
+	// events are delivered asynchronously
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(actions) == 4
+	}, time.Second, 10*time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, map[string]ModelReloadAction{
+		"model1": ModelReloadKept,
+		"model2": ModelReloadRestarted,
+		"model3": ModelReloadRemoved,
+		"model4": ModelReloadAdded,
+	}, actions)
+	mu.Unlock()
+
+	// the unchanged model kept running in the same process
+	newModel1, _ := newPM.processGroups["reloadGroup"].GetMember("model1")
+	assert.Same(t, oldModel1, newModel1)
+	assert.Equal(t, StateReady, newModel1.CurrentState())
+
+	// the changed model was replaced and is started again in the background
+	newModel2, _ := newPM.processGroups["reloadGroup"].GetMember("model2")
+	assert.NotSame(t, oldModel2, newModel2)
+	assert.Equal(t, StateShutdown, oldModel2.CurrentState())
+	assert.Eventually(t, func() bool {
+		return newModel2.CurrentState() == StateReady
+	}, 5*time.Second, 50*time.Millisecond)
+
+	assert.Equal(t, StateShutdown, oldModel3.CurrentState())
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"model2"}`))
+	w := CreateTestResponseRecorder()
+	newPM.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "model2-updated")
+}
+
+func TestProxyManager_ReloadUpdatesStoppedModels(t *testing.T) {
+	pm := New(loadReloadTestConfig(t, `
+logLevel: error
+healthCheckTimeout: 15
+models:
+  model1:
+    cmd: ${simpleresponderpath} --port ${PORT} --silent --respond model1
+`))
+	oldModel1, _ := pm.findGroupByModelName("model1").GetMember("model1")
+
+	newPM := pm.Reload(loadReloadTestConfig(t, `
+logLevel: error
+healthCheckTimeout: 30
+models:
+  model1:
+    cmd: ${simpleresponderpath} --port ${PORT} --silent --respond model1
+`))
+	defer newPM.StopProcesses(StopWaitForInflightRequest)
+
+	// changing a global setting that processes use replaces them, stopped ones are not started
+	newModel1, _ := newPM.findGroupByModelName("model1").GetMember("model1")
+	assert.NotSame(t, oldModel1, newModel1)
+	assert.Equal(t, 30, newModel1.healthCheckTimeout)
+	assert.Equal(t, StateStopped, newModel1.CurrentState())
+}
+
+func TestProxyManager_ReloadKeepsModelsOnSecretChange(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "api_key")
+	configStr := `
+logLevel: error
+apiKeys: ["${file:` + filepath.ToSlash(keyFile) + `}"]
+models:
+  model1:
+    cmd: ${simpleresponderpath} --port ${PORT} --silent --respond model1
+`
+	if !assert.NoError(t, os.WriteFile(keyFile, []byte("before"), 0600)) {
+		return
+	}
+	pm := New(loadReloadTestConfig(t, configStr))
+	oldModel1, _ := pm.findGroupByModelName("model1").GetMember("model1")
+
+	if !assert.NoError(t, os.WriteFile(keyFile, []byte("after"), 0600)) {
+		return
+	}
+	newPM := pm.Reload(loadReloadTestConfig(t, configStr))
+	defer newPM.StopProcesses(StopWaitForInflightRequest)
+
+	// the model does not use the changed secret
+	newModel1, _ := newPM.findGroupByModelName("model1").GetMember("model1")
+	assert.Same(t, oldModel1, newModel1)
+	assert.Equal(t, []string{"after"}, newPM.config.RequiredAPIKeys)
+}
+
+func TestProxyManager_ReloadConfigFile(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	configStr := strings.ReplaceAll(`
+logLevel: error
+apiKeys: [test-key]
+models:
+  model1:
+    cmd: ${simpleresponderpath} --port ${PORT} --silent --respond model1
+`, "${simpleresponderpath}", simpleResponderPath)
+	if !assert.NoError(t, os.WriteFile(configPath, []byte(configStr), 0644)) {
+		return
+	}
+	source, err := config.ReadSource(configPath)
+	if !assert.NoError(t, err) {
+		return
+	}
+	conf, err := source.Load()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	first := New(conf)
+	first.SetConfigSource(source)
+	current := first
+	first.OnReload(func(newPM *ProxyManager) {
+		current = newPM
+	})
+	defer func() {
+		current.StopProcesses(StopWaitForInflightRequest)
+	}()
+
+	// a model added through the API without persisting it replaces the ProxyManager
+	req := httptest.NewRequest("POST", "/api/config/models/model2", strings.NewReader(fmt.Sprintf(`{"cmd": "%s --port ${PORT} --silent --respond model2"}`, simpleResponderPath)))
+	req.Header.Set("x-api-key", "test-key")
+	w := CreateTestResponseRecorder()
+	first.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	afterAPI := current
+	assert.NotSame(t, first, afterAPI)
+
+	req = httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"model2"}`))
+	req.Header.Set("x-api-key", "test-key")
+	w = CreateTestResponseRecorder()
+	afterAPI.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	model2, _ := afterAPI.findGroupByModelName("model2").GetMember("model2")
+
+	// the reload starts from the latest configuration even when called on an older
+	// ProxyManager, the unsaved model is removed and stopped
+	newPM := first.ReloadConfigFile(source, conf)
+	assert.Same(t, newPM, current)
+	_, found := newPM.config.Models["model2"]
+	assert.False(t, found)
+	assert.Equal(t, StateShutdown, model2.CurrentState())
+}
@@ -10,6 +10,8 @@ import (
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -152,6 +154,74 @@ func TestProxyManager_PersistentGroupsAreNotSwapped(t *testing.T) {
 
 // When a request for a different model comes in ProxyManager should wait until
 // the first request is complete before swapping. Both requests should complete
+func TestProxyManager_Profiles(t *testing.T) {
+	config := config.AddDefaultGroupToConfig(config.Config{
+		HealthCheckTimeout: 15,
+		Models: map[string]config.ModelConfig{
+			"model1": getTestSimpleResponderConfig("model1"),
+			"model2": getTestSimpleResponderConfig("model2"),
+			"model3": getTestSimpleResponderConfig("model3"),
+		},
+		Profiles: map[string][]string{
+			"coding": {"model1", "model2"},
+		},
+		LogLevel: "error",
+	})
+
+	proxy := New(config)
+	defer proxy.StopProcesses(StopWaitForInflightRequest)
+
+	request := func(model string) *TestResponseRecorder {
+		reqBody := fmt.Sprintf(`{"model":"%s"}`, model)
+		req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(reqBody))
+		w := CreateTestResponseRecorder()
+		proxy.ServeHTTP(w, req)
+		return w
+	}
+	state := func(modelID string) ProcessState {
+		return proxy.findGroupByModelName(modelID).processes[modelID].CurrentState()
+	}
+
+	// the profile is listed in /v1/models
+	req := httptest.NewRequest("GET", "/v1/models", nil)
+	w := CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, req)
+	assert.Contains(t, w.Body.String(), `"id":"coding:model1"`)
+	assert.Contains(t, w.Body.String(), `"id":"coding:model2"`)
+	assert.NotContains(t, w.Body.String(), `"id":"coding:model3"`)
+
+	// model3 is stopped when the profile is loaded
+	w = request("model3")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, StateReady, state("model3"))
+
+	// requesting one model in the profile loads all of them
+	w = request("coding:model1")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "model1")
+	assert.Equal(t, StateStopped, state("model3"))
+	assert.Eventually(t, func() bool {
+		return state("model2") == StateReady
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// the other member can be used by its plain name without swapping
+	w = request("model2")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "model2")
+	assert.Equal(t, StateReady, state("model1"))
+
+	// a model outside of the profile swaps the profile out
+	w = request("model3")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "model3")
+	assert.Equal(t, StateStopped, state("model1"))
+	assert.Equal(t, StateStopped, state("model2"))
+
+	// unknown profile members are not found
+	w = request("coding:model3")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
 func TestProxyManager_SwapMultiProcessParallelRequests(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping slow test")
@@ -1259,6 +1329,182 @@ func TestProxyManager_ApiGetVersion(t *testing.T) {
 	}
 }
 
+func TestProxyManager_ApiConfigModels(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	configStr := strings.ReplaceAll(`# managed by llama-swap
+logLevel: error
+apiKeys: [test-key]
+models:
+  model1:
+    cmd: ${simpleresponderpath} --port ${PORT} --silent --respond model1
+`, "${simpleresponderpath}", simpleResponderPath)
+	if !assert.NoError(t, os.WriteFile(configPath, []byte(configStr), 0644)) {
+		return
+	}
+
+	source, err := config.ReadSource(configPath)
+	if !assert.NoError(t, err) {
+		return
+	}
+	conf, err := source.Load()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	current := New(conf)
+	current.SetConfigSource(source)
+	current.OnReload(func(newPM *ProxyManager) {
+		current = newPM
+	})
+	defer func() {
+		current.StopProcesses(StopWaitForInflightRequest)
+	}()
+
+	send := func(method, url, body string) *TestResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("x-api-key", "test-key")
+		w := CreateTestResponseRecorder()
+		current.ServeHTTP(w, req)
+		return w
+	}
+
+	model2 := fmt.Sprintf(`{"cmd": "%s --port ${PORT} --silent --respond model2"}`, simpleResponderPath)
+
+	t.Run("create", func(t *testing.T) {
+		w := send("POST", "/api/config/models/model2", model2)
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.Contains(t, gjson.Get(w.Body.String(), "cmd").String(), "--respond model2")
+
+		w = send("POST", "/v1/chat/completions", `{"model":"model2"}`)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "model2")
+
+		w = send("POST", "/api/config/models/model2", model2)
+		assert.Equal(t, http.StatusConflict, w.Code)
+	})
+
+	t.Run("update", func(t *testing.T) {
+		w := send("PUT", "/api/config/models/model2?persist=true", strings.ReplaceAll(model2, "--respond model2", "--respond model2-updated"))
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		w = send("POST", "/v1/chat/completions", `{"model":"model2"}`)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "model2-updated")
+
+		// written back with the comment kept
+		data, err := os.ReadFile(configPath)
+		assert.NoError(t, err)
+		assert.True(t, strings.HasPrefix(string(data), "# managed by llama-swap\n"))
+		assert.Contains(t, string(data), "--respond model2-updated")
+
+		w = send("PUT", "/api/config/models/nope", model2)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		w := send("POST", "/api/config/models/model3", `{"cmd": "svr --port ${PORT} ${unknown}"}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, "invalid configuration", gjson.Get(w.Body.String(), "error").String())
+		assert.Contains(t, gjson.Get(w.Body.String(), "errors.0").String(), "unknown macro '${unknown}'")
+
+		w = send("POST", "/api/config/models/model3", `not an object`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("get", func(t *testing.T) {
+		w := send("GET", "/api/config", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.True(t, gjson.Get(w.Body.String(), "models.model1").Exists())
+		assert.True(t, gjson.Get(w.Body.String(), "models.model2").Exists())
+		assert.False(t, gjson.Get(w.Body.String(), "models.model3").Exists())
+	})
+
+	t.Run("id with a slash", func(t *testing.T) {
+		orgModel := strings.ReplaceAll(model2, "--respond model2", "--respond org-model")
+		w := send("POST", "/api/config/models/org/model", orgModel)
+		assert.Equal(t, http.StatusCreated, w.Code)
+		_, found := current.config.Models["org/model"]
+		assert.True(t, found)
+
+		w = send("PUT", "/api/config/models/org/model", strings.ReplaceAll(orgModel, "org-model", "org-model-updated"))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, current.config.Models["org/model"].Cmd, "org-model-updated")
+
+		w = send("DELETE", "/api/config/models/org/model", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		_, found = current.config.Models["org/model"]
+		assert.False(t, found)
+
+		w = send("POST", "/api/config/models/", orgModel)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		w := send("DELETE", "/api/config/models/model2", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		_, found := current.config.Models["model2"]
+		assert.False(t, found)
+
+		w = send("DELETE", "/api/config/models/model2", "")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+}
+
+func TestProxyManager_ApiConfigModelsWithoutSource(t *testing.T) {
+	proxy := New(config.AddDefaultGroupToConfig(config.Config{
+		HealthCheckTimeout: 15,
+		Models: map[string]config.ModelConfig{
+			"model1": getTestSimpleResponderConfig("model1"),
+		},
+		LogLevel: "error",
+	}))
+	defer proxy.StopProcesses(StopWaitForInflightRequest)
+
+	req := httptest.NewRequest("DELETE", "/api/config/models/model1", nil)
+	w := CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+}
+
+func TestProxyManager_ApiConfigModelsWithoutAPIKeys(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	configStr := strings.ReplaceAll(`
+logLevel: error
+models:
+  model1:
+    cmd: ${simpleresponderpath} --port ${PORT} --silent --respond model1
+`, "${simpleresponderpath}", simpleResponderPath)
+	if !assert.NoError(t, os.WriteFile(configPath, []byte(configStr), 0644)) {
+		return
+	}
+	source, err := config.ReadSource(configPath)
+	if !assert.NoError(t, err) {
+		return
+	}
+	conf, err := source.Load()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	proxy := New(conf)
+	proxy.SetConfigSource(source)
+	defer proxy.StopProcesses(StopWaitForInflightRequest)
+
+	// anyone could run a cmd on the host when the configuration can be changed without a key
+	for _, method := range []string{"POST", "PUT", "DELETE"} {
+		req := httptest.NewRequest(method, "/api/config/models/model1", strings.NewReader(`{"cmd": "sh -c 'id' --port ${PORT}"}`))
+		w := CreateTestResponseRecorder()
+		proxy.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusForbidden, w.Code, method)
+	}
+	assert.Contains(t, proxy.config.Models["model1"].Cmd, "--respond model1")
+
+	// the configuration has the expanded cmd of every model
+	w := CreateTestResponseRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "/api/config", nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
 func TestProxyManager_APIKeyAuth(t *testing.T) {
 	testConfig := config.AddDefaultGroupToConfig(config.Config{
 		HealthCheckTimeout: 15,
@@ -12,6 +12,18 @@ export interface Model {
   parameter_size?: string;
   quantization_level?: string;
   capabilities?: string[];
+  port?: number;
+  profiles?: string[];
+  lastExit?: ExitRecord;
+}
+
+export interface ExitRecord {
+  exitCode: number;
+  signal?: string;
+  state: ModelStatus;
+  time: string;
+  durationMs: number;
+  logs: string;
 }
 
 export interface Metrics {
@@ -24,6 +36,8 @@ export interface Metrics {
   prompt_per_second: number;
   tokens_per_second: number;
   duration_ms: number;
+  queue_depth: number;
+  queue_wait_ms: number;
   has_capture: boolean;
 }
 